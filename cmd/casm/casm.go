@@ -3,14 +3,17 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/Supercaly/coppervm/internal"
 	c "github.com/Supercaly/coppervm/pkg/casm"
 	"github.com/Supercaly/coppervm/pkg/coppervm"
+	"github.com/Supercaly/coppervm/pkg/coverage"
 )
 
 func usage(stream io.Writer, program string) {
@@ -20,12 +23,19 @@ func usage(stream io.Writer, program string) {
 	fmt.Fprintf(stream, "    -I <include/path>    		Add include path.\n")
 	fmt.Fprintf(stream, "    -o <out.vm>          		Specify the output path.\n")
 	fmt.Fprintf(stream, "    -d                   		Add debug symbols to use with copperdb.\n")
+	fmt.Fprintf(stream, "    -m <capacity>        		Set the target memory capacity in bytes (default %d).\n", coppervm.CoppervmMemoryCapacity)
+	fmt.Fprintf(stream, "    -shared-stack        		Keep the return addresses on the data stack (old calling convention).\n")
+	fmt.Fprintf(stream, "    -coverage <data>     		Print the source annotated with the coverage data\n")
+	fmt.Fprintf(stream, "                         		recorded by emulator -coverage, without saving the program.\n")
+	fmt.Fprintf(stream, "    -lcov <out.info>     		With -coverage, write the coverage in the lcov format.\n")
 	fmt.Fprintf(stream, "    -v                   		Print verbose output.\n")
 	fmt.Fprintf(stream, "    -h                   		Print this help message.\n")
 }
 
 func main() {
 	casm := c.NewCasm()
+	var coveragePath string
+	var lcovPath string
 	args := os.Args
 	var program string
 	program, args = internal.Shift(args)
@@ -57,8 +67,34 @@ func main() {
 			}
 
 			casm.OutputFile, args = internal.Shift(args)
+		} else if flag == "-m" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			var capacityStr string
+			capacityStr, args = internal.Shift(args)
+			capacity, err := strconv.ParseInt(capacityStr, 10, 64)
+			if err != nil || capacity <= 0 {
+				log.Fatalf("[ERROR]: capacity argument must be a positive number!")
+			}
+			casm.MemoryCapacity = capacity
+		} else if flag == "-coverage" || flag == "-lcov" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			if flag == "-coverage" {
+				coveragePath, args = internal.Shift(args)
+			} else {
+				lcovPath, args = internal.Shift(args)
+			}
 		} else if flag == "-d" {
 			casm.AddDebugSymbols = true
+		} else if flag == "-shared-stack" {
+			casm.SharedCallStack = true
 		} else if flag == "-I" {
 			if len(args) == 0 {
 				usage(os.Stderr, program)
@@ -85,6 +121,11 @@ func main() {
 		log.Fatalf("[ERROR]: input was not provided\n")
 	}
 
+	if lcovPath != "" && coveragePath == "" {
+		usage(os.Stderr, program)
+		log.Fatalf("[ERROR]: -lcov requires the coverage data given with -coverage\n")
+	}
+
 	if casm.OutputFile == "" {
 		fileName := filepath.Base(casm.InputFile)
 		fileDir := filepath.Dir(casm.InputFile)
@@ -100,7 +141,57 @@ func main() {
 	if err := casm.TranslateSourceFile(casm.InputFile); err != nil {
 		log.Fatalf("[ERROR]: %s", err)
 	}
+	if coveragePath != "" {
+		if err := reportCoverage(&casm, coveragePath, lcovPath); err != nil {
+			log.Fatalf("[ERROR]: %s", err)
+		}
+		return
+	}
 	if err := casm.SaveProgramToFile(); err != nil {
 		log.Fatalf("[ERROR]: %s", err)
 	}
 }
+
+// Print the source files of the program annotated with the
+// coverage data and optionally write the lcov file.
+func reportCoverage(casm *c.Casm, coveragePath string, lcovPath string) error {
+	cov, err := coverage.ReadFile(coveragePath)
+	if err != nil {
+		return err
+	}
+
+	var lines []coverage.SourceLine
+	for _, location := range casm.SourceLocations() {
+		lines = append(lines, coverage.SourceLine{File: location.FileName, Line: location.Row + 1})
+	}
+	files, err := cov.Files(lines)
+	if err != nil {
+		return fmt.Errorf("%s: %s", coveragePath, err)
+	}
+
+	for i, fc := range files {
+		source, err := ioutil.ReadFile(fc.Name)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := coverage.WriteAnnotated(os.Stdout, fc, source); err != nil {
+			return err
+		}
+	}
+
+	if lcovPath != "" {
+		f, err := os.Create(lcovPath)
+		if err != nil {
+			return err
+		}
+		if err := coverage.WriteLcov(f, files); err != nil {
+			f.Close()
+			return fmt.Errorf("error writing file '%s': %s", lcovPath, err)
+		}
+		return f.Close()
+	}
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 
@@ -52,21 +53,31 @@ func main() {
 		log.Fatalf("[ERROR]: input was not provided\n")
 	}
 
-	vm := coppervm.Coppervm{}
-	if _, err := vm.LoadProgramFromFile(inputFilePath); err != nil {
+	// The file is parsed without loading it in a vm, so
+	// the static memory can be bigger than the default capacity
+	content, err := ioutil.ReadFile(inputFilePath)
+	if err != nil {
 		log.Fatalf("[ERROR]: %s", err)
 	}
+	meta, err := coppervm.ParseFileMeta(content)
+	if err != nil {
+		log.Fatalf("[ERROR]: error reading content of file '%s': %s", inputFilePath, err)
+	}
 
 	// Dump memory to stdout
 	if printMemory {
-		vm.DumpMemory()
-		println()
+		fmt.Fprintln(os.Stdout, "Memory:")
+		for _, b := range meta.Memory {
+			fmt.Fprintf(os.Stdout, "%x ", b)
+		}
+		fmt.Fprintln(os.Stdout)
 	}
 
 	// Dump program to stdout
-	fmt.Fprintf(os.Stdout, "Entry point: %d\n", vm.Ip)
-	for i := 0; i < len(vm.Program); i++ {
-		inst := vm.Program[i]
+	fmt.Fprintf(os.Stdout, "File version: %d\n", meta.Version)
+	fmt.Fprintf(os.Stdout, "Entry point: %d\n", meta.Entry)
+	for i := 0; i < len(meta.Program); i++ {
+		inst := meta.Program[i]
 		if printLineNbr {
 			fmt.Fprintf(os.Stdout, "%d: ", i)
 		}
@@ -1,23 +1,67 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/Supercaly/coppervm/internal"
 	"github.com/Supercaly/coppervm/pkg/coppervm"
+	"github.com/Supercaly/coppervm/pkg/coverage"
+	"github.com/Supercaly/coppervm/pkg/profiler"
 )
 
 func usage(stream io.Writer, program string) {
-	fmt.Fprintf(stream, "Usage: %s [OPTIONS] <input.vm>\n", program)
+	fmt.Fprintf(stream, "Usage: %s [OPTIONS] <input.vm> [-- <args>...]\n", program)
 	fmt.Fprintf(stream, "OPTIONS:\n")
 	fmt.Fprintf(stream, "    -l <limit>      Limit the steps of the emulation.\n")
 	fmt.Fprintf(stream, "                    If negative no limit will be set.\n")
+	fmt.Fprintf(stream, "    -s <capacity>   Set the stack capacity in words (default %d).\n", coppervm.CoppervmStackCapacity)
+	fmt.Fprintf(stream, "    -c <capacity>   Set the call stack capacity (default %d).\n", coppervm.CoppervmCallStackCapacity)
+	fmt.Fprintf(stream, "    -m <capacity>   Set the memory capacity in bytes (default %d).\n", coppervm.CoppervmMemoryCapacity)
+	fmt.Fprintf(stream, "    -fs <kind>      Set the filesystem used by the program (default os).\n")
+	fmt.Fprintf(stream, "                    os:   unrestricted access to the host filesystem.\n")
+	fmt.Fprintf(stream, "                    jail: access restricted to the root directory.\n")
+	fmt.Fprintf(stream, "                    mem:  empty in-memory filesystem.\n")
+	fmt.Fprintf(stream, "    -root <dir>     Set the root directory of the jail filesystem (default .).\n")
+	fmt.Fprintf(stream, "    -seed <seed>    Set the seed of the random numbers and use a virtual\n")
+	fmt.Fprintf(stream, "                    clock, so the execution is reproducible.\n")
+	fmt.Fprintf(stream, "    -shared-stack   Keep the return addresses on the data stack.\n")
+	fmt.Fprintf(stream, "                    Programs assembled before the call stack\n")
+	fmt.Fprintf(stream, "                    always run in this mode.\n")
+	fmt.Fprintf(stream, "    -timeout <duration>\n")
+	fmt.Fprintf(stream, "                    Stop the program with an error after duration\n")
+	fmt.Fprintf(stream, "                    (like 500ms or 2m) of wall-clock time.\n")
+	fmt.Fprintf(stream, "    -gas <limit>    Stop the program with an error when it runs out of gas;\n")
+	fmt.Fprintf(stream, "                    every instruction costs %d and system calls %d more.\n", coppervm.DefaultInstGas, coppervm.DefaultSyscallGas)
+	fmt.Fprintf(stream, "    -gas-table <file>\n")
+	fmt.Fprintf(stream, "                    Read the cost of the instructions and system calls\n")
+	fmt.Fprintf(stream, "                    from file, with lines like `push 2` or `syscall write 50`.\n")
+	fmt.Fprintf(stream, "    -trace          Print every executed instruction to stderr.\n")
+	fmt.Fprintf(stream, "    -profile <file> Write a report of the executed instructions per\n")
+	fmt.Fprintf(stream, "                    function to file (- for stderr).\n")
+	fmt.Fprintf(stream, "    -pprof <file>   Write the profile in the pprof format to file.\n")
+	fmt.Fprintf(stream, "    -coverage <file>\n")
+	fmt.Fprintf(stream, "                    Add the executed instructions to the coverage\n")
+	fmt.Fprintf(stream, "                    data file; see the report with casm -coverage.\n")
+	fmt.Fprintf(stream, "    -snapshot <file>\n")
+	fmt.Fprintf(stream, "                    Write the state of the vm to file when requested\n")
+	fmt.Fprintf(stream, "                    by -snapshot-at or -snapshot-signal.\n")
+	fmt.Fprintf(stream, "    -snapshot-at <step>\n")
+	fmt.Fprintf(stream, "                    Write the snapshot after executing step instructions.\n")
+	fmt.Fprintf(stream, "    -snapshot-signal\n")
+	fmt.Fprintf(stream, "                    Write the snapshot every time the emulator receives\n")
+	fmt.Fprintf(stream, "                    SIGUSR1 (not available on Windows).\n")
+	fmt.Fprintf(stream, "    -resume <file>  Resume the program from a snapshot.\n")
 	fmt.Fprintf(stream, "    -v              Print verbose messages.\n")
 	fmt.Fprintf(stream, "    -h              Print this help message.\n")
+	fmt.Fprintf(stream, "The arguments after -- are passed to the program.\n")
 }
 
 func main() {
@@ -26,12 +70,29 @@ func main() {
 	program, args = internal.Shift(args)
 	var inputFilePath string
 	var limit int = -1
+	var vmOptions []coppervm.CoppervmOption
+	var fsKind string = "os"
+	var fsRoot string = "."
+	var programArgs []string
+	var profilePath string
+	var pprofPath string
+	var coveragePath string
+	var snapshotPath string
+	var snapshotAt int = -1
+	var snapshotOnSignal bool
+	var resumePath string
+	var gasLimit int64 = -1
+	var gasTablePath string
+	var timeout time.Duration
 
 	for len(args) > 0 {
 		var flag string
 		flag, args = internal.Shift(args)
 
-		if flag == "-h" {
+		if flag == "--" {
+			programArgs = args
+			break
+		} else if flag == "-h" {
 			usage(os.Stdout, program)
 			os.Exit(0)
 		} else if flag == "-l" {
@@ -47,6 +108,127 @@ func main() {
 			if err != nil {
 				log.Fatalf("[ERROR]: limit argument must be a number!")
 			}
+		} else if flag == "-s" || flag == "-c" || flag == "-m" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			var capacityStr string
+			capacityStr, args = internal.Shift(args)
+			capacity, err := strconv.ParseInt(capacityStr, 10, 64)
+			if err != nil || capacity <= 0 {
+				log.Fatalf("[ERROR]: capacity argument must be a positive number!")
+			}
+			if flag == "-s" {
+				vmOptions = append(vmOptions, coppervm.WithStackCapacity(capacity))
+			} else if flag == "-c" {
+				vmOptions = append(vmOptions, coppervm.WithCallStackCapacity(capacity))
+			} else {
+				vmOptions = append(vmOptions, coppervm.WithMemoryCapacity(capacity))
+			}
+		} else if flag == "-fs" || flag == "-root" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			if flag == "-fs" {
+				fsKind, args = internal.Shift(args)
+			} else {
+				fsRoot, args = internal.Shift(args)
+			}
+		} else if flag == "-seed" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			var seedStr string
+			seedStr, args = internal.Shift(args)
+			seed, err := strconv.ParseUint(seedStr, 0, 64)
+			if err != nil {
+				log.Fatalf("[ERROR]: seed argument must be a positive number!")
+			}
+			vmOptions = append(vmOptions,
+				coppervm.WithRandomSeed(seed),
+				coppervm.WithClock(coppervm.NewVirtualClock(time.Unix(0, 0))))
+		} else if flag == "-shared-stack" {
+			vmOptions = append(vmOptions, coppervm.WithSharedCallStack())
+		} else if flag == "-profile" || flag == "-pprof" || flag == "-coverage" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			if flag == "-profile" {
+				profilePath, args = internal.Shift(args)
+			} else if flag == "-pprof" {
+				pprofPath, args = internal.Shift(args)
+			} else {
+				coveragePath, args = internal.Shift(args)
+			}
+		} else if flag == "-snapshot" || flag == "-resume" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			if flag == "-snapshot" {
+				snapshotPath, args = internal.Shift(args)
+			} else {
+				resumePath, args = internal.Shift(args)
+			}
+		} else if flag == "-snapshot-at" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			var stepStr string
+			var err error
+			stepStr, args = internal.Shift(args)
+			snapshotAt, err = strconv.Atoi(stepStr)
+			if err != nil || snapshotAt < 0 {
+				log.Fatalf("[ERROR]: step argument must be a positive number!")
+			}
+		} else if flag == "-snapshot-signal" {
+			if snapshotSignal == nil {
+				log.Fatalf("[ERROR]: `%s` is not supported on this platform\n", flag)
+			}
+			snapshotOnSignal = true
+		} else if flag == "-timeout" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			var timeoutStr string
+			var err error
+			timeoutStr, args = internal.Shift(args)
+			timeout, err = time.ParseDuration(timeoutStr)
+			if err != nil || timeout <= 0 {
+				log.Fatalf("[ERROR]: timeout argument must be a positive duration!")
+			}
+		} else if flag == "-gas" || flag == "-gas-table" {
+			if len(args) == 0 {
+				usage(os.Stderr, program)
+				log.Fatalf("[ERROR]: No argument provided for flag `%s`\n", flag)
+			}
+
+			if flag == "-gas" {
+				var gasStr string
+				var err error
+				gasStr, args = internal.Shift(args)
+				gasLimit, err = strconv.ParseInt(gasStr, 10, 64)
+				if err != nil || gasLimit < 0 {
+					log.Fatalf("[ERROR]: gas argument must be a positive number!")
+				}
+			} else {
+				gasTablePath, args = internal.Shift(args)
+			}
+		} else if flag == "-trace" {
+			vmOptions = append(vmOptions, coppervm.WithHook(coppervm.NewTraceHook(os.Stderr)))
 		} else if flag == "-v" {
 			internal.EnableDebugPrint()
 		} else {
@@ -64,15 +246,215 @@ func main() {
 		log.Fatalf("[ERROR]: input was not provided\n")
 	}
 
+	if (snapshotAt >= 0 || snapshotOnSignal) && snapshotPath == "" {
+		usage(os.Stderr, program)
+		log.Fatalf("[ERROR]: no snapshot file provided with `-snapshot`\n")
+	}
+
+	if gasTablePath != "" && gasLimit < 0 {
+		usage(os.Stderr, program)
+		log.Fatalf("[ERROR]: no gas limit provided with `-gas`\n")
+	}
+	if gasLimit >= 0 {
+		table := coppervm.DefaultGasTable()
+		if gasTablePath != "" {
+			var err error
+			table, err = readGasTable(gasTablePath)
+			if err != nil {
+				log.Fatalf("[ERROR]: %s", err)
+			}
+		}
+		vmOptions = append(vmOptions, coppervm.WithGas(uint64(gasLimit), table))
+	}
+
+	switch fsKind {
+	case "os":
+		vmOptions = append(vmOptions, coppervm.WithFileSystem(coppervm.OSFileSystem{}))
+	case "jail":
+		fs, err := coppervm.NewJailFileSystem(fsRoot)
+		if err != nil {
+			log.Fatalf("[ERROR]: %s", err)
+		}
+		vmOptions = append(vmOptions, coppervm.WithFileSystem(fs))
+	case "mem":
+		vmOptions = append(vmOptions, coppervm.WithFileSystem(coppervm.NewMemFileSystem()))
+	default:
+		usage(os.Stderr, program)
+		log.Fatalf("[ERROR]: unknown filesystem `%s`\n", fsKind)
+	}
+
+	// The first argument of the program is its path
+	programArgs = append([]string{inputFilePath}, programArgs...)
+	vmOptions = append(vmOptions, coppervm.WithArgs(programArgs))
+
 	// Load and execute the program
-	vm := coppervm.Coppervm{}
-	if _, err := vm.LoadProgramFromFile(inputFilePath); err != nil {
+	vm := coppervm.NewCoppervm(vmOptions...)
+	meta, err := vm.LoadProgramFromFile(inputFilePath)
+	if err != nil {
 		log.Fatalf("[ERROR]: %s", err)
 	}
-	if err := vm.ExecuteProgram(limit); err.Kind != coppervm.ErrorKindOk {
-		log.Fatalf("%s: [ERROR]: %s", inputFilePath, *err)
+	var prof *profiler.Profiler
+	if profilePath != "" || pprofPath != "" {
+		prof = profiler.New(meta.Program, meta.DebugSymbols, meta.LineTable)
+		vm.AddHook(prof)
+	}
+	var cov *coverage.Coverage
+	if coveragePath != "" {
+		cov = coverage.New(len(meta.Program))
+		vm.AddHook(cov)
+	}
+	if resumePath != "" {
+		if err := restoreSnapshot(vm, resumePath); err != nil {
+			log.Fatalf("[ERROR]: %s", err)
+		}
+	}
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	var execErr error
+	if snapshotPath != "" {
+		execErr = executeWithSnapshots(ctx, vm, limit, snapshotPath, snapshotAt, snapshotOnSignal)
+	} else {
+		execErr = vm.ExecuteProgramContext(ctx, limit)
+	}
+
+	// Write the profile and the coverage even if the program failed
+	if prof != nil {
+		writeProfiles(prof, profilePath, pprofPath)
+	}
+	if cov != nil {
+		if err := writeCoverage(cov, coveragePath); err != nil {
+			log.Fatalf("[ERROR]: %s", err)
+		}
+	}
+	if gas, metered := vm.RemainingGas(); metered {
+		internal.DebugPrint("[INFO]: %d gas used, %d left\n", uint64(gasLimit)-gas, gas)
+	}
+	if execErr != nil {
+		log.Fatalf("%s: [ERROR]: %s", inputFilePath, execErr)
 	}
 
 	// Exit the program with vm's exit code
 	os.Exit(vm.ExitCode)
 }
+
+// Execute the program like Coppervm.ExecuteProgramContext writing
+// a snapshot to path after snapshotAt steps, if not negative, and
+// every time the snapshot signal is received.
+func executeWithSnapshots(ctx context.Context, vm *coppervm.Coppervm, limit int, path string, snapshotAt int, onSignal bool) error {
+	var requested int32
+	if onSignal {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, snapshotSignal)
+		defer func() {
+			signal.Stop(signals)
+			close(signals)
+		}()
+		go func() {
+			for range signals {
+				atomic.StoreInt32(&requested, 1)
+			}
+		}()
+	}
+
+	for step := 0; limit != 0 && !vm.Halt; {
+		if step == snapshotAt || atomic.SwapInt32(&requested, 0) == 1 {
+			if err := writeFile(path, vm.Snapshot); err != nil {
+				return err
+			}
+			internal.DebugPrint("[INFO]: snapshot at step %d saved to '%s'\n", step, path)
+		}
+		// Execute in batches that stop at the snapshot step, so the
+		// context is checked once per batch and the signal is
+		// handled at most CoppervmContextCheckInterval steps later
+		batch := coppervm.CoppervmContextCheckInterval
+		if snapshotAt > step && snapshotAt-step < batch {
+			batch = snapshotAt - step
+		}
+		if limit > 0 && limit < batch {
+			batch = limit
+		}
+		if err := vm.ExecuteProgramContext(ctx, batch); err != nil {
+			return err
+		}
+		step += batch
+		if limit > 0 {
+			limit -= batch
+		}
+	}
+	return nil
+}
+
+// Restore the state of the vm from a snapshot file.
+func restoreSnapshot(vm *coppervm.Coppervm, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := vm.Restore(f); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return nil
+}
+
+// Read the costs of the instructions from a file.
+func readGasTable(path string) (coppervm.GasTable, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return coppervm.GasTable{}, err
+	}
+	defer f.Close()
+	table, err := coppervm.ParseGasTable(f)
+	if err != nil {
+		return coppervm.GasTable{}, fmt.Errorf("%s:%s", path, err)
+	}
+	return table, nil
+}
+
+// Write the report and the pprof profile to the given paths;
+// an empty path is skipped.
+func writeProfiles(prof *profiler.Profiler, profilePath string, pprofPath string) {
+	if profilePath == "-" {
+		prof.WriteReport(os.Stderr)
+	} else if profilePath != "" {
+		if err := writeFile(profilePath, prof.WriteReport); err != nil {
+			log.Fatalf("[ERROR]: %s", err)
+		}
+	}
+	if pprofPath != "" {
+		if err := writeFile(pprofPath, prof.WritePprof); err != nil {
+			log.Fatalf("[ERROR]: %s", err)
+		}
+	}
+}
+
+// Write the coverage to a data file, merging it with the
+// coverage of the previous runs already in the file.
+func writeCoverage(cov *coverage.Coverage, path string) error {
+	old, err := coverage.ReadFile(path)
+	if err == nil {
+		if err := cov.Merge(old); err != nil {
+			return fmt.Errorf("%s: %s", path, err)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	return writeFile(path, cov.WriteData)
+}
+
+// Create a file and fill it with given write function.
+func writeFile(path string, write func(w io.Writer) error) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing file '%s': %s", path, err)
+	}
+	return f.Close()
+}
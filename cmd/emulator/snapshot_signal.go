@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// Signal that requests a snapshot of the running program.
+var snapshotSignal os.Signal = syscall.SIGUSR1
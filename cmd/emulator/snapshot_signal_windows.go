@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// Windows has no user signals, so the snapshots can
+// only be requested by step count.
+var snapshotSignal os.Signal = nil
@@ -30,13 +30,22 @@ type Casm struct {
 	IncludePaths []string
 
 	AddDebugSymbols bool
+
+	// Memory capacity in bytes of the target machine;
+	// zero means coppervm.CoppervmMemoryCapacity.
+	MemoryCapacity int64
+
+	// Keep the return addresses on the data stack like
+	// the programs before the separate call stack.
+	SharedCallStack bool
 }
 
 // Return a new instance of Casm.
 func NewCasm() Casm {
 	intRep := internalRep{}
 	casm := Casm{
-		internalRep: &intRep,
+		internalRep:    &intRep,
+		MemoryCapacity: coppervm.CoppervmMemoryCapacity,
 	}
 	casm.copperGen.rep = &intRep
 	casm.x86_64Gen.rep = &intRep
@@ -65,9 +74,7 @@ func (casm *Casm) TranslateSourceFile(filePath string) (err error) {
 	irs := casm.translateTokensToIR(&tokens)
 
 	// Translate intermediate representation
-	casm.TranslateIntermediateRep(irs)
-
-	return err
+	return casm.TranslateIntermediateRep(irs)
 }
 
 // Translate an Intermediate Representation to an in-memory program.
@@ -84,6 +91,21 @@ func (casm *Casm) TranslateIntermediateRep(ir []IR) (err error) {
 	// Generate an internal program from IR
 	casm.internalRep.firstPass(ir)
 	casm.internalRep.secondPass()
+	casm.internalRep.checkTryFrames()
+
+	// Check the static memory fits the target memory
+	memoryCapacity := casm.MemoryCapacity
+	if memoryCapacity == 0 {
+		memoryCapacity = coppervm.CoppervmMemoryCapacity
+	}
+	if int64(len(casm.internalRep.memory)) > memoryCapacity {
+		panic(fmt.Sprintf("static memory of %d bytes exceeds the target memory capacity of %d bytes",
+			len(casm.internalRep.memory),
+			memoryCapacity))
+	}
+	casm.x86_64Gen.memoryCapacity = memoryCapacity
+	casm.x86_64Gen.sharedCallStack = casm.SharedCallStack
+	casm.copperGen.sharedCallStack = casm.SharedCallStack
 
 	// Generate the output program depending on the build target
 	switch casm.Target {
@@ -108,7 +130,7 @@ func (casm *Casm) SaveProgramToFile() (err error) {
 	}()
 
 	// generate the correct source program
-	var programSource string
+	var programSource []byte
 	switch casm.Target {
 	case BuildTargetCopper:
 		programSource = casm.copperGen.saveProgram(casm.AddDebugSymbols)
@@ -116,14 +138,14 @@ func (casm *Casm) SaveProgramToFile() (err error) {
 			panic(fmt.Errorf("file '%s' is not a valid %s file", casm.OutputFile, coppervm.CoppervmFileExtention))
 		}
 	case BuildTargetX86_64Linux:
-		programSource = casm.x86_64Gen.saveProgram()
+		programSource = []byte(casm.x86_64Gen.saveProgram())
 		if filepath.Ext(casm.OutputFile) != ".asm" {
 			panic(fmt.Errorf("file '%s' is not a valid %s file", casm.OutputFile, ".asm"))
 		}
 	}
 
 	// save program to file
-	if err := ioutil.WriteFile(casm.OutputFile, []byte(programSource), os.ModePerm); err != nil {
+	if err := ioutil.WriteFile(casm.OutputFile, programSource, os.ModePerm); err != nil {
 		panic(fmt.Errorf("error saving file '%s': %s", casm.OutputFile, err))
 	}
 
@@ -131,6 +153,12 @@ func (casm *Casm) SaveProgramToFile() (err error) {
 	return err
 }
 
+// Returns the source location of every instruction of the
+// in-memory program, indexed by instruction address.
+func (casm *Casm) SourceLocations() []FileLocation {
+	return casm.internalRep.locations
+}
+
 // Convert tokens to intermediate representation.
 func (casm *Casm) translateTokensToIR(tokens *tokens) (out []IR) {
 	for !tokens.Empty() {
@@ -2,8 +2,10 @@ package casm
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/Supercaly/coppervm/pkg/coppervm"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -59,9 +61,9 @@ func TestTranslateSourceFile(t *testing.T) {
 		{"testdata/test1.casm", true},
 		{"testdata/test.casm", false},
 	}
-	casm := Casm{}
 
 	for _, test := range tests {
+		casm := NewCasm()
 		err := casm.TranslateSourceFile(test.path)
 
 		if test.hasError {
@@ -143,3 +145,232 @@ func TestTranslateIR(t *testing.T) {
 		}()
 	}
 }
+
+func TestTranslateIntermediateRepMemoryCapacity(t *testing.T) {
+	tests := []struct {
+		capacity int64
+		hasError bool
+	}{
+		{0, false},
+		{16, false},
+		{8, true},
+	}
+
+	for _, test := range tests {
+		casm := NewCasm()
+		casm.MemoryCapacity = test.capacity
+		err := casm.TranslateIntermediateRep([]IR{
+			ir(IRKindMemory, MemoryIR{"m", expression(ExpressionKindByteList, make([]byte, 16))}, FileLocation{}),
+			ir(IRKindInstruction, InstructionIR{Name: "halt"}, FileLocation{}),
+		})
+
+		if test.hasError {
+			assert.Error(t, err, test)
+		} else {
+			assert.NoError(t, err, test)
+		}
+	}
+}
+
+func TestSharedCallStack(t *testing.T) {
+	tests := []struct {
+		shared  bool
+		version int
+	}{
+		{false, coppervm.CoppervmFileVersion},
+		{true, coppervm.CoppervmSharedStackFileVersion},
+	}
+
+	for _, test := range tests {
+		casm := NewCasm()
+		casm.SharedCallStack = test.shared
+		err := casm.TranslateIntermediateRep([]IR{
+			ir(IRKindInstruction, InstructionIR{Name: "halt"}, FileLocation{}),
+		})
+		assert.NoError(t, err, test)
+
+		meta, err := coppervm.ParseFileMeta(casm.copperGen.saveProgram(false))
+		assert.NoError(t, err, test)
+		assert.Equal(t, test.version, meta.Version, test)
+	}
+}
+
+func TestSourceLocations(t *testing.T) {
+	casm := NewCasm()
+	err := casm.TranslateSourceFile("testdata/test.casm")
+	assert.NoError(t, err)
+
+	locations := casm.SourceLocations()
+	assert.Len(t, locations, 6)
+	assert.Equal(t, FileLocation{FileName: "testdata/test.casm", Col: 4, Row: 3}, locations[0])
+	assert.Equal(t, FileLocation{FileName: "testdata/test.casm", Col: 4, Row: 8}, locations[5])
+}
+
+func TestDebugLineTable(t *testing.T) {
+	casm := NewCasm()
+	casm.IncludePaths = []string{"testdata"}
+	err := casm.TranslateSourceFile("testdata/include.casm")
+	assert.NoError(t, err)
+
+	meta, err := coppervm.ParseFileMeta(casm.copperGen.saveProgram(true))
+	assert.NoError(t, err)
+	assert.Len(t, meta.LineTable, 7)
+	assert.Equal(t, coppervm.SourceLocation{Address: 0, File: "testdata/test.casm", Row: 4, Col: 5}, meta.LineTable[0])
+	assert.Equal(t, coppervm.SourceLocation{Address: 6, File: "testdata/include.casm", Row: 4, Col: 5}, meta.LineTable[6])
+
+	// The line table is part of the debug symbols
+	casm = NewCasm()
+	err = casm.TranslateSourceFile("testdata/test.casm")
+	assert.NoError(t, err)
+	meta, err = coppervm.ParseFileMeta(casm.copperGen.saveProgram(false))
+	assert.NoError(t, err)
+	assert.Empty(t, meta.LineTable)
+}
+
+func TestX86_64ThreadSyscalls(t *testing.T) {
+	casm := NewCasm()
+	casm.Target = BuildTargetX86_64Linux
+	err := casm.TranslateIntermediateRep([]IR{
+		ir(IRKindInstruction, InstructionIR{Name: "syscall", Operand: expression(ExpressionKindNumLitInt, int64(coppervm.SysCallYield))}, FileLocation{FileName: "a.casm", Row: 2}),
+		ir(IRKindInstruction, InstructionIR{Name: "halt"}, FileLocation{}),
+	})
+	assert.EqualError(t, err, "a.casm:3:1: system call 'yield' is not supported by the x86-64 target")
+}
+
+func TestX86_64TrapSyscall(t *testing.T) {
+	casm := NewCasm()
+	casm.Target = BuildTargetX86_64Linux
+	err := casm.TranslateIntermediateRep([]IR{
+		ir(IRKindInstruction, InstructionIR{Name: "syscall", Operand: expression(ExpressionKindNumLitInt, int64(coppervm.SysCallTrap))}, FileLocation{FileName: "a.casm", Row: 0}),
+	})
+	assert.EqualError(t, err, "a.casm:1:1: system call 'trap' is not supported by the x86-64 target")
+}
+
+func TestX86_64Atomic(t *testing.T) {
+	casm := NewCasm()
+	casm.Target = BuildTargetX86_64Linux
+	err := casm.TranslateIntermediateRep([]IR{
+		ir(IRKindInstruction, InstructionIR{Name: "cas"}, FileLocation{}),
+		ir(IRKindInstruction, InstructionIR{Name: "xadd"}, FileLocation{}),
+		ir(IRKindInstruction, InstructionIR{Name: "xadd"}, FileLocation{}),
+		ir(IRKindInstruction, InstructionIR{Name: "halt"}, FileLocation{}),
+	})
+	assert.NoError(t, err)
+
+	text := casm.x86_64Gen.textSection.String()
+	assert.Equal(t, 3, strings.Count(text, "lock cmpxchg"))
+	assert.Contains(t, text, "jne xadd_retry_0")
+	assert.Contains(t, text, "jne xadd_retry_1")
+}
+
+func TestTryFrames(t *testing.T) {
+	inst := func(name string, row int) IR {
+		return ir(IRKindInstruction, InstructionIR{Name: name}, FileLocation{FileName: "a.casm", Row: row})
+	}
+	jump := func(name string, label string, row int) IR {
+		return ir(IRKindInstruction, InstructionIR{
+			Name:       name,
+			Operand:    expression(ExpressionKindBinding, label),
+			HasOperand: true,
+		}, FileLocation{FileName: "a.casm", Row: row})
+	}
+	label := func(name string) IR {
+		return ir(IRKindLabel, LabelIR{name}, FileLocation{})
+	}
+
+	tests := []struct {
+		program []IR
+		err     string
+	}{
+		// A balanced try in a called function
+		{[]IR{
+			jump("call", "f", 0),
+			inst("halt", 1),
+			label("f"),
+			jump("try", "handler", 2),
+			inst("throw", 3),
+			inst("endtry", 4),
+			inst("ret", 5),
+			label("handler"),
+			inst("ret", 6),
+		}, ""},
+		{[]IR{
+			inst("endtry", 0),
+			inst("halt", 1),
+		}, "a.casm:1:1: endtry without a try in the same function"},
+		{[]IR{
+			jump("call", "f", 0),
+			inst("halt", 1),
+			label("f"),
+			jump("try", "f", 2),
+			inst("ret", 3),
+		}, "a.casm:4:1: return with 1 open try frames"},
+		// The frame is closed only on one of the paths
+		{[]IR{
+			jump("try", "end", 0),
+			inst("dup", 1),
+			jump("jz", "end", 2),
+			inst("endtry", 3),
+			label("end"),
+			inst("halt", 4),
+		}, "unbalanced try frames"},
+		// Functions called indirectly, spawned or installed as
+		// trap handlers are checked from the pushed labels
+		{[]IR{
+			jump("push", "f", 0),
+			inst("icall", 1),
+			inst("halt", 2),
+			label("f"),
+			jump("try", "f", 3),
+			inst("ret", 4),
+		}, "a.casm:5:1: return with 1 open try frames"},
+		// A pushed label reached directly keeps its frames
+		{[]IR{
+			jump("try", "handler", 0),
+			jump("push", "next", 1),
+			inst("ijmp", 2),
+			label("next"),
+			inst("endtry", 3),
+			label("handler"),
+			inst("halt", 4),
+		}, ""},
+	}
+
+	for _, test := range tests {
+		casm := NewCasm()
+		err := casm.TranslateIntermediateRep(test.program)
+		if test.err == "" {
+			assert.NoError(t, err, test)
+		} else {
+			assert.Error(t, err, test)
+			assert.Contains(t, err.Error(), test.err, test)
+		}
+	}
+}
+
+func TestX86_64Exceptions(t *testing.T) {
+	casm := NewCasm()
+	casm.Target = BuildTargetX86_64Linux
+	err := casm.TranslateIntermediateRep([]IR{
+		ir(IRKindInstruction, InstructionIR{Name: "try", Operand: expression(ExpressionKindBinding, "handler"), HasOperand: true}, FileLocation{}),
+		ir(IRKindInstruction, InstructionIR{Name: "push", Operand: expression(ExpressionKindNumLitInt, int64(1)), HasOperand: true}, FileLocation{}),
+		ir(IRKindInstruction, InstructionIR{Name: "throw"}, FileLocation{}),
+		ir(IRKindLabel, LabelIR{"handler"}, FileLocation{}),
+		ir(IRKindInstruction, InstructionIR{Name: "halt"}, FileLocation{}),
+	})
+	assert.NoError(t, err)
+
+	text := casm.x86_64Gen.textSection.String()
+	assert.Contains(t, text, "mov rax, handler")
+	assert.Contains(t, text, "jmp [try_stack+rcx]")
+	assert.Contains(t, casm.x86_64Gen.bssSection.String(), "try_stack:")
+}
+
+func TestInstDefs(t *testing.T) {
+	// The mnemonics must match the ones of the vm
+	for kind := coppervm.InstKind(0); kind < coppervm.InstCount; kind++ {
+		exist, inst := getInstructionByName(kind.String())
+		assert.True(t, exist, kind)
+		assert.Equal(t, kind, inst.kind)
+	}
+}
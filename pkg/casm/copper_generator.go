@@ -1,7 +1,6 @@
 package casm
 
 import (
-	"encoding/json"
 	"fmt"
 
 	"github.com/Supercaly/coppervm/pkg/coppervm"
@@ -10,21 +9,30 @@ import (
 type copperGenerator struct {
 	rep       *internalRep
 	dbSymbols coppervm.DebugSymbols
+	lineTable coppervm.LineTable
 	program   []coppervm.InstDef
+
+	sharedCallStack bool
 }
 
-func (gen *copperGenerator) saveProgram(addDebugSymbols bool) string {
+func (gen *copperGenerator) saveProgram(addDebugSymbols bool) []byte {
 	if addDebugSymbols {
 		gen.addDebugSymbols()
 	}
 
 	meta := coppervm.FileMeta(gen.rep.entry, gen.program, gen.rep.memory, gen.dbSymbols)
-	metaJson, err := json.Marshal(meta)
+	meta.LineTable = gen.lineTable
+	if gen.sharedCallStack {
+		// The vm runs the older files with the return
+		// addresses on the data stack
+		meta.Version = coppervm.CoppervmSharedStackFileVersion
+	}
+	metaBinary, err := meta.MarshalBinary()
 	if err != nil {
 		panic(fmt.Errorf("error writing program to file %s", err))
 	}
 
-	return string(metaJson)
+	return metaBinary
 }
 
 func (gen *copperGenerator) generateProgram() {
@@ -40,6 +48,17 @@ func (gen *copperGenerator) addDebugSymbols() {
 			})
 		}
 	}
+
+	// The locations of the included files are kept
+	// with the name they were resolved to
+	for addr, loc := range gen.rep.locations {
+		gen.lineTable = append(gen.lineTable, coppervm.SourceLocation{
+			Address: coppervm.InstAddr(addr),
+			File:    loc.FileName,
+			Row:     loc.Row + 1,
+			Col:     loc.Col + 1,
+		})
+	}
 }
 
 func (gen *copperGenerator) internalProgramToVMProgram() {
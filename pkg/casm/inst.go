@@ -184,6 +184,16 @@ var instDefs = [coppervm.InstCount]instruction{
 		hasOperand: false,
 		name:       "ret",
 	},
+	{
+		kind:       coppervm.InstJmpIndirect,
+		hasOperand: false,
+		name:       "ijmp",
+	},
+	{
+		kind:       coppervm.InstFunCallIndirect,
+		hasOperand: false,
+		name:       "icall",
+	},
 	{
 		kind:       coppervm.InstMemRead,
 		hasOperand: false,
@@ -213,6 +223,41 @@ var instDefs = [coppervm.InstCount]instruction{
 		hasOperand: false,
 		name:       "fwrite",
 	},
+	{
+		kind:       coppervm.InstMemReadAtomic,
+		hasOperand: false,
+		name:       "aread",
+	},
+	{
+		kind:       coppervm.InstMemWriteAtomic,
+		hasOperand: false,
+		name:       "awrite",
+	},
+	{
+		kind:       coppervm.InstMemCompareSwap,
+		hasOperand: false,
+		name:       "cas",
+	},
+	{
+		kind:       coppervm.InstMemFetchAdd,
+		hasOperand: false,
+		name:       "xadd",
+	},
+	{
+		kind:       coppervm.InstTry,
+		hasOperand: true,
+		name:       "try",
+	},
+	{
+		kind:       coppervm.InstEndTry,
+		hasOperand: false,
+		name:       "endtry",
+	},
+	{
+		kind:       coppervm.InstThrow,
+		hasOperand: false,
+		name:       "throw",
+	},
 	{
 		kind:       coppervm.InstSyscall,
 		hasOperand: true,
@@ -21,6 +21,9 @@ type internalRep struct {
 
 	program []instruction
 	memory  []byte
+
+	// Source location of every instruction in program
+	locations []FileLocation
 }
 
 // Do the first pass in the parsing process.
@@ -45,6 +48,7 @@ func (rep *internalRep) firstPass(irs []IR) {
 				}
 			}
 			rep.program = append(rep.program, instDef)
+			rep.locations = append(rep.locations, ir.Location)
 		case IRKindEntry:
 			rep.bindEntry(ir.AsEntry, ir.Location)
 		case IRKindConst:
@@ -426,3 +430,113 @@ func (rep *internalRep) getStringByAddress(addr int) string {
 	strBytes := rep.memory[addr : addr+strLen-1]
 	return string(strBytes[:])
 }
+
+// Check that the try frames are balanced in the functions of the
+// program, following the jumps from the entry point and from the
+// start of every called function: endtry must pop a frame pushed
+// in the same function, ret must leave no frames open and the
+// paths reaching an instruction must have the same frames.
+// The labels pushed on the stack, that can be called indirectly,
+// spawned as threads or installed as trap handlers, are followed
+// too if they are not reached otherwise, starting with no frames
+// unless they are pushed for ijmp; code reached only through
+// computed addresses is not checked.
+func (rep *internalRep) checkTryFrames() {
+	// Number of open frames at every instruction, -1 if not reached
+	depths := make([]int, len(rep.program))
+	for addr := range depths {
+		depths[addr] = -1
+	}
+	var pending []int
+	reach := func(addr int, depth int) {
+		if addr < 0 || addr >= len(rep.program) {
+			return
+		}
+		if depths[addr] == -1 {
+			depths[addr] = depth
+			pending = append(pending, addr)
+		} else if depths[addr] != depth {
+			panic(fmt.Sprintf("%s: unbalanced try frames, the instruction is reached with %d and %d open frames",
+				rep.locations[addr],
+				depths[addr],
+				depth))
+		}
+	}
+	target := func(inst instruction) int {
+		return int(inst.operand.toCoppervmWord().AsU64)
+	}
+
+	follow := func() {
+		for len(pending) > 0 {
+			addr := pending[len(pending)-1]
+			pending = pending[:len(pending)-1]
+			inst := rep.program[addr]
+			depth := depths[addr]
+
+			switch inst.kind {
+			case coppervm.InstTry:
+				// The handler runs after the frame is popped
+				reach(target(inst), depth)
+				reach(addr+1, depth+1)
+			case coppervm.InstEndTry:
+				if depth == 0 {
+					panic(fmt.Sprintf("%s: endtry without a try in the same function", rep.locations[addr]))
+				}
+				reach(addr+1, depth-1)
+			case coppervm.InstFunReturn:
+				if depth != 0 {
+					panic(fmt.Sprintf("%s: return with %d open try frames", rep.locations[addr], depth))
+				}
+			case coppervm.InstJmp:
+				reach(target(inst), depth)
+			case coppervm.InstJmpZero,
+				coppervm.InstJmpNotZero,
+				coppervm.InstJmpGreater,
+				coppervm.InstJmpGreaterEqual,
+				coppervm.InstJmpLess,
+				coppervm.InstJmpLessEqual:
+				reach(target(inst), depth)
+				reach(addr+1, depth)
+			case coppervm.InstJmpIndirect,
+				coppervm.InstThrow,
+				coppervm.InstHalt:
+			case coppervm.InstSyscall:
+				sysCall := coppervm.SysCall(inst.operand.toCoppervmWord().AsU64)
+				if sysCall != coppervm.SysCallExit && sysCall != coppervm.SysCallThreadExit {
+					reach(addr+1, depth)
+				}
+			default:
+				reach(addr+1, depth)
+			}
+		}
+	}
+
+	reach(rep.entry, 0)
+	for _, inst := range rep.program {
+		if inst.kind == coppervm.InstFunCall {
+			reach(target(inst), 0)
+		}
+	}
+	follow()
+	// The labels pushed on the stack not reached otherwise; a
+	// label pushed right before ijmp is a jump in the same
+	// function, so it has the frames of the push
+	for _, op := range rep.deferredOperands {
+		if rep.program[op.Address].kind != coppervm.InstPush {
+			continue
+		}
+		_, b := rep.getBindingByName(op.Name)
+		addr := int(b.evaluatedWord.asInstAddr)
+		if !b.isLabel || addr < 0 || addr >= len(depths) || depths[addr] != -1 {
+			continue
+		}
+		depth := 0
+		if op.Address+1 < len(rep.program) &&
+			rep.program[op.Address+1].kind == coppervm.InstJmpIndirect &&
+			depths[op.Address] > 0 {
+			depth = depths[op.Address]
+		}
+		reach(addr, depth)
+		follow()
+	}
+}
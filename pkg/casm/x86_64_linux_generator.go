@@ -14,9 +14,36 @@ type x86_64Generator struct {
 
 	rep *internalRep
 
+	memoryCapacity int64
+
+	// Use the native call and ret instructions that keep
+	// the return addresses on the data stack
+	sharedCallStack bool
+
 	labels map[int]string
 
-	hasPrintFn bool
+	hasPrintFn   bool
+	hasBrkFn     bool
+	hasUnlinkFn  bool
+	hasStatFn    bool
+	hasReaddirFn bool
+	hasArgsFn    bool
+	hasTimeFn    bool
+	hasRandomFn  bool
+
+	// Indirect jumps need a table with the native
+	// address of every instruction
+	hasInstTable bool
+
+	// Functions keep the return addresses in a separate
+	// call stack; every call gets a unique return label
+	hasCallStack bool
+	callCount    int
+	xaddCount    int
+
+	// The try frames keep the native address of the handler
+	// and the data and call stack pointers to unwind to
+	hasTryStack bool
 }
 
 func (gen *x86_64Generator) generateProgram() {
@@ -33,12 +60,47 @@ func (gen *x86_64Generator) generateProgram() {
 	writeLine(&gen.dataSection, "section .data")
 	writeLine(&gen.bssSection, "section .bss")
 
+	// The argument and environment system calls need
+	// the initial stack pointer
+	for idx, inst := range gen.rep.program {
+		if inst.kind == coppervm.InstSyscall &&
+			inst.operand.asInt >= int64(coppervm.SysCallArgc) &&
+			inst.operand.asInt <= int64(coppervm.SysCallGetenv) {
+			gen.hasArgsFn = true
+		}
+		// The threads are scheduled and the faults are trapped by the vm
+		if inst.kind == coppervm.InstSyscall &&
+			inst.operand.asInt >= int64(coppervm.SysCallSpawn) &&
+			inst.operand.asInt <= int64(coppervm.SysCallTrap) {
+			panic(fmt.Sprintf("%s: system call '%s' is not supported by the x86-64 target",
+				gen.rep.locations[idx],
+				coppervm.SysCall(inst.operand.asInt)))
+		}
+		if inst.kind == coppervm.InstJmpIndirect ||
+			inst.kind == coppervm.InstFunCallIndirect {
+			gen.hasInstTable = true
+		}
+		if inst.kind == coppervm.InstTry ||
+			inst.kind == coppervm.InstEndTry ||
+			inst.kind == coppervm.InstThrow {
+			gen.hasTryStack = true
+		}
+		if !gen.sharedCallStack &&
+			(inst.kind == coppervm.InstFunCall ||
+				inst.kind == coppervm.InstFunCallIndirect ||
+				inst.kind == coppervm.InstFunReturn) {
+			gen.hasCallStack = true
+		}
+	}
+
 	// Write the _start condition
 	writeLine(&gen.textSection, "global _start")
-	if !gen.rep.hasEntry {
-		writeLine(&gen.textSection, "_start:")
-	} else {
-		writeLine(&gen.textSection, "_start:")
+	writeLine(&gen.textSection, "_start:")
+	if gen.hasArgsFn {
+		writeLine(&gen.bssSection, "  start_rsp: resq 1")
+		writeLine(&gen.textSection, "  mov [start_rsp], rsp")
+	}
+	if gen.rep.hasEntry {
 		writeLine(&gen.textSection, fmt.Sprintf("  jmp %s", gen.rep.deferredEntryName))
 	}
 
@@ -47,6 +109,9 @@ func (gen *x86_64Generator) generateProgram() {
 		if label, ok := gen.labels[idx]; ok {
 			writeLine(&gen.textSection, fmt.Sprintf("%s:", label))
 		}
+		if gen.hasInstTable {
+			writeLine(&gen.textSection, fmt.Sprintf("inst_%d:", idx))
+		}
 		gen.translateInstruction(inst)
 	}
 
@@ -63,6 +128,353 @@ func (gen *x86_64Generator) generateProgram() {
 		memStr = "0x0"
 	}
 	writeLine(&gen.dataSection, fmt.Sprintf("  mem: db %s", memStr))
+	if reserved := gen.memoryCapacity - int64(len(gen.rep.memory)); reserved > 0 {
+		writeLine(&gen.dataSection, fmt.Sprintf("  times %d db 0", reserved))
+	}
+
+	// Append the program break functions
+	if gen.hasBrkFn {
+		heapStart := len(gen.rep.memory)
+		writeLine(&gen.dataSection, fmt.Sprintf("  mem_break: dq %d", heapStart))
+
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "mem_brk:")
+		writeLine(&gen.textSection, "  cmp rdi, 0")
+		writeLine(&gen.textSection, "  je mem_brk_get")
+		writeLine(&gen.textSection, fmt.Sprintf("  cmp rdi, %d", heapStart))
+		writeLine(&gen.textSection, "  jb mem_brk_fail")
+		writeLine(&gen.textSection, fmt.Sprintf("  cmp rdi, %d", gen.memoryCapacity))
+		writeLine(&gen.textSection, "  ja mem_brk_fail")
+		writeLine(&gen.textSection, "  mov [mem_break], rdi")
+		writeLine(&gen.textSection, "mem_brk_get:")
+		writeLine(&gen.textSection, "  mov rax, [mem_break]")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "mem_brk_fail:")
+		writeLine(&gen.textSection, "  mov rax, -1")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "mem_sbrk:")
+		writeLine(&gen.textSection, "  mov rax, [mem_break]")
+		writeLine(&gen.textSection, "  mov rbx, rax")
+		writeLine(&gen.textSection, "  add rbx, rdi")
+		writeLine(&gen.textSection, fmt.Sprintf("  cmp rbx, %d", heapStart))
+		writeLine(&gen.textSection, "  jl mem_sbrk_fail")
+		writeLine(&gen.textSection, fmt.Sprintf("  cmp rbx, %d", gen.memoryCapacity))
+		writeLine(&gen.textSection, "  jg mem_sbrk_fail")
+		writeLine(&gen.textSection, "  mov [mem_break], rbx")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "mem_sbrk_fail:")
+		writeLine(&gen.textSection, "  mov rax, -1")
+		writeLine(&gen.textSection, "  ret")
+	}
+
+	// Append the stat function converting the Linux
+	// struct stat to the vm layout
+	if gen.hasStatFn {
+		writeLine(&gen.bssSection, "  stat_buf: resb 144")
+
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "file_stat:")
+		writeLine(&gen.textSection, "  push rsi")
+		writeLine(&gen.textSection, "  add rdi, mem")
+		writeLine(&gen.textSection, "  mov rsi, stat_buf")
+		writeLine(&gen.textSection, "  mov rax, 0x4")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "  pop rsi")
+		writeLine(&gen.textSection, "  cmp rax, 0")
+		writeLine(&gen.textSection, "  jl file_stat_fail")
+		writeLine(&gen.textSection, "  add rsi, mem")
+		writeLine(&gen.textSection, "  mov rax, [stat_buf+48]")
+		writeLine(&gen.textSection, "  bswap rax")
+		writeLine(&gen.textSection, "  mov [rsi], rax")
+		writeLine(&gen.textSection, "  mov eax, [stat_buf+24]")
+		writeLine(&gen.textSection, "  and rax, 0x1ff")
+		writeLine(&gen.textSection, "  bswap rax")
+		writeLine(&gen.textSection, "  mov [rsi+8], rax")
+		writeLine(&gen.textSection, "  mov rax, [stat_buf+88]")
+		writeLine(&gen.textSection, "  bswap rax")
+		writeLine(&gen.textSection, "  mov [rsi+16], rax")
+		writeLine(&gen.textSection, "  mov eax, [stat_buf+24]")
+		writeLine(&gen.textSection, "  and eax, 0xf000")
+		writeLine(&gen.textSection, "  cmp eax, 0x4000")
+		writeLine(&gen.textSection, "  sete al")
+		writeLine(&gen.textSection, "  movzx rax, al")
+		writeLine(&gen.textSection, "  bswap rax")
+		writeLine(&gen.textSection, "  mov [rsi+24], rax")
+		writeLine(&gen.textSection, "  xor rax, rax")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "file_stat_fail:")
+		writeLine(&gen.textSection, "  mov rax, -1")
+		writeLine(&gen.textSection, "  ret")
+	}
+
+	// Append the table used by indirect jumps
+	if gen.hasInstTable {
+		var table []string
+		for idx := range gen.rep.program {
+			table = append(table, fmt.Sprintf("inst_%d", idx))
+		}
+		writeLine(&gen.dataSection, fmt.Sprintf("  inst_table: dq %s", strings.Join(table, ",")))
+
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "illegal_inst_access:")
+		writeLine(&gen.textSection, "  mov rdi, 1")
+		writeLine(&gen.textSection, "  mov rax, 0x3c")
+		writeLine(&gen.textSection, "  syscall")
+	}
+
+	// Append the call stack used by the functions
+	if gen.hasCallStack {
+		writeLine(&gen.dataSection, "  call_sp: dq 0")
+		writeLine(&gen.bssSection, fmt.Sprintf("  call_stack: resq %d", coppervm.CoppervmCallStackCapacity))
+
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "call_stack_error:")
+		writeLine(&gen.textSection, "  mov rdi, 1")
+		writeLine(&gen.textSection, "  mov rax, 0x3c")
+		writeLine(&gen.textSection, "  syscall")
+	}
+
+	// Append the stack of the try frames
+	if gen.hasTryStack {
+		writeLine(&gen.dataSection, "  try_sp: dq 0")
+		writeLine(&gen.bssSection, fmt.Sprintf("  try_stack: resq %d", 3*coppervm.CoppervmTryStackCapacity))
+
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "try_stack_error:")
+		writeLine(&gen.textSection, "  mov rdi, 1")
+		writeLine(&gen.textSection, "  mov rax, 0x3c")
+		writeLine(&gen.textSection, "  syscall")
+	}
+
+	// Append the unlink function that falls back
+	// to rmdir for directories
+	if gen.hasUnlinkFn {
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "file_unlink:")
+		writeLine(&gen.textSection, "  add rdi, mem")
+		writeLine(&gen.textSection, "  mov rax, 0x57")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "  cmp rax, -21")
+		writeLine(&gen.textSection, "  jne file_unlink_end")
+		writeLine(&gen.textSection, "  mov rax, 0x54")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "file_unlink_end:")
+		writeLine(&gen.textSection, "  ret")
+	}
+
+	// Append the readdir function copying the names returned
+	// by getdents64 to a buffer as null-terminated strings
+	if gen.hasReaddirFn {
+		writeLine(&gen.bssSection, "  dirent_buf: resb 4096")
+
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "file_readdir:")
+		writeLine(&gen.textSection, "  push r12")
+		writeLine(&gen.textSection, "  push r13")
+		writeLine(&gen.textSection, "  push r14")
+		writeLine(&gen.textSection, "  push r15")
+		writeLine(&gen.textSection, "  mov r12, rsi")
+		writeLine(&gen.textSection, "  add r12, mem")
+		writeLine(&gen.textSection, "  mov r13, rdx")
+		writeLine(&gen.textSection, "  xor r14, r14")
+		writeLine(&gen.textSection, "  add rdi, mem")
+		writeLine(&gen.textSection, "  mov rsi, 0x10000")
+		writeLine(&gen.textSection, "  xor rdx, rdx")
+		writeLine(&gen.textSection, "  mov rax, 0x2")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "  cmp rax, 0")
+		writeLine(&gen.textSection, "  jl file_readdir_fail")
+		writeLine(&gen.textSection, "  mov r15, rax")
+		writeLine(&gen.textSection, "file_readdir_read:")
+		writeLine(&gen.textSection, "  mov rdi, r15")
+		writeLine(&gen.textSection, "  mov rsi, dirent_buf")
+		writeLine(&gen.textSection, "  mov rdx, 4096")
+		writeLine(&gen.textSection, "  mov rax, 0xd9")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "  cmp rax, 0")
+		writeLine(&gen.textSection, "  jl file_readdir_close_fail")
+		writeLine(&gen.textSection, "  je file_readdir_done")
+		writeLine(&gen.textSection, "  mov r8, rax")
+		writeLine(&gen.textSection, "  xor rbx, rbx")
+		writeLine(&gen.textSection, "file_readdir_entry:")
+		writeLine(&gen.textSection, "  cmp rbx, r8")
+		writeLine(&gen.textSection, "  jge file_readdir_read")
+		writeLine(&gen.textSection, "  lea rsi, [dirent_buf+rbx+19]")
+		// Skip the '.' and '..' entries
+		writeLine(&gen.textSection, "  cmp byte [rsi], '.'")
+		writeLine(&gen.textSection, "  jne file_readdir_copy")
+		writeLine(&gen.textSection, "  cmp byte [rsi+1], 0")
+		writeLine(&gen.textSection, "  je file_readdir_next")
+		writeLine(&gen.textSection, "  cmp byte [rsi+1], '.'")
+		writeLine(&gen.textSection, "  jne file_readdir_copy")
+		writeLine(&gen.textSection, "  cmp byte [rsi+2], 0")
+		writeLine(&gen.textSection, "  je file_readdir_next")
+		writeLine(&gen.textSection, "file_readdir_copy:")
+		writeLine(&gen.textSection, "  cmp r13, 0")
+		writeLine(&gen.textSection, "  je file_readdir_close_fail")
+		writeLine(&gen.textSection, "  mov al, [rsi]")
+		writeLine(&gen.textSection, "  mov [r12+r14], al")
+		writeLine(&gen.textSection, "  inc r14")
+		writeLine(&gen.textSection, "  dec r13")
+		writeLine(&gen.textSection, "  inc rsi")
+		writeLine(&gen.textSection, "  cmp al, 0")
+		writeLine(&gen.textSection, "  jne file_readdir_copy")
+		writeLine(&gen.textSection, "file_readdir_next:")
+		writeLine(&gen.textSection, "  movzx rax, word [dirent_buf+rbx+16]")
+		writeLine(&gen.textSection, "  add rbx, rax")
+		writeLine(&gen.textSection, "  jmp file_readdir_entry")
+		writeLine(&gen.textSection, "file_readdir_done:")
+		writeLine(&gen.textSection, "  mov rdi, r15")
+		writeLine(&gen.textSection, "  mov rax, 0x3")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "  mov rax, r14")
+		writeLine(&gen.textSection, "  jmp file_readdir_end")
+		writeLine(&gen.textSection, "file_readdir_close_fail:")
+		writeLine(&gen.textSection, "  mov rdi, r15")
+		writeLine(&gen.textSection, "  mov rax, 0x3")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "file_readdir_fail:")
+		writeLine(&gen.textSection, "  mov rax, -1")
+		writeLine(&gen.textSection, "file_readdir_end:")
+		writeLine(&gen.textSection, "  pop r15")
+		writeLine(&gen.textSection, "  pop r14")
+		writeLine(&gen.textSection, "  pop r13")
+		writeLine(&gen.textSection, "  pop r12")
+		writeLine(&gen.textSection, "  ret")
+	}
+
+	// Append the argument and environment functions
+	// reading the initial process stack:
+	// argc, argv pointers, NULL, envp pointers, NULL
+	if gen.hasArgsFn {
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "args_argc:")
+		writeLine(&gen.textSection, "  mov rax, [start_rsp]")
+		writeLine(&gen.textSection, "  mov rax, [rax]")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "args_argv:")
+		writeLine(&gen.textSection, "  mov rax, [start_rsp]")
+		writeLine(&gen.textSection, "  cmp rdi, [rax]")
+		writeLine(&gen.textSection, "  jae args_fail")
+		writeLine(&gen.textSection, "  mov rdi, [rax+8+rdi*8]")
+		writeLine(&gen.textSection, "  jmp args_copy")
+		writeLine(&gen.textSection, "args_getenv:")
+		writeLine(&gen.textSection, "  add rdi, mem")
+		writeLine(&gen.textSection, "  mov r8, [start_rsp]")
+		writeLine(&gen.textSection, "  mov rax, [r8]")
+		writeLine(&gen.textSection, "  lea r8, [r8+16+rax*8]")
+		writeLine(&gen.textSection, "args_getenv_loop:")
+		writeLine(&gen.textSection, "  mov r9, [r8]")
+		writeLine(&gen.textSection, "  cmp r9, 0")
+		writeLine(&gen.textSection, "  je args_fail")
+		writeLine(&gen.textSection, "  xor rcx, rcx")
+		writeLine(&gen.textSection, "args_getenv_cmp:")
+		writeLine(&gen.textSection, "  mov al, [rdi+rcx]")
+		writeLine(&gen.textSection, "  cmp al, 0")
+		writeLine(&gen.textSection, "  je args_getenv_name_end")
+		writeLine(&gen.textSection, "  cmp al, [r9+rcx]")
+		writeLine(&gen.textSection, "  jne args_getenv_next")
+		writeLine(&gen.textSection, "  inc rcx")
+		writeLine(&gen.textSection, "  jmp args_getenv_cmp")
+		writeLine(&gen.textSection, "args_getenv_name_end:")
+		writeLine(&gen.textSection, "  cmp byte [r9+rcx], '='")
+		writeLine(&gen.textSection, "  jne args_getenv_next")
+		writeLine(&gen.textSection, "  lea rdi, [r9+rcx+1]")
+		writeLine(&gen.textSection, "  jmp args_copy")
+		writeLine(&gen.textSection, "args_getenv_next:")
+		writeLine(&gen.textSection, "  add r8, 8")
+		writeLine(&gen.textSection, "  jmp args_getenv_loop")
+		// Copy the null-terminated string in rdi to the
+		// buffer rsi of size rdx and return its length
+		writeLine(&gen.textSection, "args_copy:")
+		writeLine(&gen.textSection, "  add rsi, mem")
+		writeLine(&gen.textSection, "  xor rax, rax")
+		writeLine(&gen.textSection, "args_copy_loop:")
+		writeLine(&gen.textSection, "  cmp rax, rdx")
+		writeLine(&gen.textSection, "  jae args_fail")
+		writeLine(&gen.textSection, "  mov cl, [rdi+rax]")
+		writeLine(&gen.textSection, "  mov [rsi+rax], cl")
+		writeLine(&gen.textSection, "  cmp cl, 0")
+		writeLine(&gen.textSection, "  je args_copy_end")
+		writeLine(&gen.textSection, "  inc rax")
+		writeLine(&gen.textSection, "  jmp args_copy_loop")
+		writeLine(&gen.textSection, "args_copy_end:")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "args_fail:")
+		writeLine(&gen.textSection, "  mov rax, -1")
+		writeLine(&gen.textSection, "  ret")
+	}
+
+	// Append the time functions; times are returned in nanoseconds
+	if gen.hasTimeFn || gen.hasRandomFn {
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "time_now:")
+		writeLine(&gen.textSection, "  sub rsp, 16")
+		writeLine(&gen.textSection, "  mov rsi, rsp")
+		writeLine(&gen.textSection, "  mov rax, 0xe4")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "  mov rax, [rsp]")
+		writeLine(&gen.textSection, "  imul rax, rax, 1000000000")
+		writeLine(&gen.textSection, "  add rax, [rsp+8]")
+		writeLine(&gen.textSection, "  add rsp, 16")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "time_sleep:")
+		writeLine(&gen.textSection, "  cmp rdi, 0")
+		writeLine(&gen.textSection, "  jl time_sleep_fail")
+		writeLine(&gen.textSection, "  mov rax, rdi")
+		writeLine(&gen.textSection, "  xor rdx, rdx")
+		writeLine(&gen.textSection, "  mov rcx, 1000000000")
+		writeLine(&gen.textSection, "  div rcx")
+		writeLine(&gen.textSection, "  sub rsp, 16")
+		writeLine(&gen.textSection, "  mov [rsp], rax")
+		writeLine(&gen.textSection, "  mov [rsp+8], rdx")
+		writeLine(&gen.textSection, "  mov rdi, rsp")
+		writeLine(&gen.textSection, "  xor rsi, rsi")
+		writeLine(&gen.textSection, "  mov rax, 0x23")
+		writeLine(&gen.textSection, "  syscall")
+		writeLine(&gen.textSection, "  add rsp, 16")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "time_sleep_fail:")
+		writeLine(&gen.textSection, "  mov rax, -1")
+		writeLine(&gen.textSection, "  ret")
+	}
+
+	// Append the xorshift64* pseudo-random number functions;
+	// the generator is seeded with the current time on first use
+	if gen.hasRandomFn {
+		writeLine(&gen.dataSection, "  rng_state: dq 0")
+
+		writeLine(&gen.textSection, "")
+		writeLine(&gen.textSection, "rng_seed:")
+		writeLine(&gen.textSection, "  cmp rdi, 0")
+		writeLine(&gen.textSection, "  jne rng_seed_set")
+		writeLine(&gen.textSection, fmt.Sprintf("  mov rdi, 0x%x", coppervm.RandomZeroSeed))
+		writeLine(&gen.textSection, "rng_seed_set:")
+		writeLine(&gen.textSection, "  mov [rng_state], rdi")
+		writeLine(&gen.textSection, "  ret")
+		writeLine(&gen.textSection, "rng_next:")
+		writeLine(&gen.textSection, "  cmp qword [rng_state], 0")
+		writeLine(&gen.textSection, "  jne rng_next_ready")
+		writeLine(&gen.textSection, "  xor rdi, rdi")
+		writeLine(&gen.textSection, "  call time_now")
+		writeLine(&gen.textSection, "  mov rdi, rax")
+		writeLine(&gen.textSection, "  call rng_seed")
+		writeLine(&gen.textSection, "rng_next_ready:")
+		writeLine(&gen.textSection, "  mov rax, [rng_state]")
+		writeLine(&gen.textSection, "  mov rdx, rax")
+		writeLine(&gen.textSection, "  shr rdx, 12")
+		writeLine(&gen.textSection, "  xor rax, rdx")
+		writeLine(&gen.textSection, "  mov rdx, rax")
+		writeLine(&gen.textSection, "  shl rdx, 25")
+		writeLine(&gen.textSection, "  xor rax, rdx")
+		writeLine(&gen.textSection, "  mov rdx, rax")
+		writeLine(&gen.textSection, "  shr rdx, 27")
+		writeLine(&gen.textSection, "  xor rax, rdx")
+		writeLine(&gen.textSection, "  mov [rng_state], rax")
+		writeLine(&gen.textSection, "  mov rdx, 0x2545f4914f6cdd1d")
+		writeLine(&gen.textSection, "  imul rax, rdx")
+		writeLine(&gen.textSection, "  ret")
+	}
 
 	// Append debug print instruction
 	if gen.hasPrintFn {
@@ -270,10 +682,39 @@ func (gen *x86_64Generator) translateInstruction(inst instruction) {
 		// Functions
 	case coppervm.InstFunCall:
 		writeLine(&gen.textSection, "  ; -- call --")
-		writeLine(&gen.textSection, fmt.Sprintf("  call %s", gen.wordToLabel(inst.operand)))
+		if gen.sharedCallStack {
+			writeLine(&gen.textSection, fmt.Sprintf("  call %s", gen.wordToLabel(inst.operand)))
+		} else {
+			gen.writeCall(gen.wordToLabel(inst.operand))
+		}
 	case coppervm.InstFunReturn:
 		writeLine(&gen.textSection, "  ; -- ret --")
-		writeLine(&gen.textSection, "  ret")
+		if gen.sharedCallStack {
+			writeLine(&gen.textSection, "  ret")
+		} else {
+			writeLine(&gen.textSection, "  mov rax, [call_sp]")
+			writeLine(&gen.textSection, "  cmp rax, 0")
+			writeLine(&gen.textSection, "  je call_stack_error")
+			writeLine(&gen.textSection, "  dec rax")
+			writeLine(&gen.textSection, "  mov [call_sp], rax")
+			writeLine(&gen.textSection, "  jmp [call_stack+rax*8]")
+		}
+	case coppervm.InstJmpIndirect:
+		writeLine(&gen.textSection, "  ; -- ijmp --")
+		writeLine(&gen.textSection, "  pop rax")
+		writeLine(&gen.textSection, fmt.Sprintf("  cmp rax, %d", len(gen.rep.program)))
+		writeLine(&gen.textSection, "  jae illegal_inst_access")
+		writeLine(&gen.textSection, "  jmp [inst_table+rax*8]")
+	case coppervm.InstFunCallIndirect:
+		writeLine(&gen.textSection, "  ; -- icall --")
+		writeLine(&gen.textSection, "  pop rax")
+		writeLine(&gen.textSection, fmt.Sprintf("  cmp rax, %d", len(gen.rep.program)))
+		writeLine(&gen.textSection, "  jae illegal_inst_access")
+		if gen.sharedCallStack {
+			writeLine(&gen.textSection, "  call [inst_table+rax*8]")
+		} else {
+			gen.writeCall("[inst_table+rax*8]")
+		}
 
 		// Memory access
 	case coppervm.InstMemRead:
@@ -366,6 +807,90 @@ func (gen *x86_64Generator) translateInstruction(inst instruction) {
 		writeLine(&gen.textSection, "  shr rbx, 8")
 		writeLine(&gen.textSection, "  mov [mem+rax], bl")
 
+		// Atomic memory access; the memory is big-endian, so the
+		// values are swapped from and to the registers
+	case coppervm.InstMemReadAtomic:
+		writeLine(&gen.textSection, "  ; -- aread --")
+		writeLine(&gen.textSection, "  pop rax")
+		writeLine(&gen.textSection, "  mov rbx, [mem+rax]")
+		writeLine(&gen.textSection, "  bswap rbx")
+		writeLine(&gen.textSection, "  push rbx")
+	case coppervm.InstMemWriteAtomic:
+		// xchg with a memory operand is always locked
+		writeLine(&gen.textSection, "  ; -- awrite --")
+		writeLine(&gen.textSection, "  pop rax")
+		writeLine(&gen.textSection, "  pop rbx")
+		writeLine(&gen.textSection, "  bswap rbx")
+		writeLine(&gen.textSection, "  xchg [mem+rax], rbx")
+	case coppervm.InstMemCompareSwap:
+		writeLine(&gen.textSection, "  ; -- cas --")
+		writeLine(&gen.textSection, "  pop rdi")
+		writeLine(&gen.textSection, "  pop rbx")
+		writeLine(&gen.textSection, "  pop rax")
+		writeLine(&gen.textSection, "  bswap rbx")
+		writeLine(&gen.textSection, "  bswap rax")
+		writeLine(&gen.textSection, "  lock cmpxchg [mem+rdi], rbx")
+		writeLine(&gen.textSection, "  bswap rax")
+		writeLine(&gen.textSection, "  push rax")
+	case coppervm.InstMemFetchAdd:
+		// lock xadd would add the swapped values, so the sum
+		// is stored with cmpxchg until no one else changes it
+		retryLabel := fmt.Sprintf("xadd_retry_%d", gen.xaddCount)
+		gen.xaddCount++
+		writeLine(&gen.textSection, "  ; -- xadd --")
+		writeLine(&gen.textSection, "  pop rdi")
+		writeLine(&gen.textSection, "  pop rbx")
+		writeLine(&gen.textSection, "  mov rax, [mem+rdi]")
+		writeLine(&gen.textSection, fmt.Sprintf("%s:", retryLabel))
+		writeLine(&gen.textSection, "  mov rcx, rax")
+		writeLine(&gen.textSection, "  bswap rcx")
+		writeLine(&gen.textSection, "  add rcx, rbx")
+		writeLine(&gen.textSection, "  bswap rcx")
+		writeLine(&gen.textSection, "  lock cmpxchg [mem+rdi], rcx")
+		writeLine(&gen.textSection, fmt.Sprintf("  jne %s", retryLabel))
+		writeLine(&gen.textSection, "  bswap rax")
+		writeLine(&gen.textSection, "  push rax")
+
+		// Exceptions
+	case coppervm.InstTry:
+		writeLine(&gen.textSection, "  ; -- try --")
+		writeLine(&gen.textSection, "  mov rcx, [try_sp]")
+		writeLine(&gen.textSection, fmt.Sprintf("  cmp rcx, %d", coppervm.CoppervmTryStackCapacity))
+		writeLine(&gen.textSection, "  jae try_stack_error")
+		writeLine(&gen.textSection, "  inc qword [try_sp]")
+		writeLine(&gen.textSection, "  imul rcx, rcx, 24")
+		writeLine(&gen.textSection, fmt.Sprintf("  mov rax, %s", gen.wordToLabel(inst.operand)))
+		writeLine(&gen.textSection, "  mov [try_stack+rcx], rax")
+		writeLine(&gen.textSection, "  mov [try_stack+rcx+8], rsp")
+		if gen.hasCallStack {
+			writeLine(&gen.textSection, "  mov rax, [call_sp]")
+			writeLine(&gen.textSection, "  mov [try_stack+rcx+16], rax")
+		}
+	case coppervm.InstEndTry:
+		writeLine(&gen.textSection, "  ; -- endtry --")
+		writeLine(&gen.textSection, "  mov rax, [try_sp]")
+		writeLine(&gen.textSection, "  cmp rax, 0")
+		writeLine(&gen.textSection, "  je try_stack_error")
+		writeLine(&gen.textSection, "  dec rax")
+		writeLine(&gen.textSection, "  mov [try_sp], rax")
+	case coppervm.InstThrow:
+		// An uncaught exception exits like the other errors
+		writeLine(&gen.textSection, "  ; -- throw --")
+		writeLine(&gen.textSection, "  pop rbx")
+		writeLine(&gen.textSection, "  mov rcx, [try_sp]")
+		writeLine(&gen.textSection, "  cmp rcx, 0")
+		writeLine(&gen.textSection, "  je try_stack_error")
+		writeLine(&gen.textSection, "  dec rcx")
+		writeLine(&gen.textSection, "  mov [try_sp], rcx")
+		writeLine(&gen.textSection, "  imul rcx, rcx, 24")
+		writeLine(&gen.textSection, "  mov rsp, [try_stack+rcx+8]")
+		if gen.hasCallStack {
+			writeLine(&gen.textSection, "  mov rax, [try_stack+rcx+16]")
+			writeLine(&gen.textSection, "  mov [call_sp], rax")
+		}
+		writeLine(&gen.textSection, "  push rbx")
+		writeLine(&gen.textSection, "  jmp [try_stack+rcx]")
+
 		// Syscall
 	case coppervm.InstSyscall:
 		writeLine(&gen.textSection, "  ; -- syscall --")
@@ -383,9 +908,10 @@ func (gen *x86_64Generator) translateInstruction(inst instruction) {
 			writeLine(&gen.textSection, "  pop rdi")
 			writeLine(&gen.textSection, "  mov rax, 0x1")
 		case 2:
-			writeLine(&gen.textSection, "  mov rdx, 0x2")
-			writeLine(&gen.textSection, "  mov rsi, 0x2")
+			writeLine(&gen.textSection, "  pop rdx")
+			writeLine(&gen.textSection, "  pop rsi")
 			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  add rdi, mem")
 			writeLine(&gen.textSection, "  mov rax, 0x2")
 		case 3:
 			writeLine(&gen.textSection, "  pop rdi")
@@ -398,6 +924,97 @@ func (gen *x86_64Generator) translateInstruction(inst instruction) {
 		case 5:
 			writeLine(&gen.textSection, "  pop rdi")
 			writeLine(&gen.textSection, "  mov rax, 0x3c")
+		case 6:
+			// The program break is emulated inside mem
+			gen.hasBrkFn = true
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call mem_brk")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 7:
+			gen.hasBrkFn = true
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call mem_sbrk")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 8:
+			gen.hasStatFn = true
+			writeLine(&gen.textSection, "  pop rsi")
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call file_stat")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 9:
+			gen.hasUnlinkFn = true
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call file_unlink")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 10:
+			writeLine(&gen.textSection, "  pop rsi")
+			writeLine(&gen.textSection, "  add rsi, mem")
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  add rdi, mem")
+			writeLine(&gen.textSection, "  mov rax, 0x52")
+		case 11:
+			writeLine(&gen.textSection, "  pop rsi")
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  add rdi, mem")
+			writeLine(&gen.textSection, "  mov rax, 0x53")
+		case 12:
+			gen.hasReaddirFn = true
+			writeLine(&gen.textSection, "  pop rdx")
+			writeLine(&gen.textSection, "  pop rsi")
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call file_readdir")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 13:
+			writeLine(&gen.textSection, "  call args_argc")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 14:
+			writeLine(&gen.textSection, "  pop rdx")
+			writeLine(&gen.textSection, "  pop rsi")
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call args_argv")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 15:
+			writeLine(&gen.textSection, "  pop rdx")
+			writeLine(&gen.textSection, "  pop rsi")
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call args_getenv")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 16:
+			gen.hasTimeFn = true
+			writeLine(&gen.textSection, "  xor rdi, rdi")
+			writeLine(&gen.textSection, "  call time_now")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 17:
+			gen.hasTimeFn = true
+			writeLine(&gen.textSection, "  mov rdi, 0x1")
+			writeLine(&gen.textSection, "  call time_now")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 18:
+			gen.hasTimeFn = true
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call time_sleep")
+			writeLine(&gen.textSection, "  push rax")
+			return
+		case 19:
+			gen.hasRandomFn = true
+			writeLine(&gen.textSection, "  pop rdi")
+			writeLine(&gen.textSection, "  call rng_seed")
+			return
+		case 20:
+			gen.hasRandomFn = true
+			writeLine(&gen.textSection, "  call rng_next")
+			writeLine(&gen.textSection, "  push rax")
+			return
 		}
 		writeLine(&gen.textSection, "  syscall")
 		writeLine(&gen.textSection, "  push rax")
@@ -415,6 +1032,23 @@ func (gen *x86_64Generator) translateInstruction(inst instruction) {
 }
 
 // Convert a word to an immediate string.
+// Write a function call to given target that saves the
+// return address in the call stack.
+// The target can't use the rbx and rcx registers.
+func (gen *x86_64Generator) writeCall(target string) {
+	retLabel := fmt.Sprintf("call_ret_%d", gen.callCount)
+	gen.callCount++
+	writeLine(&gen.textSection, "  mov rcx, [call_sp]")
+	writeLine(&gen.textSection, fmt.Sprintf("  cmp rcx, %d", coppervm.CoppervmCallStackCapacity))
+	writeLine(&gen.textSection, "  jae call_stack_error")
+	writeLine(&gen.textSection, fmt.Sprintf("  mov rbx, %s", retLabel))
+	writeLine(&gen.textSection, "  mov [call_stack+rcx*8], rbx")
+	writeLine(&gen.textSection, "  inc rcx")
+	writeLine(&gen.textSection, "  mov [call_sp], rcx")
+	writeLine(&gen.textSection, fmt.Sprintf("  jmp %s", target))
+	writeLine(&gen.textSection, fmt.Sprintf("%s:", retLabel))
+}
+
 func (gen *x86_64Generator) wordToString(w word) (ret string) {
 	switch w.kind {
 	case wordKindInt:
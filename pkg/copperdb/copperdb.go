@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -12,6 +13,11 @@ import (
 	"github.com/Supercaly/coppervm/pkg/coppervm"
 )
 
+// Number of executed instructions the debugger can step back.
+// The undo log grows up to it as the program runs, so a short
+// session doesn't pay for it.
+const CopperdbUndoLogCapacity = 100000
+
 type Copperdb struct {
 	InputFile string
 
@@ -22,14 +28,17 @@ type Copperdb struct {
 	currentBreakpoint Breakpoint
 
 	debugSymbols coppervm.DebugSymbols
+	lineTable    coppervm.LineTable
 
 	sessionHalt bool
 }
 
 func NewCopperdb(inputFile string) Copperdb {
+	vm := coppervm.NewCoppervm()
+	vm.EnableUndoLog(CopperdbUndoLogCapacity)
 	return Copperdb{
 		InputFile: inputFile,
-		vm:        &coppervm.Coppervm{},
+		vm:        vm,
 	}
 }
 
@@ -43,6 +52,7 @@ func (db *Copperdb) StartDebugSession() error {
 	}
 	db.vm.Halt = true
 	db.debugSymbols = meta.DebugSymbols
+	db.lineTable = meta.LineTable
 
 	// Start db session
 	reader := bufio.NewReader(os.Stdin)
@@ -78,6 +88,10 @@ func (db *Copperdb) executeCommand(input string) {
 		db.continueProgram()
 	case "s":
 		db.stepProgram()
+	case "rs":
+		db.reverseStepProgram()
+	case "rc":
+		db.reverseContinueProgram()
 	case "b":
 		addr, err := db.stringToBrAddress(args)
 		if err != nil {
@@ -102,7 +116,15 @@ func (db *Copperdb) executeCommand(input string) {
 		fmt.Println()
 	case "x":
 		if !db.vm.Halt {
-			fmt.Printf("[%d] -> %s\n", db.vm.Ip, db.vm.Program[db.vm.Ip])
+			fmt.Printf("[%d] -> %s%s\n", db.vm.Ip, db.vm.Program[db.vm.Ip], db.sourceLocation(db.vm.Ip))
+		} else {
+			fmt.Println("The program is not being run. Use 'r' to run it first.")
+		}
+	case "bt":
+		if !db.vm.Halt {
+			for i, frame := range db.vm.Backtrace() {
+				fmt.Printf("#%d %s\n", i, frame)
+			}
 		} else {
 			fmt.Println("The program is not being run. Use 'r' to run it first.")
 		}
@@ -134,15 +156,16 @@ func (db *Copperdb) executeInstructions(count int) {
 		if db.brakeAtAddr(db.vm.Ip) {
 			// Reached a breakpoint
 			db.currentBreakpoint = db.breakpoints[db.breakpoints.GetIndexByAddress(db.vm.Ip)]
-			fmt.Printf("\nBreakpoint %d, %d\n",
+			fmt.Printf("\nBreakpoint %d, %d%s\n",
 				db.currentBreakpoint.Number,
-				db.currentBreakpoint.Addr)
+				db.currentBreakpoint.Addr,
+				db.sourceLocation(db.currentBreakpoint.Addr))
 			return
 		} else {
 			db.currentBreakpoint = EmptyBreakpoint()
 			// Execute current instruction
 			err := db.vm.ExecuteInstruction()
-			if err.Kind != coppervm.ErrorKindOk {
+			if err != nil {
 				fmt.Println("Error", err)
 				db.vm.Halt = true
 				return
@@ -200,6 +223,63 @@ func (db *Copperdb) stepProgram() {
 	}
 }
 
+// Revert the last executed instruction of the program.
+func (db *Copperdb) reverseStepProgram() {
+	if db.vm.UndoLogSize() == 0 {
+		fmt.Println("No instructions to step back.")
+		return
+	}
+	fmt.Println("Stepping back.")
+	undone, _ := db.vm.StepBack()
+	db.printUndone(undone)
+	// Continuing doesn't stop on a breakpoint at the new ip
+	db.currentBreakpoint = EmptyBreakpoint()
+	if brIdx := db.breakpoints.GetIndexByAddress(db.vm.Ip); brIdx != -1 {
+		db.currentBreakpoint = db.breakpoints[brIdx]
+	}
+	fmt.Printf("[%d] -> %s%s\n", db.vm.Ip, db.vm.Program[db.vm.Ip], db.sourceLocation(db.vm.Ip))
+}
+
+// Revert the executed instructions of the program until a
+// breakpoint or the start of the recorded history is reached.
+func (db *Copperdb) reverseContinueProgram() {
+	if db.vm.UndoLogSize() == 0 {
+		fmt.Println("No instructions to step back.")
+		return
+	}
+	fmt.Println("Continuing backwards.")
+	db.currentBreakpoint = EmptyBreakpoint()
+	for {
+		undone, ok := db.vm.StepBack()
+		if !ok {
+			fmt.Printf("\nReached the start of the recorded history, %d%s\n",
+				db.vm.Ip,
+				db.sourceLocation(db.vm.Ip))
+			return
+		}
+		db.printUndone(undone)
+		if brIdx := db.breakpoints.GetIndexByAddress(db.vm.Ip); brIdx != -1 {
+			// Reached a breakpoint, mark it so continuing
+			// doesn't stop on it again
+			db.currentBreakpoint = db.breakpoints[brIdx]
+			fmt.Printf("\nBreakpoint %d, %d%s\n",
+				db.currentBreakpoint.Number,
+				db.currentBreakpoint.Addr,
+				db.sourceLocation(db.currentBreakpoint.Addr))
+			return
+		}
+	}
+}
+
+// Warn about the effects of a reverted instruction that
+// are not undone, like its output or the changes to the files.
+func (db *Copperdb) printUndone(undone coppervm.UndoneInstruction) {
+	if undone.SideEffects {
+		fmt.Printf("Warning: the effects of '%s' at %d outside the vm are not undone\n",
+			undone.Inst, undone.Ip)
+	}
+}
+
 // Print all set breakpoints.
 func (db *Copperdb) listBreakpoints() {
 	if len(db.breakpoints) > 0 {
@@ -242,12 +322,17 @@ func (db *Copperdb) PrintHelp() {
 	fmt.Println("r           -- Start debugged program.")
 	fmt.Println("c           -- Continue program being debugged after breakpoint.")
 	fmt.Println("s           -- Step program to next instruction.")
-	fmt.Println("b <loc|sym> -- Set a new breakpoint at specified location or symbol.")
+	fmt.Println("rs          -- Step program back to the previous instruction.")
+	fmt.Println("rc          -- Continue program backwards until a breakpoint.")
+	fmt.Println("               Output, files and other syscall effects are not undone.")
+	fmt.Println("b <loc|sym> -- Set a new breakpoint at specified location, symbol")
+	fmt.Println("               or source line (file:line).")
 	fmt.Println("d <loc>     -- Delete breakpoint at specified location.")
 	fmt.Println("l           -- List all breakpoints.")
 	fmt.Println("p           -- Dump the stack.")
 	fmt.Println("m           -- Dump the memory.")
 	fmt.Println("x           -- Print the instruction at ip.")
+	fmt.Println("bt          -- Print the backtrace of the active functions.")
 	fmt.Println("q           -- Quit the debugger.")
 	fmt.Println("h           -- Print this help message.")
 }
@@ -258,8 +343,34 @@ func (db *Copperdb) stringToBrNum(str string) (uint, error) {
 	return uint(out64), err
 }
 
+// Returns the source location of an address preceded by
+// " at ", or an empty string if the program has no line table.
+func (db *Copperdb) sourceLocation(addr coppervm.InstAddr) string {
+	if loc, ok := db.lineTable.Lookup(addr); ok {
+		return fmt.Sprintf(" at %s", loc)
+	}
+	return ""
+}
+
 // Parse a string to an address.
 func (db *Copperdb) stringToBrAddress(str string) (out int, err error) {
+	// Try parse as source line
+	if idx := strings.LastIndexByte(str, ':'); idx != -1 {
+		file, lineStr := str[:idx], str[idx+1:]
+		line, err := strconv.Atoi(lineStr)
+		if err != nil {
+			return out, fmt.Errorf("invalid line number '%s'", lineStr)
+		}
+		addr, ok := db.lineTable.AddressOf(line, func(name string) bool {
+			// The file can be given by its path or by its name
+			return name == file || filepath.Base(name) == file
+		})
+		if !ok {
+			return out, fmt.Errorf("no instructions at line '%s'", str)
+		}
+		return int(addr), nil
+	}
+
 	// Try parse as address
 	out, err = strconv.Atoi(str)
 	if err != nil {
@@ -0,0 +1,381 @@
+package coppervm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// Layout of a binary .copper file (all values are big-endian):
+//
+//	header:
+//	  magic          4 bytes  "CPVM"
+//	  version        u16
+//	  section count  u16
+//	section table (one entry per section):
+//	  kind           u32
+//	  offset         u32      from the start of the file
+//	  size           u32      in bytes
+//	sections:
+//	  code           one 10 bytes entry per instruction:
+//	                   kind     u8
+//	                   flags    u8  bit 0: has operand, bits 1-2: operand representation
+//	                   operand  u64
+//	  memory         raw bytes
+//	  entry          u64
+//	  debug symbols  u32 count followed by count entries of:
+//	                   address  u64
+//	                   length   u16
+//	                   name     length bytes
+//	  line table     written only if not empty;
+//	                 u32 file count followed by count entries of:
+//	                   length   u16
+//	                   name     length bytes
+//	                 u32 count followed by count entries of:
+//	                   address  u64
+//	                   file     u32  index in the file names
+//	                   row      u32
+//	                   col      u32
+const (
+	CoppervmFileMagic string = "CPVM"
+
+	fileHeaderSize       int = 8
+	fileSectionEntrySize int = 12
+	fileInstSize         int = 10
+	fileLineEntrySize    int = 20
+)
+
+type fileSectionKind uint32
+
+const (
+	fileSectionCode fileSectionKind = iota + 1
+	fileSectionMemory
+	fileSectionEntry
+	fileSectionDebugSymbols
+	fileSectionLineTable
+)
+
+type fileSection struct {
+	kind fileSectionKind
+	data []byte
+}
+
+// Encode the CoppervmFileMeta in the binary .copper format.
+// A zero Version is encoded as CoppervmFileVersion.
+// This method implements the encoding.BinaryMarshaler interface.
+func (meta CoppervmFileMeta) MarshalBinary() ([]byte, error) {
+	if meta.Version == 0 {
+		meta.Version = CoppervmFileVersion
+	}
+	if !isBinaryFileVersion(meta.Version) {
+		return nil, fmt.Errorf("unsupported file version %d", meta.Version)
+	}
+
+	// Code section
+	var code bytes.Buffer
+	for idx, inst := range meta.Program {
+		if inst.Kind < 0 || inst.Kind >= InstCount {
+			return nil, fmt.Errorf("invalid instruction kind %d at address %d", inst.Kind, idx)
+		}
+		rep, ok := wordRepresentation(inst.Operand)
+		if !ok {
+			return nil, fmt.Errorf("cannot encode operand %s at address %d", inst.Operand, idx)
+		}
+		flags := byte(rep) << 1
+		if inst.HasOperand {
+			flags |= 1
+		}
+		code.WriteByte(byte(inst.Kind))
+		code.WriteByte(flags)
+		binary.Write(&code, binary.BigEndian, wordBits(inst.Operand, rep))
+	}
+
+	// Entry section
+	var entry bytes.Buffer
+	binary.Write(&entry, binary.BigEndian, uint64(meta.Entry))
+
+	// Debug symbols section
+	var symbols bytes.Buffer
+	binary.Write(&symbols, binary.BigEndian, uint32(len(meta.DebugSymbols)))
+	for _, s := range meta.DebugSymbols {
+		if len(s.Name) > math.MaxUint16 {
+			return nil, fmt.Errorf("debug symbol name '%s' is too long", s.Name)
+		}
+		binary.Write(&symbols, binary.BigEndian, uint64(s.Address))
+		binary.Write(&symbols, binary.BigEndian, uint16(len(s.Name)))
+		symbols.WriteString(s.Name)
+	}
+
+	sections := []fileSection{
+		{fileSectionCode, code.Bytes()},
+		{fileSectionMemory, meta.Memory},
+		{fileSectionEntry, entry.Bytes()},
+		{fileSectionDebugSymbols, symbols.Bytes()},
+	}
+
+	// Line table section
+	if len(meta.LineTable) > 0 {
+		lines, err := encodeLineTableSection(meta.LineTable)
+		if err != nil {
+			return nil, err
+		}
+		sections = append(sections, fileSection{fileSectionLineTable, lines})
+	}
+
+	// Write header and section table followed by the sections data
+	var out bytes.Buffer
+	out.WriteString(CoppervmFileMagic)
+	binary.Write(&out, binary.BigEndian, uint16(meta.Version))
+	binary.Write(&out, binary.BigEndian, uint16(len(sections)))
+	offset := fileHeaderSize + len(sections)*fileSectionEntrySize
+	for _, s := range sections {
+		binary.Write(&out, binary.BigEndian, uint32(s.kind))
+		binary.Write(&out, binary.BigEndian, uint32(offset))
+		binary.Write(&out, binary.BigEndian, uint32(len(s.data)))
+		offset += len(s.data)
+	}
+	for _, s := range sections {
+		out.Write(s.data)
+	}
+
+	return out.Bytes(), nil
+}
+
+// Decode a CoppervmFileMeta from the binary .copper format.
+// This method implements the encoding.BinaryUnmarshaler interface.
+func (meta *CoppervmFileMeta) UnmarshalBinary(data []byte) error {
+	if len(data) < fileHeaderSize || string(data[:4]) != CoppervmFileMagic {
+		return fmt.Errorf("missing %s file header", CoppervmFileExtention)
+	}
+	version := int(binary.BigEndian.Uint16(data[4:6]))
+	if !isBinaryFileVersion(version) {
+		return fmt.Errorf("unsupported file version %d", version)
+	}
+	sectionCount := int(binary.BigEndian.Uint16(data[6:8]))
+	if len(data) < fileHeaderSize+sectionCount*fileSectionEntrySize {
+		return fmt.Errorf("truncated section table")
+	}
+
+	*meta = CoppervmFileMeta{Version: version}
+	for i := 0; i < sectionCount; i++ {
+		entry := data[fileHeaderSize+i*fileSectionEntrySize:]
+		kind := fileSectionKind(binary.BigEndian.Uint32(entry[0:4]))
+		offset := uint64(binary.BigEndian.Uint32(entry[4:8]))
+		size := uint64(binary.BigEndian.Uint32(entry[8:12]))
+		if offset+size > uint64(len(data)) {
+			return fmt.Errorf("section %d exceeds the file size", kind)
+		}
+		section := data[offset : offset+size]
+
+		var err error
+		switch kind {
+		case fileSectionCode:
+			meta.Program, err = decodeCodeSection(section)
+		case fileSectionMemory:
+			if size > 0 {
+				meta.Memory = append([]byte{}, section...)
+			}
+		case fileSectionEntry:
+			if size != 8 {
+				err = fmt.Errorf("invalid entry section size %d", size)
+			} else {
+				meta.Entry = int(binary.BigEndian.Uint64(section))
+			}
+		case fileSectionDebugSymbols:
+			meta.DebugSymbols, err = decodeDebugSymbolsSection(section)
+		case fileSectionLineTable:
+			meta.LineTable, err = decodeLineTableSection(section)
+		default:
+			// Unknown sections are skipped so newer files stay readable
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Returns true if the binary format can encode given file version.
+// Files of version CoppervmSharedStackFileVersion are still supported
+// and run with the return addresses on the data stack.
+func isBinaryFileVersion(version int) bool {
+	return version == CoppervmFileVersion || version == CoppervmSharedStackFileVersion
+}
+
+// Decode the instructions of a code section.
+func decodeCodeSection(section []byte) ([]InstDef, error) {
+	if len(section)%fileInstSize != 0 {
+		return nil, fmt.Errorf("invalid code section size %d", len(section))
+	}
+	program := make([]InstDef, 0, len(section)/fileInstSize)
+	for i := 0; i < len(section); i += fileInstSize {
+		kind := InstKind(section[i])
+		if kind >= InstCount {
+			return nil, fmt.Errorf("invalid instruction kind %d at address %d", kind, i/fileInstSize)
+		}
+		flags := section[i+1]
+		rep := TypeRepresentation(flags >> 1)
+		if rep > TypeF64 {
+			return nil, fmt.Errorf("invalid operand representation %d at address %d", rep, i/fileInstSize)
+		}
+		program = append(program, InstDef{
+			Kind:       kind,
+			HasOperand: flags&1 == 1,
+			Name:       kind.String(),
+			Operand:    wordFromBits(binary.BigEndian.Uint64(section[i+2:i+10]), rep),
+		})
+	}
+	return program, nil
+}
+
+// Decode the symbols of a debug symbols section.
+func decodeDebugSymbolsSection(section []byte) (symbols DebugSymbols, err error) {
+	if len(section) < 4 {
+		return nil, fmt.Errorf("invalid debug symbols section size %d", len(section))
+	}
+	count := int(binary.BigEndian.Uint32(section[0:4]))
+	section = section[4:]
+	for i := 0; i < count; i++ {
+		if len(section) < 10 {
+			return nil, fmt.Errorf("truncated debug symbol %d", i)
+		}
+		addr := binary.BigEndian.Uint64(section[0:8])
+		nameLen := int(binary.BigEndian.Uint16(section[8:10]))
+		section = section[10:]
+		if len(section) < nameLen {
+			return nil, fmt.Errorf("truncated debug symbol %d", i)
+		}
+		symbols = append(symbols, DebugSymbol{
+			Name:    string(section[:nameLen]),
+			Address: InstAddr(addr),
+		})
+		section = section[nameLen:]
+	}
+	return symbols, nil
+}
+
+// Encode a line table section; the file names are stored
+// once and referenced by index.
+func encodeLineTableSection(lineTable LineTable) ([]byte, error) {
+	var files []string
+	fileIds := make(map[string]uint32)
+	var entries bytes.Buffer
+	binary.Write(&entries, binary.BigEndian, uint32(len(lineTable)))
+	for _, loc := range lineTable {
+		id, ok := fileIds[loc.File]
+		if !ok {
+			if len(loc.File) > math.MaxUint16 {
+				return nil, fmt.Errorf("file name '%s' is too long", loc.File)
+			}
+			id = uint32(len(files))
+			fileIds[loc.File] = id
+			files = append(files, loc.File)
+		}
+		binary.Write(&entries, binary.BigEndian, uint64(loc.Address))
+		binary.Write(&entries, binary.BigEndian, id)
+		binary.Write(&entries, binary.BigEndian, uint32(loc.Row))
+		binary.Write(&entries, binary.BigEndian, uint32(loc.Col))
+	}
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.BigEndian, uint32(len(files)))
+	for _, f := range files {
+		binary.Write(&out, binary.BigEndian, uint16(len(f)))
+		out.WriteString(f)
+	}
+	out.Write(entries.Bytes())
+	return out.Bytes(), nil
+}
+
+// Decode the locations of a line table section.
+func decodeLineTableSection(section []byte) (lineTable LineTable, err error) {
+	if len(section) < 4 {
+		return nil, fmt.Errorf("invalid line table section size %d", len(section))
+	}
+	fileCount := int(binary.BigEndian.Uint32(section[0:4]))
+	section = section[4:]
+	var files []string
+	for i := 0; i < fileCount; i++ {
+		if len(section) < 2 {
+			return nil, fmt.Errorf("truncated line table file %d", i)
+		}
+		nameLen := int(binary.BigEndian.Uint16(section[0:2]))
+		section = section[2:]
+		if len(section) < nameLen {
+			return nil, fmt.Errorf("truncated line table file %d", i)
+		}
+		files = append(files, string(section[:nameLen]))
+		section = section[nameLen:]
+	}
+
+	if len(section) < 4 {
+		return nil, fmt.Errorf("truncated line table")
+	}
+	count := int(binary.BigEndian.Uint32(section[0:4]))
+	section = section[4:]
+	if len(section) != count*fileLineEntrySize {
+		return nil, fmt.Errorf("invalid line table size %d for %d entries", len(section), count)
+	}
+	for i := 0; i < count; i++ {
+		entry := section[i*fileLineEntrySize:]
+		file := binary.BigEndian.Uint32(entry[8:12])
+		if file >= uint32(len(files)) {
+			return nil, fmt.Errorf("invalid file %d in line table entry %d", file, i)
+		}
+		lineTable = append(lineTable, SourceLocation{
+			Address: InstAddr(binary.BigEndian.Uint64(entry[0:8])),
+			File:    files[file],
+			Row:     int(binary.BigEndian.Uint32(entry[12:16])),
+			Col:     int(binary.BigEndian.Uint32(entry[16:20])),
+		})
+	}
+	return lineTable, nil
+}
+
+// Returns the representation a Word was created with.
+// The second return value is false if the Word doesn't
+// match any of WordU64, WordI64 or WordF64.
+func wordRepresentation(w Word) (TypeRepresentation, bool) {
+	switch {
+	case wordsIdentical(w, WordU64(w.AsU64)):
+		return TypeU64, true
+	case wordsIdentical(w, WordI64(w.AsI64)):
+		return TypeI64, true
+	case wordsIdentical(w, WordF64(w.AsF64)):
+		return TypeF64, true
+	}
+	return TypeU64, false
+}
+
+// Returns the raw 64 bits of a Word in given representation.
+func wordBits(w Word, rep TypeRepresentation) uint64 {
+	if rep == TypeF64 {
+		return math.Float64bits(w.AsF64)
+	}
+	return w.AsU64
+}
+
+// Create a Word from its raw 64 bits and the representation
+// it was created with.
+// Floating point words are stored as their IEEE 754 bits.
+func wordFromBits(bits uint64, rep TypeRepresentation) (out Word) {
+	switch rep {
+	case TypeU64:
+		out = WordU64(bits)
+	case TypeI64:
+		out = WordI64(int64(bits))
+	case TypeF64:
+		out = WordF64(math.Float64frombits(bits))
+	}
+	return out
+}
+
+// Returns true if the two words have the same bits in all
+// their representations.
+func wordsIdentical(a Word, b Word) bool {
+	return a.AsU64 == b.AsU64 &&
+		a.AsI64 == b.AsI64 &&
+		math.Float64bits(a.AsF64) == math.Float64bits(b.AsF64)
+}
@@ -0,0 +1,174 @@
+package coppervm
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalUnmarshalBinary(t *testing.T) {
+	meta := FileMeta(1, []InstDef{
+		{Kind: InstPush, HasOperand: true, Name: "push", Operand: WordU64(math.MaxUint64)},
+		{Kind: InstPush, HasOperand: true, Name: "push", Operand: WordI64(-3)},
+		{Kind: InstPush, HasOperand: true, Name: "push", Operand: WordF64(-2.5)},
+		{Kind: InstPush, HasOperand: true, Name: "push", Operand: WordF64(math.NaN())},
+		{Kind: InstAddInt, HasOperand: false, Name: "add"},
+		{Kind: InstHalt, HasOperand: false, Name: "halt"},
+	}, []byte{1, 2, 3}, DebugSymbols{
+		{Name: "main", Address: 1},
+		{Name: "loop", Address: 4},
+	})
+
+	data, err := meta.MarshalBinary()
+	assert.NoError(t, err)
+
+	var decoded CoppervmFileMeta
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, CoppervmFileVersion, decoded.Version)
+	assert.Equal(t, meta.Entry, decoded.Entry)
+	assert.Equal(t, meta.Memory, decoded.Memory)
+	assert.Equal(t, meta.DebugSymbols, decoded.DebugSymbols)
+	assert.Len(t, decoded.Program, len(meta.Program))
+	for i := range meta.Program {
+		assert.Equal(t, meta.Program[i].Kind, decoded.Program[i].Kind)
+		assert.Equal(t, meta.Program[i].HasOperand, decoded.Program[i].HasOperand)
+		assert.Equal(t, meta.Program[i].Name, decoded.Program[i].Name)
+		assert.True(t, wordsIdentical(meta.Program[i].Operand, decoded.Program[i].Operand))
+	}
+}
+
+func TestLineTableSection(t *testing.T) {
+	meta := FileMeta(0, []InstDef{{Kind: InstNoop}, {Kind: InstNoop}, {Kind: InstHalt}}, nil, nil)
+	meta.LineTable = LineTable{
+		{Address: 0, File: "main.casm", Row: 3, Col: 5},
+		{Address: 1, File: "lib.casm", Row: 1, Col: 1},
+		{Address: 2, File: "main.casm", Row: 4, Col: 5},
+	}
+	data, err := meta.MarshalBinary()
+	assert.NoError(t, err)
+
+	decoded, err := ParseFileMeta(data)
+	assert.NoError(t, err)
+	assert.Equal(t, meta.LineTable, decoded.LineTable)
+
+	// The file names are stored once
+	section, err := encodeLineTableSection(meta.LineTable)
+	assert.NoError(t, err)
+	assert.Len(t, section, 4+2+len("main.casm")+2+len("lib.casm")+4+3*fileLineEntrySize)
+
+	// Files without line table don't have the section
+	meta.LineTable = nil
+	data, err = meta.MarshalBinary()
+	assert.NoError(t, err)
+	assert.Equal(t, uint16(4), binary.BigEndian.Uint16(data[6:8]))
+
+	invalidFile := append([]byte{}, section...)
+	invalidFile[4+2+len("main.casm")+2+len("lib.casm")+4+11] = 2
+	tests := [][]byte{
+		{},
+		{0, 0, 0, 1, 0},
+		{0, 0, 0, 1, 0, 4, 'a'},
+		{0, 0, 0, 0},
+		{0, 0, 0, 0, 0, 0, 0, 1},
+		section[:len(section)-1],
+		invalidFile,
+	}
+	for _, test := range tests {
+		_, err := decodeLineTableSection(test)
+		assert.Error(t, err, test)
+	}
+}
+
+func TestMarshalBinaryErrors(t *testing.T) {
+	tests := []CoppervmFileMeta{
+		FileMeta(0, []InstDef{{Kind: InstCount}}, nil, nil),
+		FileMeta(0, []InstDef{{Kind: InstPush, Operand: Word{AsU64: 1, AsI64: 2, AsF64: 3}}}, nil, nil),
+	}
+
+	unsupportedVersion := FileMeta(0, []InstDef{{Kind: InstHalt}}, nil, nil)
+	unsupportedVersion.Version = CoppervmLegacyFileVersion
+	tests = append(tests, unsupportedVersion)
+
+	for _, test := range tests {
+		_, err := test.MarshalBinary()
+		assert.Error(t, err, test)
+	}
+}
+
+func TestSharedStackFileVersion(t *testing.T) {
+	meta := FileMeta(0, []InstDef{{Kind: InstHalt}}, nil, nil)
+	meta.Version = CoppervmSharedStackFileVersion
+	data, err := meta.MarshalBinary()
+	assert.NoError(t, err)
+
+	decoded, err := ParseFileMeta(data)
+	assert.NoError(t, err)
+	assert.Equal(t, CoppervmSharedStackFileVersion, decoded.Version)
+}
+
+func TestMarshalBinaryZeroVersion(t *testing.T) {
+	// A meta built by hand is encoded with the current version
+	meta := CoppervmFileMeta{Program: []InstDef{{Kind: InstHalt, Name: "halt"}}}
+	data, err := meta.MarshalBinary()
+	assert.NoError(t, err)
+
+	decoded, err := ParseFileMeta(data)
+	assert.NoError(t, err)
+	assert.Equal(t, CoppervmFileVersion, decoded.Version)
+	assert.Equal(t, meta.Program, decoded.Program)
+}
+
+func TestUnmarshalBinaryErrors(t *testing.T) {
+	valid, err := FileMeta(0, []InstDef{{Kind: InstHalt}}, nil, nil).MarshalBinary()
+	assert.NoError(t, err)
+
+	invalidKind := append([]byte{}, valid...)
+	invalidKind[fileHeaderSize+4*fileSectionEntrySize] = byte(InstCount)
+
+	wrongVersion := append([]byte{}, valid...)
+	wrongVersion[5] = 0xff
+
+	tests := [][]byte{
+		{},
+		[]byte("CPV"),
+		[]byte("XXXX\x00\x02\x00\x00"),
+		wrongVersion,
+		valid[:fileHeaderSize+fileSectionEntrySize],
+		valid[:len(valid)-1],
+		invalidKind,
+	}
+
+	for _, test := range tests {
+		var meta CoppervmFileMeta
+		assert.Error(t, meta.UnmarshalBinary(test), test)
+	}
+}
+
+func TestParseFileMeta(t *testing.T) {
+	binary, err := FileMeta(2, []InstDef{{Kind: InstHalt}}, nil, nil).MarshalBinary()
+	assert.NoError(t, err)
+
+	tests := []struct {
+		content  []byte
+		version  int
+		hasError bool
+	}{
+		{binary, CoppervmFileVersion, false},
+		{[]byte(`{"version":1,"entry_point":2,"program":[]}`), CoppervmLegacyFileVersion, false},
+		{[]byte(`{"version":2,"entry_point":2,"program":[]}`), 0, true},
+		{[]byte(`not a program`), 0, true},
+	}
+
+	for _, test := range tests {
+		meta, err := ParseFileMeta(test.content)
+		if test.hasError {
+			assert.Error(t, err, test)
+		} else {
+			assert.NoError(t, err, test)
+			assert.Equal(t, test.version, meta.Version)
+			assert.Equal(t, 2, meta.Entry)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package coppervm
+
+import (
+	"context"
+	"time"
+)
+
+// Interface of the clock used by the time system calls.
+type Clock interface {
+	// Returns the current wall-clock time.
+	Now() time.Time
+	// Returns the time elapsed from an arbitrary origin;
+	// unlike Now it never goes backwards.
+	Monotonic() time.Duration
+	// Pauses the execution for given duration.
+	Sleep(d time.Duration)
+}
+
+// Implemented by the clocks whose Sleep really waits,
+// so it can be interrupted.
+type contextSleeper interface {
+	// Pauses the execution for given duration or until ctx is
+	// done, returning ctx.Err().
+	SleepContext(ctx context.Context, d time.Duration) error
+}
+
+// Clock backed by the host system clock.
+type systemClock struct {
+	origin time.Time
+}
+
+// Create a new Clock backed by the host system clock.
+func NewSystemClock() Clock {
+	return systemClock{origin: time.Now()}
+}
+
+func (c systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (c systemClock) Monotonic() time.Duration {
+	return time.Since(c.origin)
+}
+
+func (c systemClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+func (c systemClock) SleepContext(ctx context.Context, d time.Duration) error {
+	if ctx.Done() == nil {
+		time.Sleep(d)
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Clock that doesn't follow the real time; it starts at
+// a fixed time and advances only when Sleep is called,
+// without actually waiting.
+// It makes the execution of programs reproducible.
+type VirtualClock struct {
+	start   time.Time
+	elapsed time.Duration
+}
+
+// Create a new VirtualClock starting at given time.
+func NewVirtualClock(start time.Time) *VirtualClock {
+	return &VirtualClock{start: start}
+}
+
+func (c *VirtualClock) Now() time.Time {
+	return c.start.Add(c.elapsed)
+}
+
+func (c *VirtualClock) Monotonic() time.Duration {
+	return c.elapsed
+}
+
+func (c *VirtualClock) Sleep(d time.Duration) {
+	if d > 0 {
+		c.elapsed += d
+	}
+}
@@ -1,46 +1,396 @@
 package coppervm
 
 import (
+	"context"
 	"encoding/binary"
-	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/Supercaly/coppervm/internal"
 )
 
 const (
-	CoppervmStackCapacity  int64  = 1024
-	CoppervmMemoryCapacity int64  = 1024
-	CoppervmFileExtention  string = ".copper"
+	CoppervmStackCapacity     int64  = 1024
+	CoppervmCallStackCapacity int64  = 1024
+	CoppervmTryStackCapacity  int64  = 256
+	CoppervmMemoryCapacity    int64  = 1024
+	CoppervmFileExtention     string = ".copper"
+	// Number of instructions executed by ExecuteProgramContext
+	// between two checks of the context
+	CoppervmContextCheckInterval int = 1024
 )
 
 type InstAddr uint64
 
+// State of a virtual machine.
+// Create it with NewCoppervm to configure it with options; the
+// fields of a Coppervm literal that are not set get the defaults
+// of NewCoppervm when a program is loaded or executed.
 type Coppervm struct {
 	// VM Stack
-	Stack     [CoppervmStackCapacity]Word
+	Stack     []Word
 	StackSize int64
 
+	// VM Call Stack with the return addresses of the
+	// active functions
+	CallStack     []InstAddr
+	CallStackSize int64
+	// Are the return addresses kept on the data stack
+	// like in the files before version 3?
+	sharedCallStack      bool
+	forceSharedCallStack bool
+
+	// Frames pushed by the try instructions that
+	// are still active
+	tryStack     []tryFrame
+	tryStackSize int64
+
 	// VM Program
 	Program     []InstDef
 	Ip          InstAddr
 	initialAddr InstAddr
+	// Labels and source locations of the program used
+	// to symbolize the backtraces
+	debugSymbols DebugSymbols
+	lineTable    LineTable
 
 	// VM Memory
-	Memory        [CoppervmMemoryCapacity]byte
-	initialMemory [CoppervmMemoryCapacity]byte
+	Memory        []byte
+	initialMemory []byte
+	// Lock held by the atomic instructions, shared by the vms
+	// that share the memory; when the memory is shared the plain
+	// accesses hold it too
+	memoryLock   *sync.Mutex
+	sharedMemory bool
+
+	// Heap region between the end of the static memory
+	// and the program break
+	heapStart   uint64
+	memoryBreak uint64
 
 	// Opened File Descriptors
-	FDs []*os.File
+	FDs []File
+	// Filesystem used by the file system calls
+	fs FileSystem
+
+	// Standard streams and debug output
+	stdin       io.Reader
+	stdout      io.Writer
+	stderr      io.Writer
+	debugOutput io.Writer
+
+	// Command-line arguments and environment of the program
+	args      []string
+	lookupEnv func(name string) (string, bool)
+
+	// Clock and pseudo-random numbers of the program
+	clock       Clock
+	random      xorshift64
+	initialSeed uint64
+
+	// Available system calls
+	syscalls SyscallTable
+	// Addresses of the handlers of the faults installed by the
+	// program, by kind or TrapCatchAll
+	traps map[CoppervmErrorKind]InstAddr
+
+	// Cost of the instructions and gas left to the program;
+	// the gas is not metered if the table is nil
+	gasTable   *GasTable
+	gas        uint64
+	initialGas uint64
+
+	// Observers of the execution
+	hooks []Hook
+	// Changes of the last instructions, recorded to revert them
+	undoLog *undoLog
+
+	// Threads of the program, nil until the first one is
+	// spawned, and channels between them
+	threads       []*thread
+	currentThread int
+	timeSlice     int
+	channels      []*channel
+	// Does the running thread yield, block or exit
+	// after this instruction?
+	switchThread bool
+	// Is the running thread blocked in a system call?
+	blocked bool
+
+	// Context of the running ExecuteProgramContext,
+	// used to interrupt the blocking system calls
+	ctx context.Context
 
 	// Is the VM halted?
 	Halt     bool
 	ExitCode int
+
+	// Are the unset fields filled with the defaults?
+	initialized bool
+}
+
+// Option used to configure a Coppervm created with NewCoppervm.
+type CoppervmOption func(vm *Coppervm)
+
+// Set the number of Words the stack can hold.
+// The default is CoppervmStackCapacity; a capacity that is not
+// positive is ignored.
+func WithStackCapacity(capacity int64) CoppervmOption {
+	return func(vm *Coppervm) {
+		if capacity > 0 {
+			vm.Stack = make([]Word, capacity)
+		}
+	}
+}
+
+// Set the number of return addresses the call stack can hold.
+// The default is CoppervmCallStackCapacity; a negative capacity
+// is ignored.
+func WithCallStackCapacity(capacity int64) CoppervmOption {
+	return func(vm *Coppervm) {
+		if capacity >= 0 {
+			vm.CallStack = make([]InstAddr, capacity)
+		}
+	}
+}
+
+// Keep the return addresses on the data stack even for
+// programs that use the separate call stack.
+// Programs older than CoppervmFileVersion always run in
+// this mode.
+func WithSharedCallStack() CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.forceSharedCallStack = true
+	}
+}
+
+// Set the number of bytes of memory available to the program.
+// The default is CoppervmMemoryCapacity; a negative capacity is
+// ignored.
+func WithMemoryCapacity(capacity int64) CoppervmOption {
+	return func(vm *Coppervm) {
+		if capacity >= 0 {
+			vm.Memory = make([]byte, capacity)
+			vm.initialMemory = make([]byte, capacity)
+		}
+	}
+}
+
+// Use given memory, shared with other vms, instead of allocating
+// it; the vms that share the memory must hold the same lock,
+// taken by every instruction and syscall accessing the memory.
+// Each access is atomic on its own, but only the atomic
+// instructions can read and update memory in one step.
+// Loading a program writes its static memory at the start of
+// the shared one.
+// It replaces the memory set by WithMemoryCapacity.
+func WithSharedMemory(memory []byte, lock *sync.Mutex) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.Memory = memory
+		vm.initialMemory = make([]byte, len(memory))
+		vm.memoryLock = lock
+		vm.sharedMemory = true
+	}
+}
+
+// Set the stream used as standard input by the program.
+// The default is os.Stdin.
+func WithStdin(stdin io.Reader) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.stdin = stdin
+	}
+}
+
+// Set the stream used as standard output by the program.
+// The default is os.Stdout.
+func WithStdout(stdout io.Writer) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.stdout = stdout
+	}
+}
+
+// Set the stream used as standard error by the program.
+// The default is os.Stderr.
+func WithStderr(stderr io.Writer) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.stderr = stderr
+	}
+}
+
+// Set the stream where the print instruction and the
+// stack and memory dumps are written.
+// The default is os.Stdout.
+func WithDebugOutput(output io.Writer) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.debugOutput = output
+	}
+}
+
+// Set the filesystem used by the file system calls.
+// The default is the unrestricted OSFileSystem.
+func WithFileSystem(fs FileSystem) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.fs = fs
+	}
+}
+
+// Set the command-line arguments of the program; by convention
+// the first one is the path of the program.
+// The default is no arguments.
+func WithArgs(args []string) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.args = append([]string{}, args...)
+	}
+}
+
+// Set the environment of the program as a list of "key=value"
+// strings, like the ones returned by os.Environ.
+// The default is the environment of the host process.
+func WithEnv(env []string) CoppervmOption {
+	return func(vm *Coppervm) {
+		vars := make(map[string]string, len(env))
+		for _, kv := range env {
+			if idx := strings.IndexByte(kv, '='); idx >= 0 {
+				vars[kv[:idx]] = kv[idx+1:]
+			}
+		}
+		vm.lookupEnv = func(name string) (string, bool) {
+			value, exist := vars[name]
+			return value, exist
+		}
+	}
+}
+
+// Set the clock used by the time system calls.
+// The default is the host system clock.
+func WithClock(clock Clock) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.clock = clock
+	}
+}
+
+// Set the initial seed of the pseudo-random numbers.
+// The default is a seed based on the current time.
+func WithRandomSeed(seed uint64) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.initialSeed = seed
+	}
+}
+
+// Register a hook that observes the execution.
+// Hooks are called in the order they are registered.
+func WithHook(hook Hook) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.AddHook(hook)
+	}
+}
+
+// Register a system call handler, replacing the default one
+// if the system call already exists.
+func WithSyscall(sysCall SysCall, handler SyscallHandler) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.RegisterSyscall(sysCall, handler)
+	}
+}
+
+// Replace all the system calls with the ones in given table.
+func WithSyscallTable(table SyscallTable) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.syscalls = SyscallTable{}
+		for sysCall, handler := range table {
+			vm.syscalls[sysCall] = handler
+		}
+	}
+}
+
+// Create a new Coppervm configured with given options; it's
+// the only way to create a usable vm.
+func NewCoppervm(opts ...CoppervmOption) *Coppervm {
+	vm := &Coppervm{
+		syscalls:    DefaultSyscallTable(),
+		fs:          OSFileSystem{},
+		lookupEnv:   os.LookupEnv,
+		clock:       NewSystemClock(),
+		initialSeed: uint64(time.Now().UnixNano()),
+		stdin:       os.Stdin,
+		stdout:      os.Stdout,
+		stderr:      os.Stderr,
+		debugOutput: os.Stdout,
+		memoryLock:  &sync.Mutex{},
+	}
+	WithStackCapacity(CoppervmStackCapacity)(vm)
+	WithCallStackCapacity(CoppervmCallStackCapacity)(vm)
+	WithTryStackCapacity(CoppervmTryStackCapacity)(vm)
+	WithMemoryCapacity(CoppervmMemoryCapacity)(vm)
+	for _, opt := range opts {
+		opt(vm)
+	}
+	vm.random.seed(vm.initialSeed)
+	vm.sharedCallStack = vm.forceSharedCallStack
+	vm.stdin = newInterruptibleReader(vm.stdin)
+	vm.initialized = true
+	return vm
+}
+
+// Set the defaults of NewCoppervm to the fields that are not set
+// in a vm created as a Coppervm literal.
+func (vm *Coppervm) ensureDefaults() {
+	if vm.initialized {
+		return
+	}
+	defaults := NewCoppervm()
+	if vm.Stack == nil {
+		vm.Stack = defaults.Stack
+	}
+	if vm.CallStack == nil {
+		vm.CallStack = defaults.CallStack
+	}
+	if vm.tryStack == nil {
+		vm.tryStack = defaults.tryStack
+	}
+	if vm.Memory == nil {
+		vm.Memory = defaults.Memory
+	}
+	if len(vm.initialMemory) != len(vm.Memory) {
+		vm.initialMemory = append([]byte{}, vm.Memory...)
+	}
+	if vm.memoryLock == nil {
+		vm.memoryLock = defaults.memoryLock
+	}
+	if vm.fs == nil {
+		vm.fs = defaults.fs
+	}
+	if vm.stdin == nil {
+		vm.stdin = defaults.stdin
+	}
+	if vm.stdout == nil {
+		vm.stdout = defaults.stdout
+	}
+	if vm.stderr == nil {
+		vm.stderr = defaults.stderr
+	}
+	if vm.debugOutput == nil {
+		vm.debugOutput = defaults.debugOutput
+	}
+	if vm.lookupEnv == nil {
+		vm.lookupEnv = defaults.lookupEnv
+	}
+	if vm.clock == nil {
+		vm.clock = defaults.clock
+	}
+	if vm.syscalls == nil {
+		vm.syscalls = defaults.syscalls
+	}
+	vm.initialSeed = defaults.initialSeed
+	vm.random = defaults.random
+	vm.initialized = true
 }
 
 // Load program's binary to vm from file.
@@ -61,10 +411,11 @@ func (vm *Coppervm) LoadProgramFromFile(filePath string) (meta CoppervmFileMeta,
 			fileErr))
 	}
 
-	if err := json.Unmarshal(content, &meta); err != nil {
+	meta, parseErr := ParseFileMeta(content)
+	if parseErr != nil {
 		panic(fmt.Sprintf("error reading content of file '%s': %s",
 			filePath,
-			err))
+			parseErr))
 	}
 
 	vm.loadProgramFromMeta(meta)
@@ -75,55 +426,156 @@ func (vm *Coppervm) LoadProgramFromFile(filePath string) (meta CoppervmFileMeta,
 
 // Loads a program's binary from a CoppervmFileMeta.
 func (vm *Coppervm) loadProgramFromMeta(meta CoppervmFileMeta) {
+	vm.ensureDefaults()
 	// Init program
+	vm.stopThreads()
 	vm.Halt = false
 	vm.Ip = InstAddr(meta.Entry)
 	vm.initialAddr = vm.Ip
 	vm.Program = meta.Program
+	vm.debugSymbols = meta.DebugSymbols
+	vm.lineTable = meta.LineTable
+
+	// Files older than the call stack put the return
+	// addresses on the data stack
+	vm.sharedCallStack = vm.forceSharedCallStack || meta.Version < CoppervmFileVersion
+	vm.CallStackSize = 0
+	vm.tryStackSize = 0
+	vm.traps = nil
+	vm.clearUndoLog()
 
 	// Init memory
-	if len(meta.Memory) > int(CoppervmMemoryCapacity) {
-		panic("memory exceed the maximum memory capacity")
+	if len(meta.Memory) > len(vm.Memory) {
+		panic(fmt.Sprintf("memory of %d bytes exceed the memory capacity of %d bytes",
+			len(meta.Memory),
+			len(vm.Memory)))
 	}
-	for i := 0; i < len(meta.Memory); i++ {
-		vm.Memory[i] = meta.Memory[i]
-	}
-	vm.initialMemory = vm.Memory
+	vm.lockSharedMemory()
+	copy(vm.Memory, meta.Memory)
+	copy(vm.initialMemory, vm.Memory)
+	vm.unlockSharedMemory()
+	vm.heapStart = uint64(len(meta.Memory))
+	vm.memoryBreak = vm.heapStart
 
-	// Append Stdin, Stdout, Stderr to open file descriptors
-	vm.FDs = append(vm.FDs, os.Stdin)
-	vm.FDs = append(vm.FDs, os.Stdout)
-	vm.FDs = append(vm.FDs, os.Stderr)
+	// Stdin, Stdout, Stderr are the first open file descriptors
+	vm.closeFds()
+	vm.FDs = []File{
+		streamFile{reader: vm.stdin},
+		streamFile{writer: vm.stdout},
+		streamFile{writer: vm.stderr},
+	}
 }
 
 // Executes all the program of the vm.
-// Return a CoppervmError if something went wrong or ErrorOk.
-func (vm *Coppervm) ExecuteProgram(limit int) *CoppervmError {
+// Return a *CoppervmError if something went wrong or nil.
+func (vm *Coppervm) ExecuteProgram(limit int) error {
 	for limit != 0 && !vm.Halt {
-		if err := vm.ExecuteInstruction(); err.Kind != ErrorKindOk {
+		if err := vm.ExecuteInstruction(); err != nil {
 			return err
 		}
 		limit--
 	}
-	return ErrorOk(vm)
+	return nil
+}
+
+// Executes all the program of the vm like ExecuteProgram, stopping
+// when ctx is canceled or its deadline expires.
+// The context is checked every CoppervmContextCheckInterval
+// instructions and while a read from the standard input or a sleep
+// is blocked; then a *CoppervmError of kind ErrorKindCanceled is
+// returned, that wraps ctx.Err(). The interrupted instruction is
+// not completed, so the execution can be resumed later.
+func (vm *Coppervm) ExecuteProgramContext(ctx context.Context, limit int) error {
+	vm.ctx = ctx
+	defer func() {
+		vm.ctx = nil
+	}()
+	for step := 0; limit != 0 && !vm.Halt; step++ {
+		if step%CoppervmContextCheckInterval == 0 {
+			if err := ctx.Err(); err != nil {
+				return ErrorCanceled(vm, err)
+			}
+		}
+		if err := vm.ExecuteInstruction(); err != nil {
+			return err
+		}
+		limit--
+	}
+	return nil
+}
+
+// Returns the context of the running execution.
+func (vm *Coppervm) context() context.Context {
+	if vm.ctx == nil {
+		return context.Background()
+	}
+	return vm.ctx
 }
 
 // Executes a single instruction of the program where the
 // current ip points and then increments the ip.
-// Return a CoppervmError if something went wrong or ErrorOk.
-func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
+// Return a *CoppervmError if something went wrong or nil; the
+// faults caught by a trap handler of the program continue the
+// execution from the handler instead.
+// Use errors.Is with a CoppervmErrorKind to check the kind
+// of the error.
+func (vm *Coppervm) ExecuteInstruction() error {
+	if !vm.initialized {
+		vm.ensureDefaults()
+	}
 	if vm.Ip >= InstAddr(len(vm.Program)) {
-		return ErrorIllegalInstAccess(vm)
+		err := vm.trap(ErrorIllegalInstAccess(vm))
+		if err == nil && vm.undoLog != nil {
+			// The stack changed outside of an instruction
+			vm.undoLog.synced = false
+		}
+		return err
 	}
 
 	currentInst := vm.Program[vm.Ip]
+	if vm.gasTable != nil {
+		if err := vm.chargeGas(currentInst); err != nil {
+			return err
+		}
+	}
+
+	var err error
+	if len(vm.hooks) == 0 {
+		err = vm.executeInstruction(currentInst)
+		if err != nil {
+			err = vm.trap(err)
+		}
+	} else {
+		ip := vm.Ip
+		for _, h := range vm.hooks {
+			h.BeforeInstruction(vm, ip, currentInst)
+		}
+		err = vm.executeInstruction(currentInst)
+		if err != nil {
+			err = vm.trap(err)
+		}
+		for _, h := range vm.hooks {
+			h.AfterInstruction(vm, ip, currentInst, err)
+		}
+	}
+	if vm.gasTable != nil && vm.didNotComplete(err) {
+		vm.refundGas(currentInst)
+	}
+	if err == nil && vm.threads != nil && !vm.Halt {
+		err = vm.tickThread()
+	}
+	return err
+}
+
+// Executes given instruction, that is the one at the current ip.
+func (vm *Coppervm) executeInstruction(currentInst InstDef) error {
 	internal.DebugPrint("[INFO]: execute instruction %s\n", currentInst)
 	switch currentInst.Kind {
 	// Basic instructions
 	case InstNoop:
 		vm.Ip++
 	case InstPush:
-		if err := vm.pushStack(currentInst.Operand); err.Kind != ErrorKindOk {
+		if err := vm.pushStack(currentInst.Operand); err != nil {
 			return err
 		}
 		vm.Ip++
@@ -142,7 +594,7 @@ func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
 			return ErrorStackUnderflow(vm)
 		}
 		newVal := vm.Stack[vm.StackSize-1]
-		if err := vm.pushStack(newVal); err.Kind != ErrorKindOk {
+		if err := vm.pushStack(newVal); err != nil {
 			return err
 		}
 		vm.Ip++
@@ -152,7 +604,7 @@ func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
 			return ErrorStackUnderflow(vm)
 		}
 		newVal := vm.Stack[vm.StackSize-int64(loc)-1]
-		if err := vm.pushStack(newVal); err.Kind != ErrorKindOk {
+		if err := vm.pushStack(newVal); err != nil {
 			return err
 		}
 		vm.Ip++
@@ -423,38 +875,80 @@ func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
 		vm.StackSize--
 	// Functions
 	case InstFunCall:
-		if err := vm.pushStack(WordU64(uint64(vm.Ip + 1))); err.Kind != ErrorKindOk {
+		if err := vm.pushReturnAddress(vm.Ip + 1); err != nil {
 			return err
 		}
-		vm.Ip = InstAddr(currentInst.Operand.AsU64)
+		target := InstAddr(currentInst.Operand.AsU64)
+		if len(vm.hooks) > 0 {
+			vm.hookCall(target)
+		}
+		vm.Ip = target
 	case InstFunReturn:
+		retAddr, err := vm.popReturnAddress()
+		if err != nil {
+			return err
+		}
+		if len(vm.hooks) > 0 {
+			vm.hookReturn(retAddr)
+		}
+		vm.Ip = retAddr
+	case InstJmpIndirect:
 		if vm.StackSize < 1 {
 			return ErrorStackUnderflow(vm)
 		}
-		retAdds := vm.Stack[vm.StackSize-1]
+		target := InstAddr(vm.Stack[vm.StackSize-1].AsU64)
+		if target >= InstAddr(len(vm.Program)) {
+			return ErrorIllegalInstAccess(vm)
+		}
 		vm.StackSize--
-		vm.Ip = InstAddr(retAdds.AsU64)
+		vm.Ip = target
+	case InstFunCallIndirect:
+		if vm.StackSize < 1 {
+			return ErrorStackUnderflow(vm)
+		}
+		target := InstAddr(vm.Stack[vm.StackSize-1].AsU64)
+		if target >= InstAddr(len(vm.Program)) {
+			return ErrorIllegalInstAccess(vm)
+		}
+		vm.StackSize--
+		if err := vm.pushReturnAddress(vm.Ip + 1); err != nil {
+			vm.StackSize++
+			return err
+		}
+		if len(vm.hooks) > 0 {
+			vm.hookCall(target)
+		}
+		vm.Ip = target
 	// Memory Access
 	case InstMemRead:
 		if vm.StackSize < 1 {
 			return ErrorStackUnderflow(vm)
 		}
 		addr := vm.Stack[vm.StackSize-1].AsU64
-		if addr >= uint64(CoppervmMemoryCapacity) {
-			return ErrorIllegalMemoryAccess(vm)
+		if !vm.isValidMemoryRange(addr, 1) {
+			return ErrorIllegalMemoryAccess(vm, addr)
 		}
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryRead(addr, 1)
+		}
+		vm.lockSharedMemory()
 		vm.Stack[vm.StackSize-1] = WordU64(uint64(vm.Memory[addr]))
+		vm.unlockSharedMemory()
 		vm.Ip++
 	case InstMemReadInt:
 		if vm.StackSize < 1 {
 			return ErrorStackUnderflow(vm)
 		}
 		addr := vm.Stack[vm.StackSize-1].AsU64
-		if addr >= uint64(CoppervmMemoryCapacity) {
-			return ErrorIllegalMemoryAccess(vm)
+		if !vm.isValidMemoryRange(addr, 8) {
+			return ErrorIllegalMemoryAccess(vm, addr)
+		}
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryRead(addr, 8)
 		}
-		buffer := vm.Memory[addr : addr+8]
-		value := binary.BigEndian.Uint64(buffer)
+		vm.lockSharedMemory()
+		value := binary.BigEndian.Uint64(vm.Memory[addr : addr+8])
+		vm.unlockSharedMemory()
 		vm.Stack[vm.StackSize-1] = WordI64(int64(value))
 		vm.Ip++
 	case InstMemReadFloat:
@@ -462,11 +956,15 @@ func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
 			return ErrorStackUnderflow(vm)
 		}
 		addr := vm.Stack[vm.StackSize-1].AsU64
-		if addr >= uint64(CoppervmMemoryCapacity) {
-			return ErrorIllegalMemoryAccess(vm)
+		if !vm.isValidMemoryRange(addr, 8) {
+			return ErrorIllegalMemoryAccess(vm, addr)
 		}
-		buffer := vm.Memory[addr : addr+8]
-		value := binary.BigEndian.Uint64(buffer)
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryRead(addr, 8)
+		}
+		vm.lockSharedMemory()
+		value := binary.BigEndian.Uint64(vm.Memory[addr : addr+8])
+		vm.unlockSharedMemory()
 		vm.Stack[vm.StackSize-1] = WordF64(math.Float64frombits(value))
 		vm.Ip++
 	case InstMemWrite:
@@ -474,10 +972,16 @@ func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
 			return ErrorStackUnderflow(vm)
 		}
 		addr := vm.Stack[vm.StackSize-1].AsU64
-		if addr >= uint64(CoppervmMemoryCapacity) {
-			return ErrorIllegalMemoryAccess(vm)
+		if !vm.isValidMemoryRange(addr, 1) {
+			return ErrorIllegalMemoryAccess(vm, addr)
+		}
+		value := byte(vm.Stack[vm.StackSize-2].AsU64)
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryWrite(addr, []byte{value})
 		}
-		vm.Memory[addr] = byte(vm.Stack[vm.StackSize-2].AsU64)
+		vm.lockSharedMemory()
+		vm.Memory[addr] = value
+		vm.unlockSharedMemory()
 		vm.StackSize -= 2
 		vm.Ip++
 	case InstMemWriteInt:
@@ -485,15 +989,18 @@ func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
 			return ErrorStackUnderflow(vm)
 		}
 		addr := vm.Stack[vm.StackSize-1].AsU64
-		if addr >= uint64(CoppervmMemoryCapacity) {
-			return ErrorIllegalMemoryAccess(vm)
+		if !vm.isValidMemoryRange(addr, 8) {
+			return ErrorIllegalMemoryAccess(vm, addr)
 		}
 		value := vm.Stack[vm.StackSize-2].AsI64
 		var buffer [8]byte
 		binary.BigEndian.PutUint64(buffer[:], uint64(value))
-		for i := uint64(0); i < uint64(8); i++ {
-			vm.Memory[addr+i] = buffer[i]
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryWrite(addr, buffer[:])
 		}
+		vm.lockSharedMemory()
+		copy(vm.Memory[addr:addr+8], buffer[:])
+		vm.unlockSharedMemory()
 		vm.StackSize -= 2
 		vm.Ip++
 	case InstMemWriteFloat:
@@ -501,166 +1008,136 @@ func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
 			return ErrorStackUnderflow(vm)
 		}
 		addr := vm.Stack[vm.StackSize-1].AsU64
-		if addr >= uint64(CoppervmMemoryCapacity) {
-			return ErrorIllegalMemoryAccess(vm)
+		if !vm.isValidMemoryRange(addr, 8) {
+			return ErrorIllegalMemoryAccess(vm, addr)
 		}
 		value := math.Float64bits(vm.Stack[vm.StackSize-2].AsF64)
 		var buffer [8]byte
 		binary.BigEndian.PutUint64(buffer[:], uint64(value))
-		for i := uint64(0); i < uint64(8); i++ {
-			vm.Memory[addr+i] = buffer[i]
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryWrite(addr, buffer[:])
+		}
+		vm.lockSharedMemory()
+		copy(vm.Memory[addr:addr+8], buffer[:])
+		vm.unlockSharedMemory()
+		vm.StackSize -= 2
+		vm.Ip++
+	// Atomic memory access
+	case InstMemReadAtomic:
+		if vm.StackSize < 1 {
+			return ErrorStackUnderflow(vm)
 		}
+		addr := vm.Stack[vm.StackSize-1].AsU64
+		if !vm.isValidMemoryRange(addr, 8) {
+			return ErrorIllegalMemoryAccess(vm, addr)
+		}
+		vm.memoryLock.Lock()
+		value := binary.BigEndian.Uint64(vm.Memory[addr : addr+8])
+		vm.memoryLock.Unlock()
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryRead(addr, 8)
+		}
+		vm.Stack[vm.StackSize-1] = WordI64(int64(value))
+		vm.Ip++
+	case InstMemWriteAtomic:
+		if vm.StackSize < 2 {
+			return ErrorStackUnderflow(vm)
+		}
+		addr := vm.Stack[vm.StackSize-1].AsU64
+		if !vm.isValidMemoryRange(addr, 8) {
+			return ErrorIllegalMemoryAccess(vm, addr)
+		}
+		var buffer [8]byte
+		binary.BigEndian.PutUint64(buffer[:], uint64(vm.Stack[vm.StackSize-2].AsI64))
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryWrite(addr, buffer[:])
+		}
+		vm.memoryLock.Lock()
+		copy(vm.Memory[addr:addr+8], buffer[:])
+		vm.memoryLock.Unlock()
+		vm.StackSize -= 2
+		vm.Ip++
+	case InstMemCompareSwap:
+		if vm.StackSize < 3 {
+			return ErrorStackUnderflow(vm)
+		}
+		addr := vm.Stack[vm.StackSize-1].AsU64
+		if !vm.isValidMemoryRange(addr, 8) {
+			return ErrorIllegalMemoryAccess(vm, addr)
+		}
+		expected := uint64(vm.Stack[vm.StackSize-3].AsI64)
+		value := uint64(vm.Stack[vm.StackSize-2].AsI64)
+		old := vm.atomicUpdate(addr, func(old uint64) (uint64, bool) {
+			return value, old == expected
+		})
 		vm.StackSize -= 2
+		vm.Stack[vm.StackSize-1] = WordI64(int64(old))
 		vm.Ip++
+	case InstMemFetchAdd:
+		if vm.StackSize < 2 {
+			return ErrorStackUnderflow(vm)
+		}
+		addr := vm.Stack[vm.StackSize-1].AsU64
+		if !vm.isValidMemoryRange(addr, 8) {
+			return ErrorIllegalMemoryAccess(vm, addr)
+		}
+		increment := uint64(vm.Stack[vm.StackSize-2].AsI64)
+		old := vm.atomicUpdate(addr, func(old uint64) (uint64, bool) {
+			return old + increment, true
+		})
+		vm.StackSize--
+		vm.Stack[vm.StackSize-1] = WordI64(int64(old))
+		vm.Ip++
+	// Exceptions
+	case InstTry:
+		if vm.tryStackSize >= int64(len(vm.tryStack)) {
+			return ErrorTryStackOverflow(vm)
+		}
+		vm.tryStack[vm.tryStackSize] = tryFrame{
+			handler:       InstAddr(currentInst.Operand.AsU64),
+			stackSize:     vm.StackSize,
+			callStackSize: vm.CallStackSize,
+		}
+		vm.tryStackSize++
+		vm.Ip++
+	case InstEndTry:
+		if vm.tryStackSize < 1 {
+			return ErrorTryStackUnderflow(vm)
+		}
+		vm.tryStackSize--
+		vm.Ip++
+	case InstThrow:
+		if vm.StackSize < 1 {
+			return ErrorStackUnderflow(vm)
+		}
+		return vm.throw(vm.Stack[vm.StackSize-1])
 	// Syscall
 	case InstSyscall:
 		sysCall := SysCall(currentInst.Operand.AsU64)
-		switch sysCall {
-		case SysCallRead:
-			if vm.StackSize < 3 {
-				return ErrorStackUnderflow(vm)
-			}
-			// Get count and start
-			count := vm.Stack[vm.StackSize-1].AsU64
-			bufStart := vm.Stack[vm.StackSize-2].AsU64
-			if bufStart > uint64(CoppervmMemoryCapacity) {
-				return ErrorIllegalMemoryAccess(vm)
-			}
-
-			// Get file descriptor
-			fd := vm.Stack[vm.StackSize-3].AsU64
-			if fd >= uint64(len(vm.FDs)) {
-				vm.Stack[vm.StackSize-3] = WordI64(-1)
-			} else {
-				// Read form file
-				file := vm.FDs[fd]
-				buf := make([]byte, count)
-				readBytesCount, err := file.Read(buf)
-				if err != nil {
-					vm.Stack[vm.StackSize-3] = WordI64(-1)
-				} else {
-					for i := bufStart; i < bufStart+uint64(readBytesCount); i++ {
-						vm.Memory[i] = buf[i-bufStart]
-					}
-					vm.Stack[vm.StackSize-3] = WordU64(uint64(readBytesCount))
-				}
-			}
-			vm.StackSize -= 2
-			vm.Ip++
-		case SysCallWrite:
-			if vm.StackSize < 3 {
-				return ErrorStackUnderflow(vm)
-			}
-			// Get count and start
-			count := vm.Stack[vm.StackSize-1].AsU64
-			bufStart := vm.Stack[vm.StackSize-2].AsU64
-			if bufStart > uint64(CoppervmMemoryCapacity) {
-				return ErrorIllegalMemoryAccess(vm)
-			}
-			buf := vm.Memory[bufStart : bufStart+count]
-
-			// Get file descriptor
-			fd := vm.Stack[vm.StackSize-3].AsU64
-			if fd >= uint64(len(vm.FDs)) {
-				vm.Stack[vm.StackSize-3] = WordI64(-1)
-			} else {
-				// Write to file
-				file := vm.FDs[fd]
-				writtenBytesCount, err := file.Write(buf)
-				if err != nil {
-					vm.Stack[vm.StackSize-3] = WordI64(-1)
-				} else {
-					vm.Stack[vm.StackSize-3] = WordU64(uint64(writtenBytesCount))
-				}
-			}
-			vm.StackSize -= 2
-			vm.Ip++
-		case SysCallOpen:
-			if vm.StackSize < 1 {
-				return ErrorStackUnderflow(vm)
-			}
-			// Get file name form memory
-			bufStart := vm.Stack[vm.StackSize-1].AsU64
-			if int64(bufStart) > CoppervmMemoryCapacity {
-				return ErrorIllegalMemoryAccess(vm)
-			}
-			var fileNameBytes []byte
-			for i := int(bufStart); i < len(vm.Memory); i++ {
-				if vm.Memory[i] != 0 {
-					fileNameBytes = append(fileNameBytes, vm.Memory[i])
-				} else {
-					break
-				}
-			}
-			// Open the file
-			// TODO(#47): Files are opened only in O_RDWR mode
-			fd, err := os.OpenFile(string(fileNameBytes), os.O_RDWR, os.ModePerm)
-			if err != nil {
-				vm.Stack[vm.StackSize-1] = WordI64(-1)
-			} else {
-				vm.FDs = append(vm.FDs, fd)
-				vm.Stack[vm.StackSize-1] = WordI64(int64(len(vm.FDs) - 1))
-			}
-			vm.Ip++
-		case SysCallClose:
-			if vm.StackSize < 1 {
-				return ErrorStackUnderflow(vm)
-			}
-			// Get file descriptor
-			fd := vm.Stack[vm.StackSize-1].AsU64
-			if fd >= uint64(len(vm.FDs)) {
-				vm.Stack[vm.StackSize-1] = WordI64(-1)
-			} else {
-				// Close the file
-				file := vm.FDs[fd]
-				err := file.Close()
-				if err != nil {
-					vm.Stack[vm.StackSize-1] = WordI64(-1)
-				} else {
-					vm.FDs = append(vm.FDs[:fd], vm.FDs[fd+1:]...)
-					vm.Stack[vm.StackSize-1] = WordU64(0)
-				}
-			}
-			vm.Ip++
-		case SysCallSeek:
-			if vm.StackSize < 3 {
-				return ErrorStackUnderflow(vm)
-			}
-			// Get offset and whence
-			whence := vm.Stack[vm.StackSize-1].AsI64
-			offset := vm.Stack[vm.StackSize-2].AsI64
-			// Get file descriptor
-			fd := vm.Stack[vm.StackSize-3].AsU64
-			if fd >= uint64(len(vm.FDs)) {
-				vm.Stack[vm.StackSize-3] = WordI64(-1)
-			} else {
-				// Seek the file
-				file := vm.FDs[fd]
-				newPosition, err := file.Seek(offset, int(whence))
-				if err != nil {
-					vm.Stack[vm.StackSize-3] = WordI64(-1)
-				} else {
-					vm.Stack[vm.StackSize-3] = WordI64(newPosition)
-				}
-			}
-			vm.StackSize -= 2
+		handler, exist := vm.syscalls[sysCall]
+		if !exist {
+			return ErrorUnknownSyscall(vm)
+		}
+		for _, h := range vm.hooks {
+			h.SyscallEnter(vm, sysCall)
+		}
+		err := handler.HandleSyscall(vm)
+		for _, h := range vm.hooks {
+			h.SyscallExit(vm, sysCall, err)
+		}
+		if err != nil {
+			return err
+		}
+		// A blocked system call is executed again later
+		if !vm.Halt && !vm.blocked {
 			vm.Ip++
-		case SysCallExit:
-			if vm.StackSize < 1 {
-				return ErrorStackUnderflow(vm)
-			}
-			statusCode := vm.Stack[vm.StackSize-1]
-			vm.haltVm(int(statusCode.AsI64))
-			vm.StackSize--
-		default:
-			log.Fatalf("Unknown system call %d", sysCall)
 		}
 	// Debug print
 	case InstPrint:
 		if vm.StackSize < 1 {
 			return ErrorStackUnderflow(vm)
 		}
-		fmt.Printf("%s\n", vm.Stack[vm.StackSize-1])
+		fmt.Fprintf(vm.debugOutput, "%s\n", vm.Stack[vm.StackSize-1])
 		vm.StackSize--
 		vm.Ip++
 	case InstCount:
@@ -674,19 +1151,161 @@ func (vm *Coppervm) ExecuteInstruction() *CoppervmError {
 		vm.DumpStack()
 	}
 
-	return ErrorOk(vm)
+	return nil
+}
+
+// Register a hook that observes the execution.
+// Hooks are called in the order they are registered.
+func (vm *Coppervm) AddHook(hook Hook) {
+	vm.hooks = append(vm.hooks, hook)
+}
+
+// Register a system call handler, replacing the existing one
+// if the system call is already registered.
+func (vm *Coppervm) RegisterSyscall(sysCall SysCall, handler SyscallHandler) {
+	if vm.syscalls == nil {
+		vm.syscalls = SyscallTable{}
+	}
+	vm.syscalls[sysCall] = handler
 }
 
 // Push a Word to the stack.
 // Return a ErrorStackOverflow if the stack overflows, or
-// ErrorOk otherwise.
-func (vm *Coppervm) pushStack(w Word) *CoppervmError {
-	if vm.StackSize >= CoppervmStackCapacity {
+// nil otherwise.
+func (vm *Coppervm) pushStack(w Word) error {
+	if vm.StackSize >= int64(len(vm.Stack)) {
 		return ErrorStackOverflow(vm)
 	}
 	vm.Stack[vm.StackSize] = w
 	vm.StackSize++
-	return ErrorOk(vm)
+	return nil
+}
+
+// Push the return address of a function call.
+// The address goes to the call stack, or to the data stack
+// in shared call stack mode.
+func (vm *Coppervm) pushReturnAddress(addr InstAddr) error {
+	if vm.sharedCallStack {
+		return vm.pushStack(WordU64(uint64(addr)))
+	}
+	if vm.CallStackSize >= int64(len(vm.CallStack)) {
+		return ErrorCallStackOverflow(vm)
+	}
+	vm.CallStack[vm.CallStackSize] = addr
+	vm.CallStackSize++
+	return nil
+}
+
+// Pop the return address of the current function.
+func (vm *Coppervm) popReturnAddress() (InstAddr, error) {
+	if vm.sharedCallStack {
+		if vm.StackSize < 1 {
+			return 0, ErrorStackUnderflow(vm)
+		}
+		vm.StackSize--
+		return InstAddr(vm.Stack[vm.StackSize].AsU64), nil
+	}
+	if vm.CallStackSize < 1 {
+		return 0, ErrorCallStackUnderflow(vm)
+	}
+	vm.CallStackSize--
+	return vm.CallStack[vm.CallStackSize], nil
+}
+
+// Returns the backtrace of the current execution.
+// The first frame is the current instruction, followed by the
+// call instructions of the active functions from the innermost
+// to the outermost.
+// In shared call stack mode the return addresses can't be told
+// apart from the data, so only the current instruction is returned.
+func (vm *Coppervm) Backtrace() []BacktraceFrame {
+	frames := []BacktraceFrame{vm.backtraceFrame(vm.Ip)}
+	if vm.sharedCallStack {
+		return frames
+	}
+	for i := vm.CallStackSize - 1; i >= 0; i-- {
+		frames = append(frames, vm.backtraceFrame(vm.CallStack[i]-1))
+	}
+	return frames
+}
+
+func (vm *Coppervm) backtraceFrame(ip InstAddr) BacktraceFrame {
+	frame := BacktraceFrame{Ip: ip, Symbol: vm.debugSymbols.Symbolize(ip)}
+	if loc, ok := vm.lineTable.Lookup(ip); ok {
+		frame.Location = loc.String()
+	}
+	return frame
+}
+
+// Returns true if size bytes starting from addr are
+// all inside the vm memory, false otherwise.
+func (vm *Coppervm) isValidMemoryRange(addr uint64, size uint64) bool {
+	memSize := uint64(len(vm.Memory))
+	return addr < memSize && size <= memSize-addr
+}
+
+// Holds the memory lock if the memory is shared with other vms,
+// so the plain accesses don't race with theirs.
+func (vm *Coppervm) lockSharedMemory() {
+	if vm.sharedMemory {
+		vm.memoryLock.Lock()
+	}
+}
+
+// Releases the lock taken by lockSharedMemory.
+func (vm *Coppervm) unlockSharedMemory() {
+	if vm.sharedMemory {
+		vm.memoryLock.Unlock()
+	}
+}
+
+// Atomically replaces the integer in memory at addr with the one
+// returned by update for the old integer, if update returns true,
+// and returns the old integer.
+// The hooks are called without holding the memory lock, so they
+// can run other vms; the integer is read, the hooks are called
+// and it's written only if it didn't change meanwhile, otherwise
+// the update is retried.
+func (vm *Coppervm) atomicUpdate(addr uint64, update func(old uint64) (uint64, bool)) uint64 {
+	for {
+		vm.memoryLock.Lock()
+		old := binary.BigEndian.Uint64(vm.Memory[addr : addr+8])
+		if len(vm.hooks) == 0 {
+			if value, ok := update(old); ok {
+				binary.BigEndian.PutUint64(vm.Memory[addr:addr+8], value)
+			}
+			vm.memoryLock.Unlock()
+			return old
+		}
+		vm.memoryLock.Unlock()
+
+		vm.hookMemoryRead(addr, 8)
+		value, ok := update(old)
+		if !ok {
+			return old
+		}
+		var buffer [8]byte
+		binary.BigEndian.PutUint64(buffer[:], value)
+		vm.hookMemoryWrite(addr, buffer[:])
+
+		vm.memoryLock.Lock()
+		if binary.BigEndian.Uint64(vm.Memory[addr:addr+8]) == old {
+			copy(vm.Memory[addr:addr+8], buffer[:])
+			vm.memoryLock.Unlock()
+			return old
+		}
+		vm.memoryLock.Unlock()
+	}
+}
+
+// Set the program break to given address.
+// Returns false if the address is outside the heap region.
+func (vm *Coppervm) setMemoryBreak(addr uint64) bool {
+	if addr < vm.heapStart || addr > uint64(len(vm.Memory)) {
+		return false
+	}
+	vm.memoryBreak = addr
+	return true
 }
 
 // Set the virtual machine in an halt state.
@@ -694,42 +1313,96 @@ func (vm *Coppervm) haltVm(code int) {
 	vm.Halt = true
 	vm.ExitCode = code
 	vm.closeFds()
+	for _, h := range vm.hooks {
+		h.Halt(vm, code)
+	}
 }
 
 // Reset the vm to his initial state.
 func (vm *Coppervm) Reset() {
-	copy(vm.Stack[:], []Word{})
+	vm.ensureDefaults()
+	vm.stopThreads()
 	vm.StackSize = 0
+	vm.CallStackSize = 0
+	vm.tryStackSize = 0
 	vm.Ip = vm.initialAddr
-	vm.Memory = vm.initialMemory
+	vm.lockSharedMemory()
+	copy(vm.Memory, vm.initialMemory)
+	vm.unlockSharedMemory()
+	vm.memoryBreak = vm.heapStart
 	vm.closeFds()
+	vm.random.seed(vm.initialSeed)
 	vm.Halt = false
 	vm.ExitCode = 0
+	vm.gas = vm.initialGas
+	vm.traps = nil
+	vm.clearUndoLog()
+}
+
+// Forget the instructions recorded by the undo log,
+// since the state of the vm changed from outside.
+func (vm *Coppervm) clearUndoLog() {
+	if vm.undoLog != nil {
+		vm.undoLog.clear()
+	}
+}
+
+// Returns the open file with given file descriptor.
+// The second return value is false if the file descriptor
+// is not open.
+func (vm *Coppervm) getFile(fd uint64) (File, bool) {
+	if fd >= uint64(len(vm.FDs)) || vm.FDs[fd] == nil {
+		return nil, false
+	}
+	return vm.FDs[fd], true
+}
+
+// Adds an open file to the file descriptors and returns its
+// file descriptor.
+// Like in POSIX the lowest unused file descriptor is chosen,
+// so closing a file never renumbers the other ones.
+func (vm *Coppervm) addFile(file File) int {
+	for i, f := range vm.FDs {
+		if f == nil {
+			vm.FDs[i] = file
+			return i
+		}
+	}
+	vm.FDs = append(vm.FDs, file)
+	return len(vm.FDs) - 1
 }
 
 // Close all open files except for the stdin, stdout, stderr.
 func (vm *Coppervm) closeFds() {
 	for i := 3; i < len(vm.FDs); i++ {
-		vm.FDs[i].Close()
+		if vm.FDs[i] != nil {
+			vm.FDs[i].Close()
+		}
+	}
+	if len(vm.FDs) > 3 {
+		vm.FDs = vm.FDs[:3]
 	}
 }
 
-// Prints the stack content to standard output.
+// Prints the stack content to the debug output.
 func (vm *Coppervm) DumpStack() {
-	fmt.Printf("Stack:\n")
+	fmt.Fprintf(vm.debugOutput, "Stack:\n")
 	if vm.StackSize > 0 {
 		for i := int64(0); i < vm.StackSize; i++ {
-			fmt.Printf("  %s\n", vm.Stack[i])
+			fmt.Fprintf(vm.debugOutput, "  %s\n", vm.Stack[i])
 		}
 	} else {
-		fmt.Printf("  [empty]\n")
+		fmt.Fprintf(vm.debugOutput, "  [empty]\n")
 	}
 }
 
-// Prints the memory content to standard output.
+// Prints the memory content to the debug output.
 func (vm *Coppervm) DumpMemory() {
-	fmt.Println("Memory:")
-	for _, b := range vm.Memory {
-		fmt.Printf("%x ", b)
+	vm.lockSharedMemory()
+	memory := append([]byte{}, vm.Memory...)
+	vm.unlockSharedMemory()
+	fmt.Fprintln(vm.debugOutput, "Memory:")
+	for _, b := range memory {
+		fmt.Fprintf(vm.debugOutput, "%x ", b)
 	}
 }
@@ -1,11 +1,40 @@
 package coppervm
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
+// Runs the program for up to limit instructions on a new vm
+// configured with given options and returns the vm, what it
+// printed and the error.
+func runTestProgram(program []InstDef, limit int, opts ...CoppervmOption) (*Coppervm, string, error) {
+	var output bytes.Buffer
+	vm := NewCoppervm(append([]CoppervmOption{WithDebugOutput(&output)}, opts...)...)
+	vm.loadProgramFromMeta(FileMeta(0, program, []byte{}, DebugSymbols{}))
+	err := vm.ExecuteProgram(limit)
+	return vm, output.String(), err
+}
+
+// Returns the output of print for given words.
+func printedWords(words ...Word) string {
+	var out string
+	for _, w := range words {
+		out += w.String() + "\n"
+	}
+	return out
+}
+
 func TestLoadProgramFromFile(t *testing.T) {
 	tests := []struct {
 		path     string
@@ -14,8 +43,9 @@ func TestLoadProgramFromFile(t *testing.T) {
 		{"testdata/test.notcopper", true},
 		{"testdata/test1.copper", true},
 		{"testdata/test.copper", false},
+		{"testdata/test_binary.copper", false},
 	}
-	vm := Coppervm{}
+	vm := NewCoppervm()
 
 	for _, test := range tests {
 		_, err := vm.LoadProgramFromFile(test.path)
@@ -29,7 +59,7 @@ func TestLoadProgramFromFile(t *testing.T) {
 
 func TestLoadProgramFromMeta(t *testing.T) {
 	func() {
-		vm := Coppervm{}
+		vm := NewCoppervm()
 		meta := FileMeta(2, []InstDef{
 			InstDef{
 				Kind:       InstAddInt,
@@ -63,7 +93,7 @@ func TestLoadProgramFromMeta(t *testing.T) {
 
 	func() {
 		defer func() { recover() }()
-		vm := Coppervm{}
+		vm := NewCoppervm()
 		meta := FileMeta(0,
 			[]InstDef{},
 			make([]byte, CoppervmMemoryCapacity+1),
@@ -74,12 +104,104 @@ func TestLoadProgramFromMeta(t *testing.T) {
 	}()
 }
 
+func TestNewCoppervm(t *testing.T) {
+	vm := NewCoppervm()
+	assert.Len(t, vm.Stack, int(CoppervmStackCapacity))
+	assert.Len(t, vm.Memory, int(CoppervmMemoryCapacity))
+
+	vm = NewCoppervm(WithStackCapacity(16), WithMemoryCapacity(4096))
+	assert.Len(t, vm.Stack, 16)
+	assert.Len(t, vm.Memory, 4096)
+
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{}, make([]byte, 2048), DebugSymbols{}))
+	assert.Len(t, vm.Memory, 4096)
+}
+
+func TestCapacityOptions(t *testing.T) {
+	// The invalid capacities keep the defaults
+	vm := NewCoppervm(
+		WithStackCapacity(0),
+		WithCallStackCapacity(-1),
+		WithTryStackCapacity(-1),
+		WithMemoryCapacity(-1))
+	assert.Len(t, vm.Stack, int(CoppervmStackCapacity))
+	assert.Len(t, vm.CallStack, int(CoppervmCallStackCapacity))
+	assert.Len(t, vm.tryStack, int(CoppervmTryStackCapacity))
+	assert.Len(t, vm.Memory, int(CoppervmMemoryCapacity))
+
+	vm = NewCoppervm(WithCallStackCapacity(0), WithMemoryCapacity(0))
+	assert.Len(t, vm.CallStack, 0)
+	assert.Len(t, vm.Memory, 0)
+}
+
+func TestZeroCoppervm(t *testing.T) {
+	// The unset fields of a literal get the defaults
+	vm := &Coppervm{
+		Stack:   make([]Word, 4),
+		Program: []InstDef{{Kind: InstPush, Operand: WordU64(3)}, {Kind: InstDup}, {Kind: InstHalt}},
+	}
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	assert.True(t, vm.Halt)
+	assert.Equal(t, []Word{WordU64(3), WordU64(3)}, vm.Stack[:vm.StackSize])
+	assert.Len(t, vm.Stack, 4)
+	assert.Len(t, vm.Memory, int(CoppervmMemoryCapacity))
+
+	var output bytes.Buffer
+	vm = &Coppervm{}
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstMemRead},
+		{Kind: InstPrint},
+		{Kind: InstHalt},
+	}, []byte{7}, DebugSymbols{}))
+	vm.debugOutput = &output
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	assert.Equal(t, printedWords(WordU64(7)), output.String())
+}
+
+func TestStdStreams(t *testing.T) {
+	stdin := strings.NewReader("ok")
+	var stdout, stderr, debug bytes.Buffer
+	vm := NewCoppervm(
+		WithStdin(stdin),
+		WithStdout(&stdout),
+		WithStderr(&stderr),
+		WithDebugOutput(&debug),
+	)
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstPush, Operand: WordU64(4)},
+		{Kind: InstPush, Operand: WordU64(2)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallRead))},
+		{Kind: InstPush, Operand: WordU64(1)},
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstPush, Operand: WordU64(6)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallWrite))},
+		{Kind: InstPush, Operand: WordU64(2)},
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstPush, Operand: WordU64(4)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallWrite))},
+		{Kind: InstPrint},
+		{Kind: InstHalt},
+	}, []byte("err:"), DebugSymbols{}))
+	assert.Len(t, vm.FDs, 3)
+
+	err := vm.ExecuteProgram(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, "err:ok", stdout.String())
+	assert.Equal(t, "err:", stderr.String())
+	assert.Equal(t, WordU64(4).String()+"\n", debug.String())
+
+	vm.Reset()
+	assert.Len(t, vm.FDs, 3)
+}
+
 var instructionsTests = []struct {
 	prog       []InstDef
 	stack      []Word
 	memory     []byte
 	additional func(t assert.TestingT, vm Coppervm)
-	err        CoppervmErrorKind
+	err        error
 }{
 	// noop
 	{
@@ -89,7 +211,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(1), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	// push
 	{
@@ -100,7 +222,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordU64(1), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstPush, Operand: WordU64(1)}},
@@ -118,7 +240,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, WordU64(2), vm.Stack[0])
 			assert.Equal(t, WordU64(1), vm.Stack[1])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstSwap, Operand: WordU64(1)}},
@@ -136,7 +258,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(2), vm.StackSize)
 			assert.Equal(t, vm.Stack[0], vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstDup}},
@@ -160,7 +282,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, int64(0), vm.StackSize)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstDrop}},
@@ -178,7 +300,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordU64(2), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstAddInt}},
@@ -196,7 +318,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordU64(0), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstSubInt}},
@@ -214,7 +336,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordU64(6), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMulInt}},
@@ -232,7 +354,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordI64(-2), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMulIntSigned}},
@@ -250,7 +372,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordU64(2), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstDivInt}},
@@ -275,7 +397,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordI64(-2), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstDivIntSigned}},
@@ -301,7 +423,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, WordU64(2).AsU64, vm.Stack[0].AsU64)
 			assert.Equal(t, WordU64(2).AsI64, vm.Stack[0].AsI64)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstModInt}},
@@ -326,7 +448,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordI64(-2).AsI64, vm.Stack[0].AsI64)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstModIntSigned}},
@@ -351,7 +473,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordF64(2.0), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstAddFloat}},
@@ -369,7 +491,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordF64(0.0), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstSubFloat}},
@@ -387,7 +509,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordF64(6.0), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMulFloat}},
@@ -405,7 +527,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordF64(0.5), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstDivFloat}},
@@ -430,7 +552,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, WordI64(-1), vm.Stack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstCmp}},
@@ -447,7 +569,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(5), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	// jmp zero
 	{
@@ -457,7 +579,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(5), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpZero, Operand: WordU64(5)}},
@@ -466,7 +588,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(1), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpZero}},
@@ -483,7 +605,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(5), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpNotZero, Operand: WordU64(5)}},
@@ -492,7 +614,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(1), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpNotZero}},
@@ -509,7 +631,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(5), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpGreater, Operand: WordU64(5)}},
@@ -518,7 +640,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(1), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpGreater}},
@@ -535,7 +657,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(5), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpLess, Operand: WordU64(5)}},
@@ -544,7 +666,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(1), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpLess}},
@@ -561,7 +683,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(5), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpGreaterEqual, Operand: WordU64(5)}},
@@ -570,7 +692,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(1), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpGreaterEqual}},
@@ -587,7 +709,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(5), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpLessEqual, Operand: WordU64(5)}},
@@ -596,7 +718,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(1), vm.Ip)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstJmpLessEqual}},
@@ -612,30 +734,73 @@ var instructionsTests = []struct {
 		[]byte{},
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, InstAddr(5), vm.Ip)
+			assert.Equal(t, int64(0), vm.StackSize)
+			assert.Equal(t, int64(1), vm.CallStackSize)
+			assert.Equal(t, InstAddr(1), vm.CallStack[0])
+		},
+		nil,
+	},
+	// ret
+	{
+		[]InstDef{{Kind: InstFunReturn}},
+		[]Word{WordU64(5)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, int64(1), vm.StackSize)
 		},
-		ErrorKindOk,
+		ErrorKindCallStackUnderflow,
 	},
+	// ijmp
 	{
-		[]InstDef{{Kind: InstFunCall}},
-		make([]Word, CoppervmStackCapacity),
+		[]InstDef{{Kind: InstJmpIndirect}, {Kind: InstNoop}, {Kind: InstHalt}},
+		[]Word{WordU64(2)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, InstAddr(2), vm.Ip)
+			assert.Equal(t, int64(0), vm.StackSize)
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstJmpIndirect}},
+		[]Word{WordU64(1)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, InstAddr(0), vm.Ip)
+		},
+		ErrorKindIllegalInstAccess,
+	},
+	{
+		[]InstDef{{Kind: InstJmpIndirect}},
+		[]Word{},
 		[]byte{},
 		func(t assert.TestingT, vm Coppervm) {},
-		ErrorKindStackOverflow,
+		ErrorKindStackUnderflow,
 	},
-	// ret
+	// icall
 	{
-		[]InstDef{{Kind: InstFunReturn}},
-		[]Word{WordU64(5)},
+		[]InstDef{{Kind: InstFunCallIndirect}, {Kind: InstNoop}, {Kind: InstHalt}},
+		[]Word{WordU64(2)},
 		[]byte{},
 		func(t assert.TestingT, vm Coppervm) {
-			assert.Equal(t, InstAddr(5), vm.Ip)
+			assert.Equal(t, InstAddr(2), vm.Ip)
 			assert.Equal(t, int64(0), vm.StackSize)
+			assert.Equal(t, int64(1), vm.CallStackSize)
+			assert.Equal(t, InstAddr(1), vm.CallStack[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
-		[]InstDef{{Kind: InstFunReturn}},
+		[]InstDef{{Kind: InstFunCallIndirect}},
+		[]Word{WordI64(-1)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, InstAddr(0), vm.Ip)
+		},
+		ErrorKindIllegalInstAccess,
+	},
+	{
+		[]InstDef{{Kind: InstFunCallIndirect}},
 		[]Word{},
 		[]byte{},
 		func(t assert.TestingT, vm Coppervm) {},
@@ -650,7 +815,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, uint64(0x22), vm.Stack[0].AsU64)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMemRead}},
@@ -675,7 +840,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, int64(5), vm.Stack[0].AsI64)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMemReadInt}},
@@ -684,6 +849,13 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {},
 		ErrorKindIllegalMemoryAccess,
 	},
+	{
+		[]InstDef{{Kind: InstMemReadInt}},
+		[]Word{WordU64(uint64(CoppervmMemoryCapacity - 4))},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindIllegalMemoryAccess,
+	},
 	{
 		[]InstDef{{Kind: InstMemReadInt}},
 		[]Word{},
@@ -700,7 +872,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(1), vm.StackSize)
 			assert.Equal(t, float64(2.3), vm.Stack[0].AsF64)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMemReadFloat}},
@@ -725,7 +897,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, int64(0), vm.StackSize)
 			assert.Equal(t, byte(0x22), vm.Memory[0])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMemWrite}},
@@ -757,7 +929,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, byte(0x0), vm.Memory[6])
 			assert.Equal(t, byte(0x5), vm.Memory[7])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMemWriteInt}},
@@ -766,6 +938,13 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {},
 		ErrorKindIllegalMemoryAccess,
 	},
+	{
+		[]InstDef{{Kind: InstMemWriteInt}},
+		[]Word{WordU64(0), WordU64(uint64(CoppervmMemoryCapacity - 4))},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindIllegalMemoryAccess,
+	},
 	{
 		[]InstDef{{Kind: InstMemWriteInt}},
 		[]Word{},
@@ -789,7 +968,7 @@ var instructionsTests = []struct {
 			assert.Equal(t, byte(0x66), vm.Memory[6])
 			assert.Equal(t, byte(0x66), vm.Memory[7])
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstMemWriteFloat}},
@@ -805,7 +984,187 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {},
 		ErrorKindStackUnderflow,
 	},
+	// mem aread
+	{
+		[]InstDef{{Kind: InstMemReadAtomic}},
+		[]Word{WordU64(0)},
+		[]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, int64(1), vm.StackSize)
+			assert.Equal(t, int64(5), vm.Stack[0].AsI64)
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstMemReadAtomic}},
+		[]Word{WordU64(uint64(CoppervmMemoryCapacity - 4))},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindIllegalMemoryAccess,
+	},
+	{
+		[]InstDef{{Kind: InstMemReadAtomic}},
+		[]Word{},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindStackUnderflow,
+	},
+	// mem awrite
+	{
+		[]InstDef{{Kind: InstMemWriteAtomic}},
+		[]Word{WordU64(5), WordU64(0)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, int64(0), vm.StackSize)
+			assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 5}, vm.Memory[0:8])
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstMemWriteAtomic}},
+		[]Word{WordU64(0), WordU64(uint64(CoppervmMemoryCapacity - 4))},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindIllegalMemoryAccess,
+	},
+	{
+		[]InstDef{{Kind: InstMemWriteAtomic}},
+		[]Word{WordU64(0)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindStackUnderflow,
+	},
+	// mem cas
+	{
+		[]InstDef{{Kind: InstMemCompareSwap}},
+		[]Word{WordU64(5), WordU64(7), WordU64(0)},
+		[]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, int64(1), vm.StackSize)
+			assert.Equal(t, int64(5), vm.Stack[0].AsI64)
+			assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 7}, vm.Memory[0:8])
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstMemCompareSwap}},
+		[]Word{WordU64(4), WordU64(7), WordU64(0)},
+		[]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, int64(1), vm.StackSize)
+			assert.Equal(t, int64(5), vm.Stack[0].AsI64)
+			assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 5}, vm.Memory[0:8])
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstMemCompareSwap}},
+		[]Word{WordU64(0), WordU64(7), WordU64(uint64(CoppervmMemoryCapacity))},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindIllegalMemoryAccess,
+	},
+	{
+		[]InstDef{{Kind: InstMemCompareSwap}},
+		[]Word{WordU64(7), WordU64(0)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindStackUnderflow,
+	},
+	// mem xadd
+	{
+		[]InstDef{{Kind: InstMemFetchAdd}},
+		[]Word{WordI64(-2), WordU64(0)},
+		[]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, int64(1), vm.StackSize)
+			assert.Equal(t, int64(5), vm.Stack[0].AsI64)
+			assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 3}, vm.Memory[0:8])
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstMemFetchAdd}},
+		[]Word{WordU64(1), WordU64(uint64(CoppervmMemoryCapacity))},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindIllegalMemoryAccess,
+	},
+	{
+		[]InstDef{{Kind: InstMemFetchAdd}},
+		[]Word{WordU64(0)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindStackUnderflow,
+	},
 	// TODO: Test syscalls
+	// syscall brk
+	{
+		[]InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(SysCallBrk))}},
+		[]Word{WordU64(0)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, int64(1), vm.StackSize)
+			assert.Equal(t, WordU64(0), vm.Stack[0])
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(SysCallBrk))}},
+		[]Word{WordU64(16)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, WordU64(16), vm.Stack[0])
+			assert.Equal(t, uint64(16), vm.memoryBreak)
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(SysCallBrk))}},
+		[]Word{WordU64(uint64(CoppervmMemoryCapacity + 1))},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, WordI64(-1), vm.Stack[0])
+			assert.Equal(t, uint64(0), vm.memoryBreak)
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(SysCallBrk))}},
+		[]Word{},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindStackUnderflow,
+	},
+	// syscall sbrk
+	{
+		[]InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(SysCallSbrk))}},
+		[]Word{WordI64(8)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, int64(1), vm.StackSize)
+			assert.Equal(t, WordU64(0), vm.Stack[0])
+			assert.Equal(t, uint64(8), vm.memoryBreak)
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(SysCallSbrk))}},
+		[]Word{WordI64(-8)},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {
+			assert.Equal(t, WordI64(-1), vm.Stack[0])
+			assert.Equal(t, uint64(0), vm.memoryBreak)
+		},
+		nil,
+	},
+	{
+		[]InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(SysCallSbrk))}},
+		[]Word{},
+		[]byte{},
+		func(t assert.TestingT, vm Coppervm) {},
+		ErrorKindStackUnderflow,
+	},
 	// print
 	{
 		[]InstDef{{Kind: InstPrint}},
@@ -814,7 +1173,7 @@ var instructionsTests = []struct {
 		func(t assert.TestingT, vm Coppervm) {
 			assert.Equal(t, int64(0), vm.StackSize)
 		},
-		ErrorKindOk,
+		nil,
 	},
 	{
 		[]InstDef{{Kind: InstPrint}},
@@ -836,39 +1195,407 @@ var instructionsTests = []struct {
 func TestExecuteInstruction(t *testing.T) {
 
 	for _, test := range instructionsTests {
-		vm := Coppervm{}
+		vm := NewCoppervm(WithDebugOutput(ioutil.Discard))
 		vm.Program = test.prog
-		copy(vm.Stack[:], test.stack)
-		copy(vm.Memory[:], test.memory)
+		copy(vm.Stack, test.stack)
+		copy(vm.Memory, test.memory)
 		vm.StackSize = int64(len(test.stack))
 
 		err := vm.ExecuteInstruction()
 
-		assert.Equal(t, test.err, err.Kind)
-		test.additional(t, vm)
+		if test.err == nil {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, test.err)
+		}
+		test.additional(t, *vm)
+	}
+}
+
+func TestExecuteProgramContext(t *testing.T) {
+	loop := []InstDef{
+		{Kind: InstNoop, Name: "noop"},
+		{Kind: InstJmp, Name: "jmp", Operand: WordU64(0)},
 	}
+
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, loop, []byte{}, DebugSymbols{}))
+	assert.NoError(t, vm.ExecuteProgramContext(context.Background(), 10))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := vm.ExecuteProgramContext(ctx, -1)
+	assert.ErrorIs(t, err, ErrorKindCanceled)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Contains(t, err.Error(), context.DeadlineExceeded.Error())
+
+	// Nothing is executed with a canceled context
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	vm.Reset()
+	err = vm.ExecuteProgramContext(ctx, -1)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, InstAddr(0), vm.Ip)
+}
+
+func TestExecuteProgramContextBlocked(t *testing.T) {
+	syscall := func(sysCall SysCall) InstDef {
+		return InstDef{Kind: InstSyscall, Name: "syscall", Operand: WordU64(uint64(sysCall))}
+	}
+
+	// Read from the standard input
+	stdin, input := io.Pipe()
+	vm := NewCoppervm(WithStdin(stdin), WithMemoryCapacity(4))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		{Kind: InstPush, Name: "push", Operand: WordU64(4)},
+		syscall(SysCallRead),
+		{Kind: InstHalt, Name: "halt"},
+	}, []byte{}, DebugSymbols{}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := vm.ExecuteProgramContext(ctx, -1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, InstAddr(3), vm.Ip)
+	assert.Equal(t, int64(3), vm.StackSize)
+
+	// The input that arrives later is not lost
+	go input.Write([]byte("ab"))
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	assert.Equal(t, "ab", string(vm.Memory[:2]))
+	assert.Equal(t, WordU64(2), vm.Stack[0])
+
+	// Sleep with the system clock
+	vm = NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordI64(int64(time.Hour))},
+		syscall(SysCallSleep),
+	}, []byte{}, DebugSymbols{}))
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err = vm.ExecuteProgramContext(ctx, -1)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.Equal(t, InstAddr(1), vm.Ip)
+}
+
+func TestInterruptibleReader(t *testing.T) {
+	r := newInterruptibleReader(strings.NewReader("abcdef"))
+	buf := make([]byte, 2)
+	n, err := r.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "ab", string(buf[:n]))
+
+	// With a context the read happens in the background
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	buf = make([]byte, 3)
+	n, err = r.ReadContext(ctx, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "cde", string(buf[:n]))
+
+	// Seeking accounts for the data not returned yet
+	r.buf = []byte("e")
+	offset, err := r.Seek(0, io.SeekCurrent)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), offset)
+	data, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.Equal(t, "ef", string(data))
+}
+
+func TestCallStack(t *testing.T) {
+	program := []InstDef{
+		{Kind: InstPush, Operand: WordU64(3)},
+		{Kind: InstFunCall, Operand: WordU64(3)},
+		{Kind: InstHalt},
+		{Kind: InstPush, Operand: WordU64(4)},
+		{Kind: InstAddInt},
+		{Kind: InstFunReturn},
+	}
+
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, program, []byte{}, DebugSymbols{}))
+	err := vm.ExecuteProgram(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), vm.StackSize)
+	assert.Equal(t, WordU64(7), vm.Stack[0])
+	assert.Equal(t, int64(0), vm.CallStackSize)
+
+	// Files before the call stack keep using the data stack,
+	// so the callee has to move the return address away
+	shared := []InstDef{
+		{Kind: InstPush, Operand: WordU64(3)},
+		{Kind: InstFunCall, Operand: WordU64(3)},
+		{Kind: InstHalt},
+		{Kind: InstSwap, Operand: WordU64(1)},
+		{Kind: InstPush, Operand: WordU64(4)},
+		{Kind: InstAddInt},
+		{Kind: InstSwap, Operand: WordU64(1)},
+		{Kind: InstFunReturn},
+	}
+	oldMeta := FileMeta(0, shared, []byte{}, DebugSymbols{})
+	oldMeta.Version = CoppervmSharedStackFileVersion
+	tests := []struct {
+		vm   *Coppervm
+		meta CoppervmFileMeta
+	}{
+		{NewCoppervm(), oldMeta},
+		{NewCoppervm(WithSharedCallStack()), FileMeta(0, shared, []byte{}, DebugSymbols{})},
+	}
+	for _, test := range tests {
+		vm := test.vm
+		vm.loadProgramFromMeta(test.meta)
+		err := vm.ExecuteProgram(-1)
+		assert.NoError(t, err)
+		assert.Equal(t, int64(1), vm.StackSize)
+		assert.Equal(t, WordU64(7), vm.Stack[0])
+		assert.Equal(t, int64(0), vm.CallStackSize)
+	}
+
+	// Recursion without end overflows the call stack
+	vm = NewCoppervm(WithCallStackCapacity(4))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstFunCall, Operand: WordU64(0)},
+	}, []byte{}, DebugSymbols{}))
+	err = vm.ExecuteProgram(-1)
+	assert.ErrorIs(t, err, ErrorKindCallStackOverflow)
+	assert.Equal(t, int64(4), vm.CallStackSize)
+	assert.Equal(t, int64(0), vm.StackSize)
+}
+
+func TestBacktrace(t *testing.T) {
+	program := []InstDef{
+		{Kind: InstFunCall, Operand: WordU64(2)},
+		{Kind: InstHalt},
+		{Kind: InstNoop},
+		{Kind: InstFunCall, Operand: WordU64(5)},
+		{Kind: InstFunReturn},
+		{Kind: InstPush, Operand: WordU64(1)},
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstDivInt, Name: "div"},
+	}
+	symbols := DebugSymbols{
+		{Name: "main", Address: 0},
+		{Name: "f", Address: 2},
+		{Name: "g", Address: 5},
+	}
+
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, program, []byte{}, symbols))
+	var err *CoppervmError
+	assert.True(t, errors.As(vm.ExecuteProgram(-1), &err))
+	assert.ErrorIs(t, err, ErrorKindDivideByZero)
+	assert.Equal(t, []BacktraceFrame{
+		{Ip: 7, Symbol: "g+2"},
+		{Ip: 3, Symbol: "f+1"},
+		{Ip: 0, Symbol: "main"},
+	}, err.Backtrace)
+	assert.Equal(t, "'ErrorDivideByZero' executing instruction 'div' at ip '7'\n"+
+		"    at ip 7 (g+2)\n"+
+		"    at ip 3 (f+1)\n"+
+		"    at ip 0 (main)", err.Error())
+
+	// Without debug symbols the frames have only the address
+	vm.loadProgramFromMeta(FileMeta(0, program, []byte{}, DebugSymbols{}))
+	assert.True(t, errors.As(vm.ExecuteProgram(-1), &err))
+	assert.Equal(t, []BacktraceFrame{{Ip: 7}, {Ip: 3}, {Ip: 0}}, err.Backtrace)
+
+	// With the line table the frames have the source location
+	meta := FileMeta(0, program, []byte{}, symbols)
+	meta.LineTable = LineTable{
+		{Address: 0, File: "main.casm", Row: 2, Col: 5},
+		{Address: 3, File: "main.casm", Row: 7, Col: 5},
+		{Address: 7, File: "lib.casm", Row: 4, Col: 5},
+	}
+	vm.loadProgramFromMeta(meta)
+	assert.True(t, errors.As(vm.ExecuteProgram(-1), &err))
+	assert.Equal(t, "'ErrorDivideByZero' executing instruction 'div' at ip '7'\n"+
+		"    at ip 7 (g+2) in lib.casm:4:5\n"+
+		"    at ip 3 (f+1) in main.casm:7:5\n"+
+		"    at ip 0 (main) in main.casm:2:5", err.Error())
+
+	// Jumping outside the program doesn't crash the error
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstJmp, Operand: WordU64(10)},
+	}, []byte{}, DebugSymbols{}))
+	assert.True(t, errors.As(vm.ExecuteProgram(-1), &err))
+	assert.ErrorIs(t, err, ErrorKindIllegalInstAccess)
+	assert.Equal(t, InstAddr(10), err.CurrentIp)
+}
+
+func TestCoppervmError(t *testing.T) {
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Operand: WordU64(7)},
+		{Kind: InstPush, Operand: WordU64(4096)},
+		{Kind: InstMemReadInt, Name: "iread"},
+	}, []byte{}, DebugSymbols{}))
+	err := vm.ExecuteProgram(-1)
+
+	assert.ErrorIs(t, err, ErrorKindIllegalMemoryAccess)
+	assert.False(t, errors.Is(err, ErrorKindStackUnderflow))
+	var vmErr *CoppervmError
+	assert.True(t, errors.As(err, &vmErr))
+	assert.Equal(t, InstAddr(2), vmErr.CurrentIp)
+	assert.Equal(t, uint64(4096), vmErr.MemoryAddress)
+	assert.Equal(t, []Word{WordU64(7), WordU64(4096)}, vmErr.Stack)
+	assert.Equal(t, "'ErrorIllegalMemoryAccess' executing instruction 'iread' at ip '2' "+
+		"accessing address '4096'\n    at ip 2", err.Error())
+
+	// The snapshot doesn't change with the vm
+	vm.Stack[0] = WordU64(0)
+	assert.Equal(t, WordU64(7), vmErr.Stack[0])
+
+	// The wrapped errors keep their kind
+	wrapped := fmt.Errorf("running program: %w", err)
+	assert.ErrorIs(t, wrapped, ErrorKindIllegalMemoryAccess)
 }
 
 func TestPushStack(t *testing.T) {
-	vm := Coppervm{Program: []InstDef{{}}}
+	vm := NewCoppervm()
+	vm.Program = []InstDef{{}}
 	err := vm.pushStack(WordU64(1))
-	assert.Equal(t, ErrorKindOk, err.Kind)
+	assert.NoError(t, err)
 
 	vm.StackSize = CoppervmStackCapacity + 1
 	err = vm.pushStack(WordU64(1))
-	assert.Equal(t, ErrorKindStackOverflow, err.Kind)
+	assert.ErrorIs(t, err, ErrorKindStackOverflow)
 }
 
 func TestReset(t *testing.T) {
-	vm := Coppervm{}
+	vm := NewCoppervm()
 	vm.LoadProgramFromFile("testdata/test.copper")
 	res := vm.ExecuteProgram(-1)
 
-	assert.Equal(t, ErrorKindOk, res.Kind)
+	assert.NoError(t, res)
 	assert.NotZero(t, vm.Ip)
 	assert.NotZero(t, vm.StackSize)
 
 	vm.Reset()
 	assert.Zero(t, vm.Ip)
 	assert.Zero(t, vm.StackSize)
+	assert.Zero(t, vm.CallStackSize)
+}
+
+func TestInstKindString(t *testing.T) {
+	assert.Equal(t, "push", InstPush.String())
+	assert.Equal(t, "throw", InstThrow.String())
+	assert.Equal(t, "InstKind(-1)", InstKind(-1).String())
+	assert.Equal(t, fmt.Sprintf("InstKind(%d)", InstCount), InstCount.String())
+}
+
+// Program adding 1 to the word at address 0 count times.
+func xaddProgram(count int) []InstDef {
+	var program []InstDef
+	for i := 0; i < count; i++ {
+		program = append(program,
+			InstDef{Kind: InstPush, Operand: WordU64(1)},
+			InstDef{Kind: InstPush, Operand: WordU64(0)},
+			InstDef{Kind: InstMemFetchAdd},
+			InstDef{Kind: InstDrop})
+	}
+	return append(program, InstDef{Kind: InstHalt})
+}
+
+func TestSharedMemory(t *testing.T) {
+	memory := make([]byte, 8)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		vm := NewCoppervm(WithSharedMemory(memory, &lock))
+		vm.loadProgramFromMeta(FileMeta(0, xaddProgram(500), []byte{}, DebugSymbols{}))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, vm.ExecuteProgram(-1))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0x07, 0xd0}, memory)
+}
+
+// Program writing and reading the integer at 8 with the plain
+// instructions and writing it to the standard output, while it
+// adds 1 to the integer at 0 atomically, count times.
+func sharedMemoryProgram(id uint64, count int) []InstDef {
+	var program []InstDef
+	for i := 0; i < count; i++ {
+		program = append(program,
+			InstDef{Kind: InstPush, Operand: WordU64(id)},
+			InstDef{Kind: InstPush, Operand: WordU64(8)},
+			InstDef{Kind: InstMemWriteInt},
+			InstDef{Kind: InstPush, Operand: WordU64(8)},
+			InstDef{Kind: InstMemReadInt},
+			InstDef{Kind: InstDrop},
+			InstDef{Kind: InstPush, Operand: WordU64(1)},
+			InstDef{Kind: InstPush, Operand: WordU64(8)},
+			InstDef{Kind: InstPush, Operand: WordU64(8)},
+			InstDef{Kind: InstSyscall, Operand: WordU64(uint64(SysCallWrite))},
+			InstDef{Kind: InstDrop},
+			InstDef{Kind: InstPush, Operand: WordU64(1)},
+			InstDef{Kind: InstPush, Operand: WordU64(0)},
+			InstDef{Kind: InstMemFetchAdd},
+			InstDef{Kind: InstDrop})
+	}
+	return append(program, InstDef{Kind: InstHalt})
+}
+
+func TestSharedMemoryPlainAccess(t *testing.T) {
+	// Run with -race: the plain accesses hold the lock too
+	memory := make([]byte, 16)
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	outputs := make([]bytes.Buffer, 4)
+	for i := range outputs {
+		vm := NewCoppervm(WithSharedMemory(memory, &lock), WithStdout(&outputs[i]))
+		vm.loadProgramFromMeta(FileMeta(0, sharedMemoryProgram(uint64(i+1), 200), []byte{}, DebugSymbols{}))
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, vm.ExecuteProgram(-1))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0x03, 0x20}, memory[:8])
+	for i := range outputs {
+		assert.Equal(t, 8*200, outputs[i].Len())
+		// Every integer written is one of the ids, never a mix
+		for out := outputs[i].Bytes(); len(out) > 0; out = out[8:] {
+			assert.Contains(t, []byte{1, 2, 3, 4}, out[7])
+			assert.Equal(t, make([]byte, 7), out[:7])
+		}
+	}
+}
+
+// Hook running another vm when the memory is read.
+type runVmHook struct {
+	NoopHook
+	other *Coppervm
+}
+
+func (h *runVmHook) MemoryRead(vm *Coppervm, addr uint64, size uint64) {
+	h.other.ExecuteProgram(-1)
+}
+
+func TestAtomicHooks(t *testing.T) {
+	// The other vm changes the word between the read and the
+	// write of the first, that retries the update
+	memory := make([]byte, 8)
+	var lock sync.Mutex
+	other := NewCoppervm(WithSharedMemory(memory, &lock))
+	other.loadProgramFromMeta(FileMeta(0, xaddProgram(1), []byte{}, DebugSymbols{}))
+	vm := NewCoppervm(WithSharedMemory(memory, &lock), WithHook(&runVmHook{other: other}))
+	vm.loadProgramFromMeta(FileMeta(0, xaddProgram(1), []byte{}, DebugSymbols{}))
+	vm.EnableUndoLog(10)
+
+	assert.NoError(t, vm.ExecuteProgram(3))
+	assert.True(t, other.Halt)
+	assert.Equal(t, []Word{WordU64(1)}, vm.Stack[:vm.StackSize])
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 2}, memory)
+
+	// The undo log has the memory before the update
+	_, ok := vm.StepBack()
+	assert.True(t, ok)
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 1}, memory)
 }
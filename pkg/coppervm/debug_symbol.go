@@ -1,5 +1,7 @@
 package coppervm
 
+import "fmt"
+
 type DebugSymbol struct {
 	Name    string
 	Address InstAddr
@@ -17,3 +19,23 @@ func (ds DebugSymbols) GetIndexByName(name string) int {
 	}
 	return -1
 }
+
+// Returns the name of the nearest symbol at or before given
+// address, followed by the offset from it when it's not zero
+// (e.g. "loop+2").
+// Returns an empty string if no symbol comes before the address.
+func (ds DebugSymbols) Symbolize(addr InstAddr) string {
+	best := -1
+	for i, s := range ds {
+		if s.Address <= addr && (best < 0 || s.Address > ds[best].Address) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return ""
+	}
+	if offset := addr - ds[best].Address; offset != 0 {
+		return fmt.Sprintf("%s+%d", ds[best].Name, offset)
+	}
+	return ds[best].Name
+}
@@ -26,3 +26,26 @@ func TestGetIndexByName(t *testing.T) {
 		assert.Equal(t, test.expect, ds.GetIndexByName(test.name))
 	}
 }
+
+func TestSymbolize(t *testing.T) {
+	ds := DebugSymbols{
+		DebugSymbol{Name: "loop", Address: InstAddr(4)},
+		DebugSymbol{Name: "main", Address: InstAddr(2)},
+		DebugSymbol{Name: "end", Address: InstAddr(9)},
+	}
+	tests := []struct {
+		addr   InstAddr
+		expect string
+	}{
+		{0, ""},
+		{2, "main"},
+		{3, "main+1"},
+		{4, "loop"},
+		{8, "loop+4"},
+		{12, "end+3"},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expect, ds.Symbolize(test.addr))
+	}
+}
@@ -1,92 +1,225 @@
 package coppervm
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
+// Error returned when the execution of a program fails.
+// Use errors.Is with a CoppervmErrorKind to check the kind of
+// the error, or errors.As to get the context of the failure.
 type CoppervmError struct {
 	Kind        CoppervmErrorKind
 	CurrentIp   InstAddr
 	CurrentInst InstDef
+	Backtrace   []BacktraceFrame
+	// Content of the stack when the error happened
+	Stack []Word
+	// Address that caused an ErrorKindIllegalMemoryAccess
+	MemoryAddress uint64
+	// Word thrown without a try frame that caused an
+	// ErrorKindUncaughtException
+	Exception Word
+	// Error of the context that caused an ErrorKindCanceled
+	cause error
 }
 
-func ErrorOk(vm *Coppervm) *CoppervmError {
-	return &CoppervmError{Kind: ErrorKindOk}
+// A frame of the backtrace of an error.
+// Symbol is the nearest label before Ip and Location is the
+// source position of Ip ("file:row:col"); both are empty if the
+// program has no debug symbols.
+type BacktraceFrame struct {
+	Ip       InstAddr
+	Symbol   string
+	Location string
 }
 
-func ErrorIllegalInstAccess(vm *Coppervm) *CoppervmError {
-	return &CoppervmError{
-		Kind:        ErrorKindIllegalInstAccess,
-		CurrentIp:   vm.Ip,
-		CurrentInst: vm.Program[vm.Ip],
+// Create an error of given kind at the current ip of the vm.
+func newError(vm *Coppervm, kind CoppervmErrorKind) *CoppervmError {
+	err := &CoppervmError{
+		Kind:      kind,
+		CurrentIp: vm.Ip,
+	}
+	// The ip is outside the program after a jump to an illegal address
+	if vm.Ip < InstAddr(len(vm.Program)) {
+		err.CurrentInst = vm.Program[vm.Ip]
+	}
+	// The faults caught by a trap handler are thrown away, so
+	// the backtrace and the stack are not needed
+	if _, ok := vm.catchingTrapHandler(kind); !ok {
+		err.addContext(vm)
 	}
+	return err
 }
 
-func ErrorStackOverflow(vm *Coppervm) *CoppervmError {
-	return &CoppervmError{
-		Kind:        ErrorKindStackOverflow,
-		CurrentIp:   vm.Ip,
-		CurrentInst: vm.Program[vm.Ip],
+// Add the backtrace and the content of the stack of the vm.
+func (err *CoppervmError) addContext(vm *Coppervm) {
+	err.Backtrace = vm.Backtrace()
+	if vm.StackSize <= int64(len(vm.Stack)) {
+		err.Stack = append([]Word{}, vm.Stack[:vm.StackSize]...)
 	}
 }
 
+func ErrorIllegalInstAccess(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindIllegalInstAccess)
+}
+
+func ErrorStackOverflow(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindStackOverflow)
+}
+
 func ErrorStackUnderflow(vm *Coppervm) *CoppervmError {
-	return &CoppervmError{
-		Kind:        ErrorKindStackUnderflow,
-		CurrentIp:   vm.Ip,
-		CurrentInst: vm.Program[vm.Ip],
-	}
+	return newError(vm, ErrorKindStackUnderflow)
 }
 
 func ErrorDivideByZero(vm *Coppervm) *CoppervmError {
-	return &CoppervmError{
-		Kind:        ErrorKindDivideByZero,
-		CurrentIp:   vm.Ip,
-		CurrentInst: vm.Program[vm.Ip],
-	}
+	return newError(vm, ErrorKindDivideByZero)
 }
 
-func ErrorIllegalMemoryAccess(vm *Coppervm) *CoppervmError {
-	return &CoppervmError{
-		Kind:        ErrorKindIllegalMemoryAccess,
-		CurrentIp:   vm.Ip,
-		CurrentInst: vm.Program[vm.Ip],
-	}
+func ErrorIllegalMemoryAccess(vm *Coppervm, addr uint64) *CoppervmError {
+	err := newError(vm, ErrorKindIllegalMemoryAccess)
+	err.MemoryAddress = addr
+	return err
 }
 
 func ErrorInvalidInstruction(vm *Coppervm) *CoppervmError {
-	return &CoppervmError{
-		Kind:        ErrorKindInvalidInstruction,
-		CurrentIp:   vm.Ip,
-		CurrentInst: vm.Program[vm.Ip],
-	}
+	return newError(vm, ErrorKindInvalidInstruction)
+}
+
+func ErrorUnknownSyscall(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindUnknownSyscall)
+}
+
+func ErrorCallStackOverflow(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindCallStackOverflow)
+}
+
+func ErrorCallStackUnderflow(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindCallStackUnderflow)
+}
+
+func ErrorOutOfGas(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindOutOfGas)
+}
+
+func ErrorDeadlock(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindDeadlock)
 }
 
-func (err CoppervmError) String() string {
-	return fmt.Sprintf("'%s' executing instruction '%s' at ip '%d'",
+func ErrorTryStackOverflow(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindTryStackOverflow)
+}
+
+func ErrorTryStackUnderflow(vm *Coppervm) *CoppervmError {
+	return newError(vm, ErrorKindTryStackUnderflow)
+}
+
+func ErrorUncaughtException(vm *Coppervm, exception Word) *CoppervmError {
+	err := newError(vm, ErrorKindUncaughtException)
+	err.Exception = exception
+	return err
+}
+
+func ErrorCanceled(vm *Coppervm, cause error) *CoppervmError {
+	err := newError(vm, ErrorKindCanceled)
+	err.cause = cause
+	return err
+}
+
+func (err *CoppervmError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "'%s' executing instruction '%s' at ip '%d'",
 		err.Kind,
 		err.CurrentInst,
 		err.CurrentIp)
+	if err.Kind == ErrorKindIllegalMemoryAccess {
+		fmt.Fprintf(&sb, " accessing address '%d'", err.MemoryAddress)
+	}
+	if err.Kind == ErrorKindUncaughtException {
+		fmt.Fprintf(&sb, " throwing '%d'", err.Exception.AsI64)
+	}
+	if err.cause != nil {
+		fmt.Fprintf(&sb, ": %s", err.cause)
+	}
+	for _, frame := range err.Backtrace {
+		fmt.Fprintf(&sb, "\n    %s", frame)
+	}
+	return sb.String()
+}
+
+// Reports whether the error is of given kind, so that
+// errors.Is(err, ErrorKindStackOverflow) works.
+func (err *CoppervmError) Is(target error) bool {
+	kind, ok := target.(CoppervmErrorKind)
+	return ok && kind == err.Kind
+}
+
+// Returns the error of the context that canceled the execution,
+// so that errors.Is(err, context.DeadlineExceeded) works.
+func (err *CoppervmError) Unwrap() error {
+	return err.cause
+}
+
+func (frame BacktraceFrame) String() string {
+	out := fmt.Sprintf("at ip %d", frame.Ip)
+	if frame.Symbol != "" {
+		out += fmt.Sprintf(" (%s)", frame.Symbol)
+	}
+	if frame.Location != "" {
+		out += fmt.Sprintf(" in %s", frame.Location)
+	}
+	return out
 }
 
 type CoppervmErrorKind int
 
 const (
-	ErrorKindOk CoppervmErrorKind = iota
-	ErrorKindIllegalInstAccess
+	ErrorKindIllegalInstAccess CoppervmErrorKind = iota
 	ErrorKindStackOverflow
 	ErrorKindStackUnderflow
 	ErrorKindDivideByZero
 	ErrorKindIllegalMemoryAccess
 	ErrorKindInvalidInstruction
+	ErrorKindUnknownSyscall
+	ErrorKindCallStackOverflow
+	ErrorKindCallStackUnderflow
+	ErrorKindOutOfGas
+	ErrorKindCanceled
+	ErrorKindDeadlock
+	ErrorKindTryStackOverflow
+	ErrorKindTryStackUnderflow
+	ErrorKindUncaughtException
 )
 
+// A CoppervmErrorKind is also an error, so it can be used
+// as the target of errors.Is.
+func (err CoppervmErrorKind) Error() string {
+	return err.String()
+}
+
 func (err CoppervmErrorKind) String() string {
-	return [...]string{
-		"ErrorOk",
+	names := [...]string{
 		"ErrorIllegalInstAccess",
 		"ErrorStackOverflow",
 		"ErrorStackUnderflow",
 		"ErrorDivideByZero",
 		"ErrorIllegalMemoryAccess",
 		"ErrorKindInvalidInstruction",
-	}[err]
+		"ErrorUnknownSyscall",
+		"ErrorCallStackOverflow",
+		"ErrorCallStackUnderflow",
+		"ErrorOutOfGas",
+		"ErrorCanceled",
+		"ErrorDeadlock",
+		"ErrorTryStackOverflow",
+		"ErrorTryStackUnderflow",
+		"ErrorUncaughtException",
+	}
+	if err == TrapCatchAll {
+		return "TrapCatchAll"
+	}
+	if err < 0 || int(err) >= len(names) {
+		return fmt.Sprintf("CoppervmErrorKind(%d)", int(err))
+	}
+	return names[err]
 }
@@ -0,0 +1,54 @@
+package coppervm
+
+// Frame pushed by the try instruction: where the execution
+// continues when a word is thrown and the depths of the stacks
+// when the frame was pushed.
+type tryFrame struct {
+	handler       InstAddr
+	stackSize     int64
+	callStackSize int64
+}
+
+// Set the number of frames the try stack can hold.
+// The default is CoppervmTryStackCapacity; a negative capacity
+// is ignored.
+func WithTryStackCapacity(capacity int64) CoppervmOption {
+	return func(vm *Coppervm) {
+		if capacity >= 0 {
+			vm.tryStack = make([]tryFrame, capacity)
+		}
+	}
+}
+
+// Throw a word to the handler of the innermost try frame, that is
+// popped: the stack is unwound to its depth when the frame was
+// pushed, with the word on top, and so is the call stack; the
+// functions left are reported to the hooks as returns to the
+// handler.
+// Return a *CoppervmError of kind ErrorKindUncaughtException if
+// there are no frames.
+func (vm *Coppervm) throw(exception Word) error {
+	if vm.tryStackSize == 0 {
+		return ErrorUncaughtException(vm, exception)
+	}
+	frame := vm.tryStack[vm.tryStackSize-1]
+	if frame.stackSize >= int64(len(vm.Stack)) {
+		return ErrorStackOverflow(vm)
+	}
+	vm.tryStackSize--
+
+	// A frame deeper than the call stack was pushed by a function
+	// that returned without popping it, and the return addresses
+	// above the call stack are not valid anymore, so the call
+	// stack is left as it is
+	for vm.CallStackSize > frame.callStackSize {
+		vm.CallStackSize--
+		if len(vm.hooks) > 0 {
+			vm.hookReturn(frame.handler)
+		}
+	}
+	vm.Stack[frame.stackSize] = exception
+	vm.StackSize = frame.stackSize + 1
+	vm.Ip = frame.handler
+	return nil
+}
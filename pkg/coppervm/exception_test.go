@@ -0,0 +1,154 @@
+package coppervm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Calls a function inside a try frame, that pushes some
+// words and throws 42; the handler prints it.
+var throwTestProgram = []InstDef{
+	{Kind: InstPush, Name: "push", Operand: WordU64(7)},
+	{Kind: InstTry, Name: "try", HasOperand: true, Operand: WordU64(7)},
+	{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+	{Kind: InstPush, Name: "push", Operand: WordU64(2)},
+	{Kind: InstFunCall, Name: "call", HasOperand: true, Operand: WordU64(9)},
+	{Kind: InstEndTry, Name: "endtry"},
+	{Kind: InstHalt, Name: "halt"},
+	// Handler at 7
+	{Kind: InstPrint, Name: "print"},
+	{Kind: InstHalt, Name: "halt"},
+	// Function at 9
+	{Kind: InstPush, Name: "push", Operand: WordU64(3)},
+	{Kind: InstPush, Name: "push", Operand: WordU64(42)},
+	{Kind: InstThrow, Name: "throw"},
+}
+
+func TestThrow(t *testing.T) {
+	hook := &recordHook{}
+	vm, output, err := runTestProgram(throwTestProgram, 100, WithHook(hook))
+	assert.NoError(t, err)
+	assert.True(t, vm.Halt)
+	assert.Equal(t, printedWords(WordU64(42)), output)
+	assert.Equal(t, []Word{WordU64(7)}, vm.Stack[:vm.StackSize])
+	assert.Equal(t, int64(0), vm.CallStackSize)
+	assert.Equal(t, int64(0), vm.tryStackSize)
+	// The function left by the throw returns to the handler
+	assert.Contains(t, hook.events, "return 11 7")
+
+	// Without the throw the frame is popped by endtry
+	program := append([]InstDef{}, throwTestProgram...)
+	program[11] = InstDef{Kind: InstFunReturn, Name: "ret"}
+	vm, output, err = runTestProgram(program, 100)
+	assert.NoError(t, err)
+	assert.Empty(t, output)
+	assert.Equal(t, InstAddr(6), vm.Ip)
+	assert.Equal(t, int64(0), vm.tryStackSize)
+}
+
+func TestThrowNested(t *testing.T) {
+	// The inner handler throws again to the outer one
+	vm, output, err := runTestProgram([]InstDef{
+		{Kind: InstTry, Name: "try", HasOperand: true, Operand: WordU64(6)},
+		{Kind: InstTry, Name: "try", HasOperand: true, Operand: WordU64(4)},
+		{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+		{Kind: InstThrow, Name: "throw"},
+		// Inner handler at 4
+		{Kind: InstDup, Name: "dup"},
+		{Kind: InstThrow, Name: "throw"},
+		// Outer handler at 6
+		{Kind: InstPrint, Name: "print"},
+		{Kind: InstHalt, Name: "halt"},
+	}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, printedWords(WordU64(1)), output)
+	assert.Equal(t, int64(0), vm.StackSize)
+	assert.Equal(t, int64(0), vm.tryStackSize)
+}
+
+func TestThrowErrors(t *testing.T) {
+	// Throw without a frame
+	vm, _, err := runTestProgram([]InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordU64(5)},
+		{Kind: InstThrow, Name: "throw"},
+	}, 100)
+	assert.ErrorIs(t, err, ErrorKindUncaughtException)
+	assert.Contains(t, err.Error(), "throwing '5'")
+	assert.Equal(t, InstAddr(1), vm.Ip)
+	assert.Equal(t, []Word{WordU64(5)}, vm.Stack[:vm.StackSize])
+
+	tests := []struct {
+		program []InstDef
+		err     CoppervmErrorKind
+	}{
+		{[]InstDef{{Kind: InstThrow, Name: "throw"}}, ErrorKindStackUnderflow},
+		{[]InstDef{{Kind: InstEndTry, Name: "endtry"}}, ErrorKindTryStackUnderflow},
+		{[]InstDef{
+			{Kind: InstTry, Name: "try", HasOperand: true, Operand: WordU64(0)},
+			{Kind: InstTry, Name: "try", HasOperand: true, Operand: WordU64(0)},
+		}, ErrorKindTryStackOverflow},
+	}
+	for _, test := range tests {
+		_, _, err := runTestProgram(test.program, 100, WithTryStackCapacity(1))
+		assert.ErrorIs(t, err, test.err)
+	}
+
+	// The uncaught exceptions can be trapped
+	_, output, err := runTestProgram([]InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordI64(int64(ErrorKindUncaughtException))},
+		{Kind: InstPush, Name: "push", Operand: WordU64(6)},
+		trapSyscall(),
+		{Kind: InstPush, Name: "push", Operand: WordU64(5)},
+		{Kind: InstThrow, Name: "throw"},
+		{Kind: InstHalt, Name: "halt"},
+		// Handler at 6
+		{Kind: InstDrop, Name: "drop"},
+		{Kind: InstDrop, Name: "drop"},
+		{Kind: InstPrint, Name: "print"},
+		{Kind: InstHalt, Name: "halt"},
+	}, 100)
+	assert.NoError(t, err)
+	assert.Equal(t, printedWords(WordU64(5)), output)
+}
+
+func TestThrowStepBack(t *testing.T) {
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, throwTestProgram, []byte{}, DebugSymbols{}))
+	vm.EnableUndoLog(20)
+	assert.NoError(t, vm.ExecuteProgram(8))
+	assert.Equal(t, InstAddr(7), vm.Ip)
+
+	_, ok := vm.StepBack()
+	assert.True(t, ok)
+	assert.Equal(t, InstAddr(11), vm.Ip)
+	assert.Equal(t, []Word{WordU64(7), WordU64(1), WordU64(2), WordU64(3), WordU64(42)}, vm.Stack[:vm.StackSize])
+	assert.Equal(t, int64(1), vm.CallStackSize)
+	assert.Equal(t, int64(1), vm.tryStackSize)
+
+	// Throw again after the revert
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	assert.Equal(t, []Word{WordU64(7)}, vm.Stack[:vm.StackSize])
+}
+
+func TestThrowSnapshot(t *testing.T) {
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, throwTestProgram, []byte{}, DebugSymbols{}))
+	assert.NoError(t, vm.ExecuteProgram(6))
+	var snapshot bytes.Buffer
+	assert.NoError(t, vm.Snapshot(&snapshot))
+
+	var output bytes.Buffer
+	restored := NewCoppervm(WithDebugOutput(&output))
+	restored.loadProgramFromMeta(FileMeta(0, throwTestProgram, []byte{}, DebugSymbols{}))
+	assert.NoError(t, restored.Restore(bytes.NewReader(snapshot.Bytes())))
+	assert.Equal(t, int64(1), restored.tryStackSize)
+	assert.NoError(t, restored.ExecuteProgram(-1))
+	assert.Equal(t, printedWords(WordU64(42)), output.String())
+
+	// The try stack must fit the capacity
+	small := NewCoppervm(WithTryStackCapacity(0))
+	small.loadProgramFromMeta(FileMeta(0, throwTestProgram, []byte{}, DebugSymbols{}))
+	assert.Error(t, small.Restore(bytes.NewReader(snapshot.Bytes())))
+}
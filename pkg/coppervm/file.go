@@ -0,0 +1,154 @@
+package coppervm
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+// Interface of the files a vm program can access
+// through its file descriptors.
+type File interface {
+	io.Reader
+	io.Writer
+	io.Seeker
+	io.Closer
+}
+
+// Implemented by the files whose reads can block for a long
+// time, so they can be interrupted.
+type contextReader interface {
+	ReadContext(ctx context.Context, p []byte) (int, error)
+}
+
+var (
+	errStreamNotReadable = errors.New("stream is not readable")
+	errStreamNotWritable = errors.New("stream is not writable")
+	errStreamNotSeekable = errors.New("stream is not seekable")
+)
+
+// File backed by a stream that is owned by the caller
+// of the vm, like the standard input, output and error.
+// Closing a streamFile doesn't close the underlying stream.
+type streamFile struct {
+	reader io.Reader
+	writer io.Writer
+}
+
+func (f streamFile) Read(p []byte) (int, error) {
+	if f.reader == nil {
+		return 0, errStreamNotReadable
+	}
+	return f.reader.Read(p)
+}
+
+// Read like Read, but return ctx.Err() if ctx is done before
+// the stream has data.
+func (f streamFile) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if r, ok := f.reader.(*interruptibleReader); ok {
+		return r.ReadContext(ctx, p)
+	}
+	return f.Read(p)
+}
+
+func (f streamFile) Write(p []byte) (int, error) {
+	if f.writer == nil {
+		return 0, errStreamNotWritable
+	}
+	return f.writer.Write(p)
+}
+
+func (f streamFile) Seek(offset int64, whence int) (int64, error) {
+	if seeker, ok := f.reader.(io.Seeker); ok {
+		return seeker.Seek(offset, whence)
+	}
+	if seeker, ok := f.writer.(io.Seeker); ok {
+		return seeker.Seek(offset, whence)
+	}
+	return 0, errStreamNotSeekable
+}
+
+func (f streamFile) Close() error {
+	return nil
+}
+
+// File opened by the open system call, with the name and the
+// flags needed to open it again when a snapshot is restored.
+type openedFile struct {
+	File
+	name string
+	flag int
+}
+
+// Reader whose reads can be abandoned when a context is done,
+// like the ones of the standard input that may block forever.
+// The abandoned read goes on in the background and its data is
+// returned by the next read, so nothing is lost.
+type interruptibleReader struct {
+	r io.Reader
+	// Result of the read in the background, if any
+	pending chan readResult
+	// Data read in the background and not returned yet
+	buf []byte
+	err error
+}
+
+type readResult struct {
+	data []byte
+	err  error
+}
+
+func newInterruptibleReader(r io.Reader) *interruptibleReader {
+	return &interruptibleReader{r: r}
+}
+
+func (r *interruptibleReader) Read(p []byte) (int, error) {
+	return r.ReadContext(context.Background(), p)
+}
+
+func (r *interruptibleReader) ReadContext(ctx context.Context, p []byte) (int, error) {
+	if len(r.buf) == 0 && r.err == nil {
+		if r.pending == nil && ctx.Done() == nil {
+			// The read can't be canceled, so it doesn't need
+			// to happen in the background
+			return r.r.Read(p)
+		}
+		if r.pending == nil {
+			r.pending = make(chan readResult, 1)
+			go func(pending chan<- readResult, size int) {
+				data := make([]byte, size)
+				n, err := r.r.Read(data)
+				pending <- readResult{data: data[:n], err: err}
+			}(r.pending, len(p))
+		}
+		select {
+		case result := <-r.pending:
+			r.pending = nil
+			r.buf, r.err = result.data, result.err
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	if len(r.buf) > 0 {
+		return n, nil
+	}
+	err := r.err
+	r.err = nil
+	return n, err
+}
+
+func (r *interruptibleReader) Seek(offset int64, whence int) (int64, error) {
+	seeker, ok := r.r.(io.Seeker)
+	if !ok || r.pending != nil {
+		return 0, errStreamNotSeekable
+	}
+	// The underlying reader is ahead of the data not returned yet
+	if whence == io.SeekCurrent {
+		offset -= int64(len(r.buf))
+	}
+	r.buf, r.err = nil, nil
+	return seeker.Seek(offset, whence)
+}
@@ -1,7 +1,17 @@
 package coppervm
 
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
 const (
-	CoppervmFileVersion int = 1
+	CoppervmFileVersion int = 3
+	// Last version of the binary format that keeps the return
+	// addresses on the data stack.
+	CoppervmSharedStackFileVersion int = 2
+	CoppervmLegacyFileVersion      int = 1
 )
 
 type CoppervmFileMeta struct {
@@ -10,6 +20,7 @@ type CoppervmFileMeta struct {
 	Program      []InstDef    `json:"program"`
 	Memory       []byte       `json:"memory"`
 	DebugSymbols DebugSymbols `json:"db_symbols"`
+	LineTable    LineTable    `json:"line_table"`
 }
 
 // Create a new CoppervmFileMeta with given entry point, program, memory and debug symbols.
@@ -22,3 +33,21 @@ func FileMeta(entryPoint int, program []InstDef, memory []byte, symbols DebugSym
 		DebugSymbols: symbols,
 	}
 }
+
+// Parse the content of a .copper file.
+// Both the binary format and the legacy JSON format
+// are accepted; the format is detected by the magic header.
+func ParseFileMeta(content []byte) (meta CoppervmFileMeta, err error) {
+	if bytes.HasPrefix(content, []byte(CoppervmFileMagic)) {
+		err = meta.UnmarshalBinary(content)
+		return meta, err
+	}
+
+	if err = json.Unmarshal(content, &meta); err != nil {
+		return meta, err
+	}
+	if meta.Version != CoppervmLegacyFileVersion {
+		return meta, fmt.Errorf("unsupported JSON file version %d", meta.Version)
+	}
+	return meta, nil
+}
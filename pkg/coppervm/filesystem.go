@@ -0,0 +1,499 @@
+package coppervm
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Interface of the filesystem used by the file system calls.
+type FileSystem interface {
+	// Open the named file with given flags (os.O_RDONLY, etc.)
+	// and permission bits.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Returns the information of the named file.
+	Stat(name string) (os.FileInfo, error)
+	// Remove the named file or empty directory.
+	Remove(name string) error
+	// Rename (move) a file or directory.
+	Rename(oldName string, newName string) error
+	// Create a new directory with given permission bits.
+	Mkdir(name string, perm os.FileMode) error
+	// Returns the sorted names of the entries of a directory.
+	ReadDir(name string) ([]string, error)
+}
+
+var (
+	errOutsideRoot = errors.New("path is outside the filesystem root")
+	errIsDir       = errors.New("is a directory")
+	errDirNotEmpty = errors.New("directory not empty")
+)
+
+// FileSystem with unrestricted access to the host filesystem.
+type OSFileSystem struct{}
+
+func (OSFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (OSFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (OSFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (OSFileSystem) Rename(oldName string, newName string) error {
+	return os.Rename(oldName, newName)
+}
+
+func (OSFileSystem) Mkdir(name string, perm os.FileMode) error {
+	return os.Mkdir(name, perm)
+}
+
+func (OSFileSystem) ReadDir(name string) ([]string, error) {
+	return readDirNames(name)
+}
+
+// Returns the sorted names of the entries of a directory
+// of the host filesystem.
+func readDirNames(name string) ([]string, error) {
+	dir, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer dir.Close()
+	names, err := dir.Readdirnames(-1)
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// FileSystem restricted to the files inside a root directory
+// of the host filesystem.
+// Absolute paths are relative to the root and paths that
+// escape from it, even through symbolic links, are rejected.
+type JailFileSystem struct {
+	Root string
+}
+
+// Create a new JailFileSystem with given root directory.
+func NewJailFileSystem(root string) (*JailFileSystem, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	absRoot, err = filepath.EvalSymlinks(absRoot)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(absRoot)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "jail", Path: root, Err: errors.New("not a directory")}
+	}
+	return &JailFileSystem{Root: absRoot}, nil
+}
+
+func (fs *JailFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	hostPath, err := fs.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return os.OpenFile(hostPath, flag, perm)
+}
+
+func (fs *JailFileSystem) Stat(name string) (os.FileInfo, error) {
+	hostPath, err := fs.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+	}
+	return os.Stat(hostPath)
+}
+
+func (fs *JailFileSystem) Remove(name string) error {
+	hostPath, err := fs.resolve(name)
+	if err != nil {
+		return &os.PathError{Op: "remove", Path: name, Err: err}
+	}
+	if hostPath == fs.Root {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	return os.Remove(hostPath)
+}
+
+func (fs *JailFileSystem) Rename(oldName string, newName string) error {
+	oldPath, err := fs.resolve(oldName)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	newPath, err := fs.resolve(newName)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	if oldPath == fs.Root || newPath == fs.Root {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: os.ErrPermission}
+	}
+	return os.Rename(oldPath, newPath)
+}
+
+func (fs *JailFileSystem) Mkdir(name string, perm os.FileMode) error {
+	hostPath, err := fs.resolve(name)
+	if err != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: err}
+	}
+	return os.Mkdir(hostPath, perm)
+}
+
+func (fs *JailFileSystem) ReadDir(name string) ([]string, error) {
+	hostPath, err := fs.resolve(name)
+	if err != nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: err}
+	}
+	return readDirNames(hostPath)
+}
+
+// Returns the host path of a file inside the jail.
+func (fs *JailFileSystem) resolve(name string) (string, error) {
+	rel := filepath.Clean(filepath.FromSlash(name))
+	rel = strings.TrimLeft(rel, string(filepath.Separator))
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errOutsideRoot
+	}
+	hostPath := filepath.Join(fs.Root, rel)
+
+	// Follow the symbolic links of the longest existing
+	// prefix of the path to check it's still inside the root
+	existing := hostPath
+	for {
+		if _, err := os.Lstat(existing); err == nil {
+			break
+		}
+		parent := filepath.Dir(existing)
+		if parent == existing {
+			break
+		}
+		existing = parent
+	}
+	realPath, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	if !fs.contains(realPath) {
+		return "", errOutsideRoot
+	}
+	return hostPath, nil
+}
+
+// Returns true if given host path is inside the root.
+func (fs *JailFileSystem) contains(hostPath string) bool {
+	return hostPath == fs.Root ||
+		strings.HasPrefix(hostPath, fs.Root+string(filepath.Separator)) ||
+		fs.Root == string(filepath.Separator)
+}
+
+// FileSystem that keeps all the files in memory.
+// It's useful for running programs in isolation and
+// inspecting the files they produce.
+type MemFileSystem struct {
+	files map[string]*memFileData
+	dirs  map[string]*memDirData
+}
+
+type memFileData struct {
+	data    []byte
+	mode    os.FileMode
+	modTime time.Time
+}
+
+type memDirData struct {
+	mode    os.FileMode
+	modTime time.Time
+}
+
+// Create a new empty MemFileSystem.
+func NewMemFileSystem() *MemFileSystem {
+	return &MemFileSystem{
+		files: make(map[string]*memFileData),
+		dirs:  map[string]*memDirData{"/": {mode: 0755, modTime: time.Now()}},
+	}
+}
+
+// Create or replace the named file with given content.
+// The missing parent directories are created too.
+func (fs *MemFileSystem) WriteFile(name string, data []byte) {
+	name = memPath(name)
+	for dir := path.Dir(name); fs.dirs[dir] == nil; dir = path.Dir(dir) {
+		fs.dirs[dir] = &memDirData{mode: 0755, modTime: time.Now()}
+	}
+	fs.files[name] = &memFileData{
+		data:    append([]byte{}, data...),
+		mode:    0644,
+		modTime: time.Now(),
+	}
+}
+
+// Returns the content of the named file.
+// The second return value is false if the file doesn't exist.
+func (fs *MemFileSystem) ReadFile(name string) ([]byte, bool) {
+	file, exist := fs.files[memPath(name)]
+	if !exist {
+		return nil, false
+	}
+	return append([]byte{}, file.data...), true
+}
+
+func (fs *MemFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	name = memPath(name)
+	if fs.dirs[name] != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: errIsDir}
+	}
+	file, exist := fs.files[name]
+	if exist && flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	}
+	if !exist {
+		if flag&os.O_CREATE == 0 || fs.dirs[path.Dir(name)] == nil {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		file = &memFileData{mode: perm.Perm(), modTime: time.Now()}
+		fs.files[name] = file
+	}
+	writable := flag&(os.O_WRONLY|os.O_RDWR) != 0
+	if flag&os.O_TRUNC != 0 && writable {
+		file.data = file.data[:0]
+		file.modTime = time.Now()
+	}
+	return &memFile{
+		file:     file,
+		readable: flag&os.O_WRONLY == 0,
+		writable: writable,
+		append:   flag&os.O_APPEND != 0,
+	}, nil
+}
+
+func (fs *MemFileSystem) Stat(name string) (os.FileInfo, error) {
+	name = memPath(name)
+	if file, exist := fs.files[name]; exist {
+		return memFileInfo{
+			name:    path.Base(name),
+			size:    int64(len(file.data)),
+			mode:    file.mode,
+			modTime: file.modTime,
+		}, nil
+	}
+	if dir, exist := fs.dirs[name]; exist {
+		return memFileInfo{
+			name:    path.Base(name),
+			mode:    dir.mode | os.ModeDir,
+			modTime: dir.modTime,
+		}, nil
+	}
+	return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFileSystem) Remove(name string) error {
+	name = memPath(name)
+	if _, exist := fs.files[name]; exist {
+		delete(fs.files, name)
+		return nil
+	}
+	if _, exist := fs.dirs[name]; exist {
+		if name == "/" || len(fs.children(name)) > 0 {
+			return &os.PathError{Op: "remove", Path: name, Err: errDirNotEmpty}
+		}
+		delete(fs.dirs, name)
+		return nil
+	}
+	return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+}
+
+func (fs *MemFileSystem) Rename(oldName string, newName string) error {
+	oldName, newName = memPath(oldName), memPath(newName)
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "rename", Old: oldName, New: newName, Err: err}
+	}
+	if fs.dirs[path.Dir(newName)] == nil {
+		return linkError(os.ErrNotExist)
+	}
+	if file, exist := fs.files[oldName]; exist {
+		if fs.dirs[newName] != nil {
+			return linkError(errIsDir)
+		}
+		delete(fs.files, oldName)
+		fs.files[newName] = file
+		return nil
+	}
+	dir, exist := fs.dirs[oldName]
+	if !exist || oldName == "/" {
+		return linkError(os.ErrNotExist)
+	}
+	if newName == oldName || strings.HasPrefix(newName, oldName+"/") {
+		return linkError(os.ErrInvalid)
+	}
+	if fs.files[newName] != nil || (fs.dirs[newName] != nil && len(fs.children(newName)) > 0) {
+		return linkError(os.ErrExist)
+	}
+	// Move the directory with all its content
+	for name, file := range fs.files {
+		if strings.HasPrefix(name, oldName+"/") {
+			delete(fs.files, name)
+			fs.files[newName+strings.TrimPrefix(name, oldName)] = file
+		}
+	}
+	for name, d := range fs.dirs {
+		if strings.HasPrefix(name, oldName+"/") {
+			delete(fs.dirs, name)
+			fs.dirs[newName+strings.TrimPrefix(name, oldName)] = d
+		}
+	}
+	delete(fs.dirs, oldName)
+	fs.dirs[newName] = dir
+	return nil
+}
+
+func (fs *MemFileSystem) Mkdir(name string, perm os.FileMode) error {
+	name = memPath(name)
+	if fs.files[name] != nil || fs.dirs[name] != nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrExist}
+	}
+	if fs.dirs[path.Dir(name)] == nil {
+		return &os.PathError{Op: "mkdir", Path: name, Err: os.ErrNotExist}
+	}
+	fs.dirs[name] = &memDirData{mode: perm.Perm(), modTime: time.Now()}
+	return nil
+}
+
+func (fs *MemFileSystem) ReadDir(name string) ([]string, error) {
+	name = memPath(name)
+	if fs.dirs[name] == nil {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	return fs.children(name), nil
+}
+
+// Returns the sorted names of the direct children of a directory.
+func (fs *MemFileSystem) children(dir string) (names []string) {
+	isChild := func(name string) bool {
+		return name != "/" && path.Dir(name) == dir
+	}
+	for name := range fs.files {
+		if isChild(name) {
+			names = append(names, path.Base(name))
+		}
+	}
+	for name := range fs.dirs {
+		if isChild(name) {
+			names = append(names, path.Base(name))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the canonical name of a file in a MemFileSystem.
+func memPath(name string) string {
+	return path.Clean("/" + name)
+}
+
+// Information of a file of a MemFileSystem.
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (info memFileInfo) Name() string       { return info.name }
+func (info memFileInfo) Size() int64        { return info.size }
+func (info memFileInfo) Mode() os.FileMode  { return info.mode }
+func (info memFileInfo) ModTime() time.Time { return info.modTime }
+func (info memFileInfo) IsDir() bool        { return info.mode.IsDir() }
+func (info memFileInfo) Sys() interface{}   { return nil }
+
+// Open file of a MemFileSystem.
+type memFile struct {
+	file     *memFileData
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	closed   bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.readable {
+		return 0, os.ErrPermission
+	}
+	if f.offset >= int64(len(f.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.file.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	if !f.writable {
+		return 0, os.ErrPermission
+	}
+	if f.append {
+		f.offset = int64(len(f.file.data))
+	}
+	end := f.offset + int64(len(p))
+	if end > int64(len(f.file.data)) {
+		data := make([]byte, end)
+		copy(data, f.file.data)
+		f.file.data = data
+	}
+	copy(f.file.data[f.offset:], p)
+	f.file.modTime = time.Now()
+	f.offset = end
+	return len(p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, os.ErrClosed
+	}
+	var newOffset int64
+	switch whence {
+	case io.SeekStart:
+		newOffset = offset
+	case io.SeekCurrent:
+		newOffset = f.offset + offset
+	case io.SeekEnd:
+		newOffset = int64(len(f.file.data)) + offset
+	default:
+		return 0, os.ErrInvalid
+	}
+	if newOffset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = newOffset
+	return newOffset, nil
+}
+
+func (f *memFile) Close() error {
+	if f.closed {
+		return os.ErrClosed
+	}
+	f.closed = true
+	return nil
+}
@@ -0,0 +1,185 @@
+package coppervm
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJailFileSystem(t *testing.T) {
+	root, err := ioutil.TempDir("", "coppervm-jail")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	outside, err := ioutil.TempDir("", "coppervm-outside")
+	assert.NoError(t, err)
+	defer os.RemoveAll(outside)
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644))
+	assert.NoError(t, os.Mkdir(filepath.Join(root, "dir"), 0755))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(outside, "secret.txt"), []byte("s"), 0644))
+	assert.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+
+	fs, err := NewJailFileSystem(root)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		flag     int
+		hasError bool
+	}{
+		{"a.txt", os.O_RDONLY, false},
+		{"/a.txt", os.O_RDONLY, false},
+		{"dir/../a.txt", os.O_RDONLY, false},
+		{"dir/new.txt", os.O_RDWR | os.O_CREATE, false},
+		{"missing.txt", os.O_RDONLY, true},
+		{"../a.txt", os.O_RDONLY, true},
+		{"dir/../../a.txt", os.O_RDONLY, true},
+		{"escape/secret.txt", os.O_RDONLY, true},
+		{"escape/new.txt", os.O_RDWR | os.O_CREATE, true},
+	}
+
+	for _, test := range tests {
+		file, err := fs.OpenFile(test.name, test.flag, 0644)
+		if test.hasError {
+			assert.Error(t, err, test)
+		} else {
+			assert.NoError(t, err, test)
+			file.Close()
+		}
+	}
+	_, err = os.Stat(filepath.Join(outside, "new.txt"))
+	assert.True(t, os.IsNotExist(err))
+
+	_, err = NewJailFileSystem(filepath.Join(root, "a.txt"))
+	assert.Error(t, err)
+}
+
+func TestMemFileSystem(t *testing.T) {
+	fs := NewMemFileSystem()
+	fs.WriteFile("/a.txt", []byte("hello"))
+
+	// Read
+	file, err := fs.OpenFile("a.txt", os.O_RDONLY, 0)
+	assert.NoError(t, err)
+	buf := make([]byte, 8)
+	n, err := file.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+	_, err = file.Read(buf)
+	assert.Equal(t, io.EOF, err)
+	_, err = file.Write([]byte("x"))
+	assert.Error(t, err)
+	assert.NoError(t, file.Close())
+	assert.Error(t, file.Close())
+
+	// Seek and write
+	file, err = fs.OpenFile("a.txt", os.O_RDWR, 0)
+	assert.NoError(t, err)
+	pos, err := file.Seek(-2, io.SeekEnd)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), pos)
+	file.Write([]byte("p!!"))
+	data, _ := fs.ReadFile("a.txt")
+	assert.Equal(t, "help!!", string(data))
+
+	// Append
+	file, err = fs.OpenFile("a.txt", os.O_WRONLY|os.O_APPEND, 0)
+	assert.NoError(t, err)
+	file.Write([]byte("?"))
+	data, _ = fs.ReadFile("a.txt")
+	assert.Equal(t, "help!!?", string(data))
+
+	// Truncate
+	_, err = fs.OpenFile("a.txt", os.O_WRONLY|os.O_TRUNC, 0)
+	assert.NoError(t, err)
+	data, _ = fs.ReadFile("a.txt")
+	assert.Empty(t, data)
+
+	// Create
+	_, err = fs.OpenFile("new.txt", os.O_RDWR, 0)
+	assert.True(t, os.IsNotExist(err))
+	_, err = fs.OpenFile("new.txt", os.O_RDWR|os.O_CREATE, 0)
+	assert.NoError(t, err)
+	_, exist := fs.ReadFile("/new.txt")
+	assert.True(t, exist)
+	_, err = fs.OpenFile("new.txt", os.O_RDWR|os.O_CREATE|os.O_EXCL, 0)
+	assert.True(t, os.IsExist(err))
+}
+
+func TestMemFileSystemDirectories(t *testing.T) {
+	fs := NewMemFileSystem()
+	fs.WriteFile("dir/a.txt", []byte("a"))
+
+	info, err := fs.Stat("dir")
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	info, err = fs.Stat("dir/a.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), info.Size())
+	assert.False(t, info.IsDir())
+
+	assert.NoError(t, fs.Mkdir("dir/sub", 0755))
+	assert.Error(t, fs.Mkdir("dir/sub", 0755))
+	assert.Error(t, fs.Mkdir("missing/sub", 0755))
+	_, err = fs.OpenFile("missing/b.txt", os.O_RDWR|os.O_CREATE, 0644)
+	assert.Error(t, err)
+	_, err = fs.OpenFile("dir", os.O_RDONLY, 0)
+	assert.Error(t, err)
+
+	names, err := fs.ReadDir("/dir")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "sub"}, names)
+	names, err = fs.ReadDir("/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dir"}, names)
+
+	// Rename moves the content of directories
+	assert.NoError(t, fs.Rename("dir", "moved"))
+	assert.Error(t, fs.Rename("moved", "moved/sub/inside"))
+	_, exist := fs.ReadFile("moved/a.txt")
+	assert.True(t, exist)
+	_, err = fs.Stat("moved/sub")
+	assert.NoError(t, err)
+	_, err = fs.Stat("dir")
+	assert.True(t, os.IsNotExist(err))
+
+	// Only empty directories can be removed
+	assert.Error(t, fs.Remove("moved"))
+	assert.NoError(t, fs.Remove("moved/a.txt"))
+	assert.NoError(t, fs.Remove("moved/sub"))
+	assert.NoError(t, fs.Remove("moved"))
+	assert.Error(t, fs.Remove("moved"))
+	assert.Error(t, fs.Remove("/"))
+}
+
+func TestJailFileSystemMetadata(t *testing.T) {
+	root, err := ioutil.TempDir("", "coppervm-jail")
+	assert.NoError(t, err)
+	defer os.RemoveAll(root)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644))
+
+	fs, err := NewJailFileSystem(root)
+	assert.NoError(t, err)
+
+	assert.NoError(t, fs.Mkdir("/dir", 0755))
+	assert.NoError(t, fs.Rename("a.txt", "dir/b.txt"))
+	info, err := fs.Stat("dir/b.txt")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), info.Size())
+	names, err := fs.ReadDir("/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"dir"}, names)
+	assert.NoError(t, fs.Remove("dir/b.txt"))
+
+	_, err = fs.Stat("..")
+	assert.Error(t, err)
+	_, err = fs.ReadDir("../")
+	assert.Error(t, err)
+	assert.Error(t, fs.Mkdir("../outside", 0755))
+	assert.Error(t, fs.Rename("dir", "../dir"))
+	assert.Error(t, fs.Remove("/"))
+}
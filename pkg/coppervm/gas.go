@@ -0,0 +1,175 @@
+package coppervm
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Default cost in gas of every instruction.
+const DefaultInstGas uint64 = 1
+
+// Default cost in gas of a system call, paid on top of
+// the cost of the syscall instruction.
+const DefaultSyscallGas uint64 = 10
+
+// Cost in gas of the instructions and the system calls
+// executed by a program.
+type GasTable struct {
+	// Cost of every kind of instruction
+	Inst [InstCount]uint64
+	// Cost of the system calls, paid on top of the cost of the
+	// syscall instruction; the missing ones cost nothing more
+	Syscall map[SysCall]uint64
+}
+
+// Returns a new GasTable where every instruction costs
+// DefaultInstGas and every default system call DefaultSyscallGas.
+func DefaultGasTable() GasTable {
+	table := GasTable{Syscall: map[SysCall]uint64{}}
+	for kind := range table.Inst {
+		table.Inst[kind] = DefaultInstGas
+	}
+	for sysCall := range DefaultSyscallTable() {
+		table.Syscall[sysCall] = DefaultSyscallGas
+	}
+	return table
+}
+
+// Returns the cost in gas of given instruction.
+func (table *GasTable) Cost(inst InstDef) uint64 {
+	if inst.Kind < 0 || inst.Kind >= InstCount {
+		// Invalid instructions fail without being executed
+		return 0
+	}
+	cost := table.Inst[inst.Kind]
+	if inst.Kind == InstSyscall {
+		extra := table.Syscall[SysCall(inst.Operand.AsU64)]
+		if extra > math.MaxUint64-cost {
+			return math.MaxUint64
+		}
+		cost += extra
+	}
+	return cost
+}
+
+// Parse a GasTable from a text where every line sets the cost of
+// an instruction or of a system call:
+//
+//	<instruction> <cost>
+//	syscall <name|number> <cost>
+//
+// Empty lines and lines starting with # are ignored; the costs
+// that are not set are the ones of DefaultGasTable.
+func ParseGasTable(r io.Reader) (GasTable, error) {
+	table := DefaultGasTable()
+	scanner := bufio.NewScanner(r)
+	for row := 1; scanner.Scan(); row++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		kind, ok := instKindByName(fields[0])
+		if !ok {
+			return GasTable{}, fmt.Errorf("%d: unknown instruction '%s'", row, fields[0])
+		}
+		if kind == InstSyscall && len(fields) == 3 {
+			sysCall, ok := sysCallByName(fields[1])
+			if !ok {
+				return GasTable{}, fmt.Errorf("%d: unknown system call '%s'", row, fields[1])
+			}
+			cost, err := strconv.ParseUint(fields[2], 10, 64)
+			if err != nil {
+				return GasTable{}, fmt.Errorf("%d: invalid cost '%s'", row, fields[2])
+			}
+			table.Syscall[sysCall] = cost
+			continue
+		}
+		if len(fields) != 2 {
+			return GasTable{}, fmt.Errorf("%d: expected an instruction and its cost", row)
+		}
+		cost, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return GasTable{}, fmt.Errorf("%d: invalid cost '%s'", row, fields[1])
+		}
+		table.Inst[kind] = cost
+	}
+	if err := scanner.Err(); err != nil {
+		return GasTable{}, err
+	}
+	return table, nil
+}
+
+// Returns the kind of the instruction with given name.
+func instKindByName(name string) (InstKind, bool) {
+	for kind := InstKind(0); kind < InstCount; kind++ {
+		if kind.String() == name {
+			return kind, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the system call with given name or number.
+func sysCallByName(name string) (SysCall, bool) {
+	for i, sysCallName := range sysCallNames {
+		if sysCallName == name {
+			return SysCall(i), true
+		}
+	}
+	num, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return SysCall(num), true
+}
+
+// Set the gas available to the program and the cost of its
+// instructions; an instruction that costs more than the remaining
+// gas is not executed and fails with ErrorKindOutOfGas.
+// By default the gas is not metered.
+func WithGas(limit uint64, table GasTable) CoppervmOption {
+	return func(vm *Coppervm) {
+		vm.gasTable = &table
+		vm.gas = limit
+		vm.initialGas = limit
+	}
+}
+
+// Returns the gas left to the program.
+// The second return value is false if the gas is not metered.
+func (vm *Coppervm) RemainingGas() (uint64, bool) {
+	return vm.gas, vm.gasTable != nil
+}
+
+// Pay the cost of given instruction, that is the one at the
+// current ip.
+func (vm *Coppervm) chargeGas(inst InstDef) error {
+	cost := vm.gasTable.Cost(inst)
+	if cost > vm.gas {
+		return ErrorOutOfGas(vm)
+	}
+	vm.gas -= cost
+	return nil
+}
+
+// Give back the gas charged for an instruction that didn't
+// complete, so it's paid once when it's executed again.
+func (vm *Coppervm) refundGas(inst InstDef) {
+	vm.gas += vm.gasTable.Cost(inst)
+}
+
+// Reports whether the last instruction didn't complete and is
+// executed again later: a system call that blocked the thread
+// or that was interrupted by the cancellation of the context.
+func (vm *Coppervm) didNotComplete(err error) bool {
+	if vm.blocked {
+		return true
+	}
+	fault, ok := err.(*CoppervmError)
+	return ok && fault.Kind == ErrorKindCanceled
+}
@@ -0,0 +1,153 @@
+package coppervm
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var gasTestProgram = []InstDef{
+	{Kind: InstPush, Operand: WordU64(1)},
+	{Kind: InstSyscall, Operand: WordU64(uint64(SysCallSeed))},
+	{Kind: InstNoop},
+	{Kind: InstHalt},
+}
+
+func TestGasTableCost(t *testing.T) {
+	table := DefaultGasTable()
+	assert.Equal(t, DefaultInstGas, table.Cost(InstDef{Kind: InstNoop}))
+	assert.Equal(t, DefaultInstGas+DefaultSyscallGas,
+		table.Cost(InstDef{Kind: InstSyscall, Operand: WordU64(uint64(SysCallWrite))}))
+	// Unknown system calls cost only the instruction
+	assert.Equal(t, DefaultInstGas,
+		table.Cost(InstDef{Kind: InstSyscall, Operand: WordU64(1000)}))
+	assert.Equal(t, uint64(0), table.Cost(InstDef{Kind: InstCount}))
+}
+
+func TestOutOfGas(t *testing.T) {
+	table := DefaultGasTable()
+	table.Inst[InstNoop] = 5
+
+	// Enough gas for everything: 1 + 11 + 5 + 1
+	vm := NewCoppervm(WithGas(18, table))
+	vm.loadProgramFromMeta(FileMeta(0, gasTestProgram, []byte{}, DebugSymbols{}))
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	gas, metered := vm.RemainingGas()
+	assert.True(t, metered)
+	assert.Equal(t, uint64(0), gas)
+
+	// The noop is not executed
+	vm = NewCoppervm(WithGas(16, table))
+	vm.loadProgramFromMeta(FileMeta(0, gasTestProgram, []byte{}, DebugSymbols{}))
+	err := vm.ExecuteProgram(-1)
+	assert.ErrorIs(t, err, ErrorKindOutOfGas)
+	assert.Equal(t, InstAddr(2), vm.Ip)
+	assert.False(t, vm.Halt)
+	gas, _ = vm.RemainingGas()
+	assert.Equal(t, uint64(4), gas)
+
+	// Reset gives back all the gas
+	vm.Reset()
+	gas, _ = vm.RemainingGas()
+	assert.Equal(t, uint64(16), gas)
+
+	// Without a gas table the gas is not metered
+	vm = NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, gasTestProgram, []byte{}, DebugSymbols{}))
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	_, metered = vm.RemainingGas()
+	assert.False(t, metered)
+}
+
+func TestStepBackGas(t *testing.T) {
+	vm := NewCoppervm(WithGas(100, DefaultGasTable()))
+	vm.loadProgramFromMeta(FileMeta(0, gasTestProgram, []byte{}, DebugSymbols{}))
+	vm.EnableUndoLog(10)
+	assert.NoError(t, vm.ExecuteProgram(2))
+	gas, _ := vm.RemainingGas()
+	assert.Equal(t, uint64(88), gas)
+
+	vm.StepBack()
+	gas, _ = vm.RemainingGas()
+	assert.Equal(t, uint64(99), gas)
+}
+
+func TestParseGasTable(t *testing.T) {
+	table, err := ParseGasTable(strings.NewReader(`
+# Comment
+noop 0
+syscall 2
+syscall write 100
+syscall 42 7
+`))
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), table.Inst[InstNoop])
+	assert.Equal(t, uint64(2), table.Inst[InstSyscall])
+	assert.Equal(t, DefaultInstGas, table.Inst[InstPush])
+	assert.Equal(t, uint64(100), table.Syscall[SysCallWrite])
+	assert.Equal(t, DefaultSyscallGas, table.Syscall[SysCallRead])
+	assert.Equal(t, uint64(7), table.Syscall[SysCall(42)])
+
+	tests := []string{
+		"unknown 1",
+		"push",
+		"push -1",
+		"push 1 2",
+		"syscall unknown 1",
+		"syscall write x",
+	}
+	for _, test := range tests {
+		_, err := ParseGasTable(strings.NewReader(test))
+		assert.Error(t, err, test)
+	}
+}
+
+func TestGasBlockedSyscall(t *testing.T) {
+	// The recv blocks until the thread sends the value, and
+	// then it's executed again
+	program := []InstDef{
+		{Kind: InstPush, Operand: WordU64(1)},
+		threadSyscall(SysCallChan),
+		{Kind: InstPush, Operand: WordU64(8)},
+		{Kind: InstOver, Operand: WordU64(1)},
+		threadSyscall(SysCallSpawn),
+		{Kind: InstDrop},
+		threadSyscall(SysCallRecv),
+		{Kind: InstHalt},
+		// Thread at 8
+		{Kind: InstPush, Operand: WordU64(5)},
+		threadSyscall(SysCallSend),
+		{Kind: InstPush, Operand: WordU64(0)},
+		threadSyscall(SysCallThreadExit),
+	}
+	table := GasTable{}
+	for kind := range table.Inst {
+		table.Inst[kind] = 1
+	}
+
+	// Every instruction is paid once
+	vm, _, err := runTestProgram(program, -1, WithGas(100, table))
+	assert.NoError(t, err)
+	assert.True(t, vm.Halt)
+	assert.Equal(t, []Word{WordU64(5), WordU64(1)}, vm.Stack[:vm.StackSize])
+	gas, _ := vm.RemainingGas()
+	assert.Equal(t, uint64(100-12), gas)
+}
+
+func TestGasCanceledSyscall(t *testing.T) {
+	// The interrupted sleep is paid when it's executed again
+	table := DefaultGasTable()
+	vm := NewCoppervm(WithGas(100, table))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Operand: WordI64(int64(time.Hour))},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallSleep))},
+	}, []byte{}, DebugSymbols{}))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, vm.ExecuteProgramContext(ctx, -1), ErrorKindCanceled)
+	gas, _ := vm.RemainingGas()
+	assert.Equal(t, 100-DefaultInstGas, gas)
+}
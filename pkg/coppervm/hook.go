@@ -0,0 +1,138 @@
+package coppervm
+
+import (
+	"fmt"
+	"io"
+)
+
+// Interface implemented by the observers of the execution of a vm.
+// Hooks are called synchronously from the interpreter loop, so
+// they see the vm exactly in the state described by each callback
+// and can inspect it, but they should not modify it.
+// Embed NoopHook to implement only the callbacks you need.
+type Hook interface {
+	// Called before executing the instruction at ip.
+	BeforeInstruction(vm *Coppervm, ip InstAddr, inst InstDef)
+	// Called after executing the instruction at ip, with the
+	// error it returned or nil.
+	AfterInstruction(vm *Coppervm, ip InstAddr, inst InstDef, err error)
+	// Called before the handler of a system call.
+	SyscallEnter(vm *Coppervm, sysCall SysCall)
+	// Called after the handler of a system call, with the error
+	// it returned or nil.
+	SyscallExit(vm *Coppervm, sysCall SysCall, err error)
+	// Called when size bytes starting from addr are read from memory.
+	MemoryRead(vm *Coppervm, addr uint64, size uint64)
+	// Called before data is written to memory starting from addr,
+	// so the old content is still available.
+	MemoryWrite(vm *Coppervm, addr uint64, data []byte)
+	// Called when a function at address to is called from the
+	// instruction at address from.
+	Call(vm *Coppervm, from InstAddr, to InstAddr)
+	// Called when the function returns from the instruction at
+	// address from to the address to.
+	Return(vm *Coppervm, from InstAddr, to InstAddr)
+	// Called when the vm halts with given exit code.
+	Halt(vm *Coppervm, exitCode int)
+}
+
+// Optional interface of the hooks that are notified when a
+// fault of the program is caught by a trap handler.
+type TrapHook interface {
+	// Called when the fault is caught by the trap handler at
+	// address handler, before jumping to it; the fault has no
+	// backtrace and stack.
+	Trap(vm *Coppervm, fault *CoppervmError, handler InstAddr)
+}
+
+// Hook that does nothing.
+// It's meant to be embedded by the hooks that implement
+// only some of the callbacks.
+type NoopHook struct{}
+
+func (NoopHook) BeforeInstruction(vm *Coppervm, ip InstAddr, inst InstDef)           {}
+func (NoopHook) AfterInstruction(vm *Coppervm, ip InstAddr, inst InstDef, err error) {}
+func (NoopHook) SyscallEnter(vm *Coppervm, sysCall SysCall)                          {}
+func (NoopHook) SyscallExit(vm *Coppervm, sysCall SysCall, err error)                {}
+func (NoopHook) MemoryRead(vm *Coppervm, addr uint64, size uint64)                   {}
+func (NoopHook) MemoryWrite(vm *Coppervm, addr uint64, data []byte)                  {}
+func (NoopHook) Call(vm *Coppervm, from InstAddr, to InstAddr)                       {}
+func (NoopHook) Return(vm *Coppervm, from InstAddr, to InstAddr)                     {}
+func (NoopHook) Halt(vm *Coppervm, exitCode int)                                     {}
+
+// Hook that writes a line for every executed instruction,
+// system call, function call and return to an output.
+type TraceHook struct {
+	NoopHook
+	Output io.Writer
+}
+
+// Create a new TraceHook writing to given output.
+func NewTraceHook(output io.Writer) *TraceHook {
+	return &TraceHook{Output: output}
+}
+
+func (h *TraceHook) BeforeInstruction(vm *Coppervm, ip InstAddr, inst InstDef) {
+	fmt.Fprintf(h.Output, "[%d] %s\n", ip, inst)
+}
+
+func (h *TraceHook) SyscallExit(vm *Coppervm, sysCall SysCall, err error) {
+	if err != nil {
+		fmt.Fprintf(h.Output, "  syscall %s failed: %s\n", sysCall, err)
+	}
+}
+
+func (h *TraceHook) Call(vm *Coppervm, from InstAddr, to InstAddr) {
+	fmt.Fprintf(h.Output, "  call %s\n", traceLocation(vm, to))
+}
+
+func (h *TraceHook) Return(vm *Coppervm, from InstAddr, to InstAddr) {
+	fmt.Fprintf(h.Output, "  return to %s\n", traceLocation(vm, to))
+}
+
+func (h *TraceHook) Halt(vm *Coppervm, exitCode int) {
+	fmt.Fprintf(h.Output, "  halt with exit code %d\n", exitCode)
+}
+
+func (h *TraceHook) Trap(vm *Coppervm, fault *CoppervmError, handler InstAddr) {
+	fmt.Fprintf(h.Output, "  trap %s to %s\n", fault.Kind, traceLocation(vm, handler))
+}
+
+// Returns an address followed by its symbol if the
+// program has debug symbols.
+func traceLocation(vm *Coppervm, addr InstAddr) string {
+	if symbol := vm.debugSymbols.Symbolize(addr); symbol != "" {
+		return fmt.Sprintf("%d (%s)", addr, symbol)
+	}
+	return fmt.Sprintf("%d", addr)
+}
+
+// Notify the hooks that memory is read.
+func (vm *Coppervm) hookMemoryRead(addr uint64, size uint64) {
+	for _, h := range vm.hooks {
+		h.MemoryRead(vm, addr, size)
+	}
+}
+
+// Notify the hooks that memory is about to be written.
+func (vm *Coppervm) hookMemoryWrite(addr uint64, data []byte) {
+	for _, h := range vm.hooks {
+		h.MemoryWrite(vm, addr, data)
+	}
+}
+
+// Notify the hooks that the current instruction calls
+// the function at given address.
+func (vm *Coppervm) hookCall(target InstAddr) {
+	for _, h := range vm.hooks {
+		h.Call(vm, vm.Ip, target)
+	}
+}
+
+// Notify the hooks that the current instruction returns
+// to given address.
+func (vm *Coppervm) hookReturn(retAddr InstAddr) {
+	for _, h := range vm.hooks {
+		h.Return(vm, vm.Ip, retAddr)
+	}
+}
@@ -0,0 +1,159 @@
+package coppervm
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Hook that records every callback as a string.
+type recordHook struct {
+	events []string
+}
+
+func (h *recordHook) BeforeInstruction(vm *Coppervm, ip InstAddr, inst InstDef) {
+	h.events = append(h.events, fmt.Sprintf("before %d", ip))
+}
+
+func (h *recordHook) AfterInstruction(vm *Coppervm, ip InstAddr, inst InstDef, err error) {
+	h.events = append(h.events, fmt.Sprintf("after %d %v", ip, err != nil))
+}
+
+func (h *recordHook) SyscallEnter(vm *Coppervm, sysCall SysCall) {
+	h.events = append(h.events, fmt.Sprintf("enter %d", sysCall))
+}
+
+func (h *recordHook) SyscallExit(vm *Coppervm, sysCall SysCall, err error) {
+	h.events = append(h.events, fmt.Sprintf("exit %d", sysCall))
+}
+
+func (h *recordHook) MemoryRead(vm *Coppervm, addr uint64, size uint64) {
+	h.events = append(h.events, fmt.Sprintf("read %d %d", addr, size))
+}
+
+func (h *recordHook) MemoryWrite(vm *Coppervm, addr uint64, data []byte) {
+	h.events = append(h.events, fmt.Sprintf("write %d %v old %d", addr, data, vm.Memory[addr]))
+}
+
+func (h *recordHook) Call(vm *Coppervm, from InstAddr, to InstAddr) {
+	h.events = append(h.events, fmt.Sprintf("call %d %d", from, to))
+}
+
+func (h *recordHook) Return(vm *Coppervm, from InstAddr, to InstAddr) {
+	h.events = append(h.events, fmt.Sprintf("return %d %d", from, to))
+}
+
+func (h *recordHook) Halt(vm *Coppervm, exitCode int) {
+	h.events = append(h.events, fmt.Sprintf("halt %d", exitCode))
+}
+
+func (h *recordHook) Trap(vm *Coppervm, fault *CoppervmError, handler InstAddr) {
+	h.events = append(h.events, fmt.Sprintf("trap %d %d %d", fault.Kind, fault.CurrentIp, handler))
+}
+
+func TestHooks(t *testing.T) {
+	hook := &recordHook{}
+	vm := NewCoppervm(WithHook(hook), WithStdout(ioutil.Discard))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstFunCall, Operand: WordU64(3)},
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallExit))},
+		{Kind: InstPush, Operand: WordU64(7)},
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstMemWrite},
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstMemRead},
+		{Kind: InstDrop},
+		{Kind: InstFunReturn},
+	}, []byte{1}, DebugSymbols{}))
+	assert.NoError(t, vm.ExecuteProgram(-1))
+
+	assert.Equal(t, []string{
+		"before 0", "call 0 3", "after 0 false",
+		"before 3", "after 3 false",
+		"before 4", "after 4 false",
+		"before 5", "write 0 [7] old 1", "after 5 false",
+		"before 6", "after 6 false",
+		"before 7", "read 0 1", "after 7 false",
+		"before 8", "after 8 false",
+		"before 9", "return 9 1", "after 9 false",
+		"before 1", "after 1 false",
+		"before 2", "enter 5", "halt 0", "exit 5", "after 2 false",
+	}, hook.events)
+}
+
+func TestHooksErrors(t *testing.T) {
+	hook := &recordHook{}
+	vm := NewCoppervm(WithHook(hook))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Operand: WordU64(1)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallWrite))},
+	}, []byte{}, DebugSymbols{}))
+	assert.ErrorIs(t, vm.ExecuteProgram(-1), ErrorKindStackUnderflow)
+
+	assert.Equal(t, []string{
+		"before 0", "after 0 false",
+		"before 1", "enter 1", "exit 1", "after 1 true",
+	}, hook.events)
+}
+
+func TestHooksTrap(t *testing.T) {
+	hook := &recordHook{}
+	vm := NewCoppervm(WithHook(hook))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Operand: WordI64(int64(ErrorKindStackUnderflow))},
+		{Kind: InstPush, Operand: WordU64(4)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallTrap))},
+		{Kind: InstAddInt},
+		{Kind: InstHalt},
+	}, []byte{}, DebugSymbols{}))
+	assert.NoError(t, vm.ExecuteProgram(-1))
+
+	// The fault is caught before the instruction ends
+	assert.Equal(t, []string{
+		"before 0", "after 0 false",
+		"before 1", "after 1 false",
+		"before 2", "enter 29", "exit 29", "after 2 false",
+		"before 3", "trap 2 3 4", "after 3 false",
+		"before 4", "halt 0", "after 4 false",
+	}, hook.events)
+}
+
+func TestNoopHook(t *testing.T) {
+	// Embedding NoopHook implements the whole interface
+	var hook Hook = struct{ NoopHook }{}
+	vm := NewCoppervm(WithHook(hook))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{{Kind: InstHalt}}, []byte{}, DebugSymbols{}))
+	assert.NoError(t, vm.ExecuteProgram(-1))
+}
+
+func TestTraceHook(t *testing.T) {
+	var out bytes.Buffer
+	vm := NewCoppervm(WithHook(NewTraceHook(&out)))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstFunCall, Name: "call", HasOperand: true, Operand: WordU64(2)},
+		{Kind: InstHalt, Name: "halt"},
+		{Kind: InstFunReturn, Name: "ret"},
+	}, []byte{}, DebugSymbols{{Name: "f", Address: 2}}))
+	assert.NoError(t, vm.ExecuteProgram(-1))
+
+	assert.Equal(t, fmt.Sprintf("[0] %s\n", vm.Program[0])+
+		"  call 2 (f)\n"+
+		"[2] ret\n"+
+		"  return to 1\n"+
+		"[1] halt\n"+
+		"  halt with exit code 0\n", out.String())
+}
+
+func TestTraceHookSyscall(t *testing.T) {
+	var out bytes.Buffer
+	vm := NewCoppervm(WithHook(NewTraceHook(&out)))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstSyscall, Name: "syscall", HasOperand: true, Operand: WordU64(uint64(SysCallOpen))},
+	}, []byte{}, DebugSymbols{}))
+	assert.Error(t, vm.ExecuteProgram(-1))
+	assert.Contains(t, out.String(), "  syscall open failed: ")
+}
@@ -71,9 +71,88 @@ const (
 
 	InstPrint
 
+	// Indirect flow control
+	// NOTE: New instructions are appended here to keep the
+	// kinds of the existing ones stable in .copper files
+	InstJmpIndirect
+	InstFunCallIndirect
+
+	// Atomic memory access
+	InstMemReadAtomic
+	InstMemWriteAtomic
+	InstMemCompareSwap
+	InstMemFetchAdd
+
+	// Exceptions
+	InstTry
+	InstEndTry
+	InstThrow
+
 	InstCount
 )
 
+func (kind InstKind) String() string {
+	if kind < 0 || kind >= InstCount {
+		return fmt.Sprintf("InstKind(%d)", int(kind))
+	}
+	return [InstCount]string{
+		"noop",
+		"push",
+		"swap",
+		"dup",
+		"over",
+		"drop",
+		"halt",
+		"add",
+		"sub",
+		"mul",
+		"imul",
+		"div",
+		"idiv",
+		"mod",
+		"imod",
+		"fadd",
+		"fsub",
+		"fmul",
+		"fdiv",
+		"and",
+		"or",
+		"xor",
+		"not",
+		"shl",
+		"shr",
+		"cmp",
+		"icmp",
+		"fcmp",
+		"jmp",
+		"jz",
+		"jnz",
+		"jg",
+		"jge",
+		"jl",
+		"jle",
+		"call",
+		"ret",
+		"read",
+		"iread",
+		"fread",
+		"write",
+		"iwrite",
+		"fwrite",
+		"syscall",
+		"print",
+		"ijmp",
+		"icall",
+		"aread",
+		"awrite",
+		"cas",
+		"xadd",
+		"try",
+		"endtry",
+		"throw",
+	}[kind]
+}
+
 type InstDef struct {
 	Kind       InstKind
 	HasOperand bool
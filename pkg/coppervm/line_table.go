@@ -0,0 +1,47 @@
+package coppervm
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Position in the source of an instruction.
+// Row and Col start from 1.
+type SourceLocation struct {
+	Address InstAddr
+	File    string
+	Row     int
+	Col     int
+}
+
+func (loc SourceLocation) String() string {
+	return fmt.Sprintf("%s:%d:%d", loc.File, loc.Row, loc.Col)
+}
+
+// Table with the source location of the instructions of
+// a program, sorted by address.
+type LineTable []SourceLocation
+
+// Returns the source location of the instruction at given address.
+// The second return value is false if the address is not in the table.
+func (lt LineTable) Lookup(addr InstAddr) (SourceLocation, bool) {
+	i := sort.Search(len(lt), func(i int) bool {
+		return lt[i].Address >= addr
+	})
+	if i < len(lt) && lt[i].Address == addr {
+		return lt[i], true
+	}
+	return SourceLocation{}, false
+}
+
+// Returns the address of the first instruction at given row
+// of a file, using match to compare the file names.
+// The second return value is false if the row has no instructions.
+func (lt LineTable) AddressOf(row int, match func(file string) bool) (InstAddr, bool) {
+	for _, loc := range lt {
+		if loc.Row == row && match(loc.File) {
+			return loc.Address, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,36 @@
+package coppervm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testLineTable = LineTable{
+	{Address: 0, File: "main.casm", Row: 3, Col: 5},
+	{Address: 1, File: "main.casm", Row: 4, Col: 5},
+	{Address: 2, File: "stdlib/lib.casm", Row: 10, Col: 1},
+	{Address: 3, File: "main.casm", Row: 4, Col: 9},
+}
+
+func TestLineTableLookup(t *testing.T) {
+	loc, ok := testLineTable.Lookup(2)
+	assert.True(t, ok)
+	assert.Equal(t, "stdlib/lib.casm:10:1", loc.String())
+
+	_, ok = testLineTable.Lookup(4)
+	assert.False(t, ok)
+	_, ok = LineTable{}.Lookup(0)
+	assert.False(t, ok)
+}
+
+func TestLineTableAddressOf(t *testing.T) {
+	isMain := func(file string) bool { return file == "main.casm" }
+
+	addr, ok := testLineTable.AddressOf(4, isMain)
+	assert.True(t, ok)
+	assert.Equal(t, InstAddr(1), addr)
+
+	_, ok = testLineTable.AddressOf(10, isMain)
+	assert.False(t, ok)
+}
@@ -0,0 +1,29 @@
+package coppervm
+
+// State used in place of a zero seed, since xorshift
+// generators never leave the zero state.
+const RandomZeroSeed uint64 = 0x9e3779b97f4a7c15
+
+// Pseudo-random number generator implementing the
+// xorshift64* algorithm.
+// The same algorithm is used by the x86-64 backend, so
+// a program produces the same numbers on both targets.
+type xorshift64 struct {
+	state uint64
+}
+
+// Set the state of the generator from a seed.
+func (r *xorshift64) seed(seed uint64) {
+	if seed == 0 {
+		seed = RandomZeroSeed
+	}
+	r.state = seed
+}
+
+// Returns the next pseudo-random number.
+func (r *xorshift64) next() uint64 {
+	r.state ^= r.state >> 12
+	r.state ^= r.state << 25
+	r.state ^= r.state >> 27
+	return r.state * 0x2545f4914f6cdd1d
+}
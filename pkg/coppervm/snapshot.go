@@ -0,0 +1,428 @@
+package coppervm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"time"
+)
+
+// Layout of a snapshot of the vm state (all values are big-endian):
+//
+//	magic             4 bytes  "CPSN"
+//	version           u16
+//	program size      u64      number of instructions
+//	program checksum  u32      crc32 of the instructions
+//	ip                u64
+//	halt              u8
+//	exit code         i64
+//	shared stack      u8
+//	stack             u64 size followed by size words of:
+//	                    u64, i64 and f64 bits  u64 each
+//	call stack        u64 size followed by size u64 addresses
+//	memory            u64 size followed by size bytes
+//	heap start        u64
+//	memory break      u64
+//	random state      u64
+//	virtual clock     u8 1 if the vm uses a VirtualClock, followed by:
+//	                    start    i64  unix time in nanoseconds
+//	                    elapsed  i64  nanoseconds
+//	file descriptors  u32 count followed by count entries of:
+//	                    kind     u8   0: closed, 1: standard stream, 2: file
+//	                  and for the files:
+//	                    length   u16
+//	                    name     length bytes
+//	                    flag     i64  flags of os.OpenFile
+//	                    offset   i64
+//	trap handlers     u32 count followed by count entries of:
+//	                    kind     i64  error kind or -1 for the catch-all
+//	                    address  u64
+//	try stack         u64 size followed by size frames of:
+//	                    handler          u64
+//	                    stack size       u64
+//	                    call stack size  u64
+//
+// Snapshots of version 1 end after the file descriptors and the
+// ones of version 2 after the trap handlers.
+const (
+	CoppervmSnapshotMagic   string = "CPSN"
+	CoppervmSnapshotVersion int    = 3
+)
+
+const (
+	snapshotFdClosed byte = iota
+	snapshotFdStream
+	snapshotFdFile
+)
+
+// A file descriptor of a snapshot.
+type snapshotFd struct {
+	kind   byte
+	name   string
+	flag   int
+	offset int64
+}
+
+// Write the state of the vm to w: stack, call stack, memory,
+// ip, halt flag, exit code, random numbers, the open file
+// descriptors with their offsets, the trap handlers and the
+// try frames.
+// The program is not part of the snapshot, so it must be loaded
+// again before calling Restore; the hooks, the streams, the
+// filesystem and the remaining gas are also left out.
+// Programs that spawned threads or created channels can't be
+// saved.
+func (vm *Coppervm) Snapshot(w io.Writer) error {
+	if vm.threads != nil || vm.channels != nil {
+		return fmt.Errorf("snapshots of programs with threads or channels are not supported")
+	}
+
+	var out bytes.Buffer
+	write := func(v interface{}) {
+		binary.Write(&out, binary.BigEndian, v)
+	}
+
+	out.WriteString(CoppervmSnapshotMagic)
+	write(uint16(CoppervmSnapshotVersion))
+	write(uint64(len(vm.Program)))
+	write(programChecksum(vm.Program))
+	write(uint64(vm.Ip))
+	write(vm.Halt)
+	write(int64(vm.ExitCode))
+	write(vm.sharedCallStack)
+
+	write(uint64(vm.StackSize))
+	for _, word := range vm.Stack[:vm.StackSize] {
+		write(word.AsU64)
+		write(word.AsI64)
+		write(math.Float64bits(word.AsF64))
+	}
+	write(uint64(vm.CallStackSize))
+	for _, addr := range vm.CallStack[:vm.CallStackSize] {
+		write(uint64(addr))
+	}
+
+	write(uint64(len(vm.Memory)))
+	vm.lockSharedMemory()
+	out.Write(vm.Memory)
+	vm.unlockSharedMemory()
+	write(vm.heapStart)
+	write(vm.memoryBreak)
+	write(vm.random.state)
+
+	if clock, ok := vm.clock.(*VirtualClock); ok {
+		write(true)
+		write(clock.start.UnixNano())
+		write(int64(clock.elapsed))
+	} else {
+		write(false)
+	}
+
+	write(uint32(len(vm.FDs)))
+	for fd, file := range vm.FDs {
+		switch f := file.(type) {
+		case nil:
+			write(snapshotFdClosed)
+		case *openedFile:
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return fmt.Errorf("cannot get the offset of file descriptor %d: %s", fd, err)
+			}
+			if len(f.name) > math.MaxUint16 {
+				return fmt.Errorf("file name '%s' is too long", f.name)
+			}
+			write(snapshotFdFile)
+			write(uint16(len(f.name)))
+			out.WriteString(f.name)
+			write(int64(f.flag))
+			write(offset)
+		default:
+			write(snapshotFdStream)
+		}
+	}
+
+	kinds := make([]int, 0, len(vm.traps))
+	for kind := range vm.traps {
+		kinds = append(kinds, int(kind))
+	}
+	sort.Ints(kinds)
+	write(uint32(len(kinds)))
+	for _, kind := range kinds {
+		write(int64(kind))
+		write(uint64(vm.traps[CoppervmErrorKind(kind)]))
+	}
+
+	write(uint64(vm.tryStackSize))
+	for _, frame := range vm.tryStack[:vm.tryStackSize] {
+		write(uint64(frame.handler))
+		write(uint64(frame.stackSize))
+		write(uint64(frame.callStackSize))
+	}
+
+	_, err := w.Write(out.Bytes())
+	return err
+}
+
+// Restore the state of the vm from a snapshot written by Snapshot.
+// The program loaded in the vm must be the one of the snapshot and
+// the capacities of stack, call stack and memory must fit its state.
+// The files are opened again from the filesystem of the vm and
+// moved to their offsets; the standard streams are the ones of the
+// vm. If an error is returned the vm is left unchanged.
+func (vm *Coppervm) Restore(r io.Reader) error {
+	vm.ensureDefaults()
+	sr := snapshotReader{r: r}
+
+	magic := make([]byte, len(CoppervmSnapshotMagic))
+	sr.read(magic)
+	if sr.err != nil || string(magic) != CoppervmSnapshotMagic {
+		return fmt.Errorf("missing snapshot header")
+	}
+	var version uint16
+	sr.read(&version)
+	if sr.err == nil && (version < 1 || int(version) > CoppervmSnapshotVersion) {
+		return fmt.Errorf("unsupported snapshot version %d", version)
+	}
+	var programSize uint64
+	var checksum uint32
+	sr.read(&programSize)
+	sr.read(&checksum)
+	if sr.err == nil && (programSize != uint64(len(vm.Program)) || checksum != programChecksum(vm.Program)) {
+		return fmt.Errorf("the snapshot is of a different program")
+	}
+
+	var ip uint64
+	var halt, sharedCallStack bool
+	var exitCode int64
+	sr.read(&ip)
+	sr.read(&halt)
+	sr.read(&exitCode)
+	sr.read(&sharedCallStack)
+
+	stackSize := sr.size(uint64(len(vm.Stack)), "stack")
+	stack := make([]Word, stackSize)
+	for i := range stack {
+		var f64 uint64
+		sr.read(&stack[i].AsU64)
+		sr.read(&stack[i].AsI64)
+		sr.read(&f64)
+		stack[i].AsF64 = math.Float64frombits(f64)
+	}
+	callStackSize := sr.size(uint64(len(vm.CallStack)), "call stack")
+	callStack := make([]InstAddr, callStackSize)
+	for i := range callStack {
+		sr.read((*uint64)(&callStack[i]))
+	}
+
+	memory := make([]byte, sr.size(uint64(len(vm.Memory)), "memory"))
+	sr.read(memory)
+	var heapStart, memoryBreak, randomState uint64
+	sr.read(&heapStart)
+	sr.read(&memoryBreak)
+	sr.read(&randomState)
+
+	var hasClock bool
+	var clockStart, clockElapsed int64
+	sr.read(&hasClock)
+	if hasClock {
+		sr.read(&clockStart)
+		sr.read(&clockElapsed)
+	}
+
+	var fdCount uint32
+	sr.read(&fdCount)
+	var fds []snapshotFd
+	for i := uint32(0); i < fdCount && sr.err == nil; i++ {
+		var fd snapshotFd
+		sr.read(&fd.kind)
+		switch fd.kind {
+		case snapshotFdClosed:
+		case snapshotFdStream:
+			if i >= 3 {
+				sr.fail(fmt.Errorf("file descriptor %d is not a standard stream", i))
+			}
+		case snapshotFdFile:
+			var nameLen uint16
+			var flag int64
+			sr.read(&nameLen)
+			name := make([]byte, nameLen)
+			sr.read(name)
+			sr.read(&flag)
+			sr.read(&fd.offset)
+			fd.name, fd.flag = string(name), int(flag)
+		default:
+			sr.fail(fmt.Errorf("invalid kind %d of file descriptor %d", fd.kind, i))
+		}
+		fds = append(fds, fd)
+	}
+
+	var traps map[CoppervmErrorKind]InstAddr
+	if version >= 2 {
+		var trapCount uint32
+		sr.read(&trapCount)
+		for i := uint32(0); i < trapCount && sr.err == nil; i++ {
+			var kind int64
+			var handler uint64
+			sr.read(&kind)
+			sr.read(&handler)
+			if sr.err == nil && CoppervmErrorKind(kind) != TrapCatchAll && !CoppervmErrorKind(kind).Trappable() {
+				sr.fail(fmt.Errorf("invalid kind %d of trap handler", kind))
+			}
+			if traps == nil {
+				traps = map[CoppervmErrorKind]InstAddr{}
+			}
+			traps[CoppervmErrorKind(kind)] = InstAddr(handler)
+		}
+	}
+	var tryStack []tryFrame
+	if version >= 3 {
+		tryStack = make([]tryFrame, sr.size(uint64(len(vm.tryStack)), "try stack"))
+		for i := range tryStack {
+			var handler, stackSize, callStackSize uint64
+			sr.read(&handler)
+			sr.read(&stackSize)
+			sr.read(&callStackSize)
+			if sr.err == nil && (stackSize > uint64(len(vm.Stack)) || callStackSize > uint64(len(vm.CallStack))) {
+				sr.fail(fmt.Errorf("try frame %d exceeds the capacity of the stacks", i))
+			}
+			tryStack[i] = tryFrame{
+				handler:       InstAddr(handler),
+				stackSize:     int64(stackSize),
+				callStackSize: int64(callStackSize),
+			}
+		}
+	}
+	if sr.err != nil {
+		return fmt.Errorf("invalid snapshot: %s", sr.err)
+	}
+	if memoryBreak < heapStart || memoryBreak > uint64(len(vm.Memory)) {
+		return fmt.Errorf("invalid snapshot: program break %d outside the memory", memoryBreak)
+	}
+
+	files, err := vm.reopenFiles(fds)
+	if err != nil {
+		return err
+	}
+
+	// The snapshot is valid, replace the state of the vm
+	vm.stopThreads()
+	vm.Ip = InstAddr(ip)
+	vm.Halt = halt
+	vm.ExitCode = int(exitCode)
+	vm.sharedCallStack = sharedCallStack
+	vm.StackSize = int64(copy(vm.Stack, stack))
+	vm.CallStackSize = int64(copy(vm.CallStack, callStack))
+	vm.tryStackSize = int64(copy(vm.tryStack, tryStack))
+	vm.lockSharedMemory()
+	copy(vm.Memory, memory)
+	for i := len(memory); i < len(vm.Memory); i++ {
+		vm.Memory[i] = 0
+	}
+	vm.unlockSharedMemory()
+	vm.heapStart = heapStart
+	vm.memoryBreak = memoryBreak
+	vm.random.state = randomState
+	if clock, ok := vm.clock.(*VirtualClock); ok && hasClock {
+		clock.start = time.Unix(0, clockStart)
+		clock.elapsed = time.Duration(clockElapsed)
+	}
+	vm.closeFds()
+	vm.FDs = files
+	vm.traps = traps
+	vm.clearUndoLog()
+	return nil
+}
+
+// Returns the file descriptors of a snapshot opening again its
+// files; if a file can't be opened the ones already opened are
+// closed.
+func (vm *Coppervm) reopenFiles(fds []snapshotFd) ([]File, error) {
+	files := make([]File, len(fds))
+	closeAll := func() {
+		for i := 3; i < len(files); i++ {
+			if files[i] != nil {
+				files[i].Close()
+			}
+		}
+	}
+	streams := []File{
+		streamFile{reader: vm.stdin},
+		streamFile{writer: vm.stdout},
+		streamFile{writer: vm.stderr},
+	}
+
+	for i, fd := range fds {
+		switch fd.kind {
+		case snapshotFdStream:
+			files[i] = streams[i]
+		case snapshotFdFile:
+			// The file already exists and its content must stay
+			// the same, so it's not created or truncated again
+			flag := fd.flag &^ (os.O_CREATE | os.O_EXCL | os.O_TRUNC)
+			file, err := vm.fs.OpenFile(fd.name, flag, 0)
+			if err == nil {
+				_, err = file.Seek(fd.offset, io.SeekStart)
+				if err != nil {
+					file.Close()
+				}
+			}
+			if err != nil {
+				closeAll()
+				return nil, fmt.Errorf("cannot restore file descriptor %d: %s", i, err)
+			}
+			files[i] = &openedFile{File: file, name: fd.name, flag: fd.flag}
+		}
+	}
+	return files, nil
+}
+
+// Reader of the values of a snapshot that keeps the first error.
+type snapshotReader struct {
+	r   io.Reader
+	err error
+}
+
+func (sr *snapshotReader) read(v interface{}) {
+	if sr.err == nil {
+		sr.err = binary.Read(sr.r, binary.BigEndian, v)
+	}
+}
+
+func (sr *snapshotReader) fail(err error) {
+	if sr.err == nil {
+		sr.err = err
+	}
+}
+
+// Read the size of a part of the snapshot, that can't exceed
+// the capacity of the vm.
+func (sr *snapshotReader) size(capacity uint64, name string) uint64 {
+	var size uint64
+	sr.read(&size)
+	if sr.err == nil && size > capacity {
+		sr.fail(fmt.Errorf("%s of size %d exceeds the capacity of %d", name, size, capacity))
+	}
+	if sr.err != nil {
+		return 0
+	}
+	return size
+}
+
+// Returns a checksum of the instructions of a program, used to
+// check a snapshot is restored in the same program.
+func programChecksum(program []InstDef) uint32 {
+	hash := crc32.NewIEEE()
+	var buf [17]byte
+	for _, inst := range program {
+		buf[0] = byte(inst.Kind)
+		binary.BigEndian.PutUint64(buf[1:9], inst.Operand.AsU64)
+		binary.BigEndian.PutUint64(buf[9:17], math.Float64bits(inst.Operand.AsF64))
+		hash.Write(buf[:])
+	}
+	return hash.Sum32()
+}
@@ -0,0 +1,121 @@
+package coppervm
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Reads a file in two parts and draws random numbers
+// before and after the snapshot.
+func snapshotTestProgram() CoppervmFileMeta {
+	syscall := func(sysCall SysCall) InstDef {
+		return InstDef{Kind: InstSyscall, Operand: WordU64(uint64(sysCall))}
+	}
+	read := func(buf uint64) []InstDef {
+		return []InstDef{
+			{Kind: InstDup},
+			{Kind: InstPush, Operand: WordU64(buf)},
+			{Kind: InstPush, Operand: WordU64(2)},
+			syscall(SysCallRead),
+			{Kind: InstDrop},
+		}
+	}
+	program := []InstDef{
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstPush, Operand: WordI64(OpenFlagReadOnly)},
+		{Kind: InstPush, Operand: WordU64(0)},
+		syscall(SysCallOpen),
+		{Kind: InstFunCall, Operand: WordU64(13)},
+	}
+	program = append(program, read(8)...)
+	program = append(program, syscall(SysCallRand), syscall(SysCallTime), InstDef{Kind: InstHalt})
+	// Function at 13
+	program = append(program, syscall(SysCallRand), InstDef{Kind: InstDrop})
+	program = append(program, read(10)...)
+	program = append(program,
+		InstDef{Kind: InstPush, Operand: WordU64(1)},
+		syscall(SysCallSleep),
+		InstDef{Kind: InstDrop},
+		InstDef{Kind: InstFunReturn})
+	return FileMeta(0, program, []byte("in.txt\x00"), DebugSymbols{})
+}
+
+func newSnapshotTestVm(fs FileSystem) *Coppervm {
+	vm := NewCoppervm(
+		WithFileSystem(fs),
+		WithRandomSeed(42),
+		WithClock(NewVirtualClock(time.Unix(100, 0))),
+		WithMemoryCapacity(16),
+	)
+	vm.loadProgramFromMeta(snapshotTestProgram())
+	return vm
+}
+
+func TestSnapshotRestore(t *testing.T) {
+	fs := NewMemFileSystem()
+	fs.WriteFile("in.txt", []byte("abcdef"))
+
+	// Stop inside the function, after the first read
+	vm := newSnapshotTestVm(fs)
+	assert.NoError(t, vm.ExecuteProgram(12))
+	var snapshot bytes.Buffer
+	assert.NoError(t, vm.Snapshot(&snapshot))
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	assert.Equal(t, "cdab", string(vm.Memory[8:12]))
+
+	restored := newSnapshotTestVm(fs)
+	assert.NoError(t, restored.Restore(bytes.NewReader(snapshot.Bytes())))
+	assert.Equal(t, InstAddr(20), restored.Ip)
+	assert.Equal(t, int64(1), restored.CallStackSize)
+	assert.Len(t, restored.FDs, 4)
+	assert.NoError(t, restored.ExecuteProgram(-1))
+
+	assert.True(t, restored.Halt)
+	assert.Equal(t, vm.Memory, restored.Memory)
+	assert.Equal(t, vm.Stack[:vm.StackSize], restored.Stack[:restored.StackSize])
+	assert.Equal(t, vm.CallStackSize, restored.CallStackSize)
+}
+
+func TestRestoreErrors(t *testing.T) {
+	fs := NewMemFileSystem()
+	fs.WriteFile("in.txt", []byte("abcdef"))
+	vm := newSnapshotTestVm(fs)
+	assert.NoError(t, vm.ExecuteProgram(12))
+	var snapshot bytes.Buffer
+	assert.NoError(t, vm.Snapshot(&snapshot))
+	data := snapshot.Bytes()
+
+	wrongVersion := append([]byte{}, data...)
+	wrongVersion[5] = 0xff
+
+	tests := [][]byte{
+		{},
+		[]byte("XXXX"),
+		wrongVersion,
+		data[:len(data)-1],
+	}
+	for _, test := range tests {
+		restored := newSnapshotTestVm(fs)
+		assert.Error(t, restored.Restore(bytes.NewReader(test)))
+		assert.Equal(t, InstAddr(0), restored.Ip)
+	}
+
+	// Different program
+	restored := newSnapshotTestVm(fs)
+	restored.Program = restored.Program[1:]
+	assert.Error(t, restored.Restore(bytes.NewReader(data)))
+
+	// Memory too small
+	restored = NewCoppervm(WithFileSystem(fs), WithMemoryCapacity(8))
+	restored.loadProgramFromMeta(snapshotTestProgram())
+	assert.Error(t, restored.Restore(bytes.NewReader(data)))
+
+	// The file doesn't exist anymore
+	restored = newSnapshotTestVm(NewMemFileSystem())
+	assert.Error(t, restored.Restore(bytes.NewReader(data)))
+	assert.Len(t, restored.FDs, 3)
+	assert.Equal(t, InstAddr(0), restored.Ip)
+}
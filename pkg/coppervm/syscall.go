@@ -1,5 +1,13 @@
 package coppervm
 
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"strconv"
+	"time"
+)
+
 // Represent a system call on the VM
 type SysCall int
 
@@ -10,4 +18,672 @@ const (
 	SysCallClose
 	SysCallSeek
 	SysCallExit
+	SysCallBrk
+	SysCallSbrk
+	SysCallStat
+	SysCallUnlink
+	SysCallRename
+	SysCallMkdir
+	SysCallReaddir
+	SysCallArgc
+	SysCallArgv
+	SysCallGetenv
+	SysCallTime
+	SysCallMonotonic
+	SysCallSleep
+	SysCallSeed
+	SysCallRand
+	SysCallSpawn
+	SysCallYield
+	SysCallJoin
+	SysCallThreadExit
+	SysCallChan
+	SysCallSend
+	SysCallRecv
+	SysCallChanClose
+	SysCallTrap
+)
+
+var sysCallNames = [...]string{
+	"read",
+	"write",
+	"open",
+	"close",
+	"seek",
+	"exit",
+	"brk",
+	"sbrk",
+	"stat",
+	"unlink",
+	"rename",
+	"mkdir",
+	"readdir",
+	"argc",
+	"argv",
+	"getenv",
+	"time",
+	"monotonic",
+	"sleep",
+	"seed",
+	"rand",
+	"spawn",
+	"yield",
+	"join",
+	"thread_exit",
+	"chan",
+	"send",
+	"recv",
+	"chan_close",
+	"trap",
+}
+
+// Returns the name of the system call, or its number if
+// it's not one of the default ones.
+func (sysCall SysCall) String() string {
+	if sysCall >= 0 && int(sysCall) < len(sysCallNames) {
+		return sysCallNames[sysCall]
+	}
+	return strconv.Itoa(int(sysCall))
+}
+
+// Size in bytes of the buffer filled by the stat system call.
+// The buffer contains four 64 bit big-endian values:
+// file size, permission bits, modification time as Unix
+// seconds and 1 if the file is a directory or 0 otherwise.
+const StatBufferSize uint64 = 32
+
+// Flags of the open system call.
+// The values match the Linux ones, so the x86-64
+// backend can pass them to the kernel unchanged.
+const (
+	OpenFlagReadOnly  int64 = 0x0
+	OpenFlagWriteOnly int64 = 0x1
+	OpenFlagReadWrite int64 = 0x2
+	OpenFlagCreate    int64 = 0x40
+	OpenFlagExclusive int64 = 0x80
+	OpenFlagTruncate  int64 = 0x200
+	OpenFlagAppend    int64 = 0x400
+
+	openFlagAccessMask int64 = 0x3
+	openFlagsMask      int64 = openFlagAccessMask | OpenFlagCreate |
+		OpenFlagExclusive | OpenFlagTruncate | OpenFlagAppend
 )
+
+// Interface implemented by the handlers of a system call.
+// A handler takes its arguments from the stack and leaves its
+// results there; when it returns nil the vm moves to the
+// next instruction, unless the handler has halted it.
+type SyscallHandler interface {
+	HandleSyscall(vm *Coppervm) error
+}
+
+// Adapter to use an ordinary function as a SyscallHandler.
+type SyscallHandlerFunc func(vm *Coppervm) error
+
+func (f SyscallHandlerFunc) HandleSyscall(vm *Coppervm) error {
+	return f(vm)
+}
+
+// Table of the system calls available to a vm.
+type SyscallTable map[SysCall]SyscallHandler
+
+// Returns a new SyscallTable with the default system calls.
+func DefaultSyscallTable() SyscallTable {
+	return SyscallTable{
+		SysCallRead:       SyscallHandlerFunc(sysCallRead),
+		SysCallWrite:      SyscallHandlerFunc(sysCallWrite),
+		SysCallOpen:       SyscallHandlerFunc(sysCallOpen),
+		SysCallClose:      SyscallHandlerFunc(sysCallClose),
+		SysCallSeek:       SyscallHandlerFunc(sysCallSeek),
+		SysCallExit:       SyscallHandlerFunc(sysCallExit),
+		SysCallBrk:        SyscallHandlerFunc(sysCallBrk),
+		SysCallSbrk:       SyscallHandlerFunc(sysCallSbrk),
+		SysCallStat:       SyscallHandlerFunc(sysCallStat),
+		SysCallUnlink:     SyscallHandlerFunc(sysCallUnlink),
+		SysCallRename:     SyscallHandlerFunc(sysCallRename),
+		SysCallMkdir:      SyscallHandlerFunc(sysCallMkdir),
+		SysCallReaddir:    SyscallHandlerFunc(sysCallReaddir),
+		SysCallArgc:       SyscallHandlerFunc(sysCallArgc),
+		SysCallArgv:       SyscallHandlerFunc(sysCallArgv),
+		SysCallGetenv:     SyscallHandlerFunc(sysCallGetenv),
+		SysCallTime:       SyscallHandlerFunc(sysCallTime),
+		SysCallMonotonic:  SyscallHandlerFunc(sysCallMonotonic),
+		SysCallSleep:      SyscallHandlerFunc(sysCallSleep),
+		SysCallSeed:       SyscallHandlerFunc(sysCallSeed),
+		SysCallRand:       SyscallHandlerFunc(sysCallRand),
+		SysCallSpawn:      SyscallHandlerFunc(sysCallSpawn),
+		SysCallYield:      SyscallHandlerFunc(sysCallYield),
+		SysCallJoin:       SyscallHandlerFunc(sysCallJoin),
+		SysCallThreadExit: SyscallHandlerFunc(sysCallThreadExit),
+		SysCallChan:       SyscallHandlerFunc(sysCallChan),
+		SysCallSend:       SyscallHandlerFunc(sysCallSend),
+		SysCallRecv:       SyscallHandlerFunc(sysCallRecv),
+		SysCallChanClose:  SyscallHandlerFunc(sysCallChanClose),
+		SysCallTrap:       SyscallHandlerFunc(sysCallTrap),
+	}
+}
+
+// Reads count bytes from a file descriptor to a memory buffer.
+func sysCallRead(vm *Coppervm) error {
+	if vm.StackSize < 3 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get count and start
+	count := vm.Stack[vm.StackSize-1].AsU64
+	bufStart := vm.Stack[vm.StackSize-2].AsU64
+	if !vm.isValidMemoryRange(bufStart, count) {
+		return ErrorIllegalMemoryAccess(vm, bufStart)
+	}
+
+	// Get file descriptor
+	fd := vm.Stack[vm.StackSize-3].AsU64
+	file, ok := vm.getFile(fd)
+	if !ok {
+		vm.Stack[vm.StackSize-3] = WordI64(-1)
+	} else {
+		// Read form file
+		buf := make([]byte, count)
+		var readBytesCount int
+		var err error
+		if r, ok := file.(contextReader); ok {
+			ctx := vm.context()
+			readBytesCount, err = r.ReadContext(ctx, buf)
+			if err != nil && err == ctx.Err() {
+				// Nothing was read, the read is repeated
+				// when the execution is resumed
+				return ErrorCanceled(vm, err)
+			}
+		} else {
+			readBytesCount, err = file.Read(buf)
+		}
+		if err != nil {
+			vm.Stack[vm.StackSize-3] = WordI64(-1)
+		} else {
+			if len(vm.hooks) > 0 {
+				vm.hookMemoryWrite(bufStart, buf[:readBytesCount])
+			}
+			vm.lockSharedMemory()
+			copy(vm.Memory[bufStart:], buf[:readBytesCount])
+			vm.unlockSharedMemory()
+			vm.Stack[vm.StackSize-3] = WordU64(uint64(readBytesCount))
+		}
+	}
+	vm.StackSize -= 2
+	return nil
+}
+
+// Writes count bytes from a memory buffer to a file descriptor.
+func sysCallWrite(vm *Coppervm) error {
+	if vm.StackSize < 3 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get count and start
+	count := vm.Stack[vm.StackSize-1].AsU64
+	bufStart := vm.Stack[vm.StackSize-2].AsU64
+	if !vm.isValidMemoryRange(bufStart, count) {
+		return ErrorIllegalMemoryAccess(vm, bufStart)
+	}
+	if len(vm.hooks) > 0 {
+		vm.hookMemoryRead(bufStart, count)
+	}
+	buf := vm.Memory[bufStart : bufStart+count]
+	if vm.sharedMemory {
+		// The other vms can change the memory while it's
+		// written to the file
+		vm.memoryLock.Lock()
+		buf = append([]byte{}, buf...)
+		vm.memoryLock.Unlock()
+	}
+
+	// Get file descriptor
+	fd := vm.Stack[vm.StackSize-3].AsU64
+	file, ok := vm.getFile(fd)
+	if !ok {
+		vm.Stack[vm.StackSize-3] = WordI64(-1)
+	} else {
+		// Write to file
+		writtenBytesCount, err := file.Write(buf)
+		if err != nil {
+			vm.Stack[vm.StackSize-3] = WordI64(-1)
+		} else {
+			vm.Stack[vm.StackSize-3] = WordU64(uint64(writtenBytesCount))
+		}
+	}
+	vm.StackSize -= 2
+	return nil
+}
+
+// Opens the file with name stored in memory using
+// given open flags and permission mode.
+func sysCallOpen(vm *Coppervm) error {
+	if vm.StackSize < 3 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get flags and mode
+	mode := vm.Stack[vm.StackSize-1].AsU64
+	flags := vm.Stack[vm.StackSize-2].AsI64
+	// Get file name form memory
+	fileName, ok := vm.getMemoryString(vm.Stack[vm.StackSize-3].AsU64)
+	if !ok {
+		return ErrorIllegalMemoryAccess(vm, vm.Stack[vm.StackSize-3].AsU64)
+	}
+	// Open the file
+	osFlags, ok := openFlagsToOs(flags)
+	if !ok {
+		vm.Stack[vm.StackSize-3] = WordI64(-1)
+	} else {
+		fd, err := vm.fs.OpenFile(fileName, osFlags, os.FileMode(mode).Perm())
+		if err != nil {
+			vm.Stack[vm.StackSize-3] = WordI64(-1)
+		} else {
+			vm.Stack[vm.StackSize-3] = WordI64(int64(vm.addFile(&openedFile{
+				File: fd,
+				name: fileName,
+				flag: osFlags,
+			})))
+		}
+	}
+	vm.StackSize -= 2
+	return nil
+}
+
+// Converts the flags of the open system call to the
+// ones used by the os package.
+// The second return value is false if the flags are invalid.
+func openFlagsToOs(flags int64) (out int, ok bool) {
+	if flags&^openFlagsMask != 0 {
+		return 0, false
+	}
+	switch flags & openFlagAccessMask {
+	case OpenFlagReadOnly:
+		out = os.O_RDONLY
+	case OpenFlagWriteOnly:
+		out = os.O_WRONLY
+	case OpenFlagReadWrite:
+		out = os.O_RDWR
+	default:
+		return 0, false
+	}
+	if flags&OpenFlagCreate != 0 {
+		out |= os.O_CREATE
+	}
+	if flags&OpenFlagExclusive != 0 {
+		out |= os.O_EXCL
+	}
+	if flags&OpenFlagTruncate != 0 {
+		out |= os.O_TRUNC
+	}
+	if flags&OpenFlagAppend != 0 {
+		out |= os.O_APPEND
+	}
+	return out, true
+}
+
+// Closes a file descriptor.
+func sysCallClose(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get file descriptor
+	fd := vm.Stack[vm.StackSize-1].AsU64
+	file, ok := vm.getFile(fd)
+	if !ok {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+	} else {
+		// Close the file
+		err := file.Close()
+		if err != nil {
+			vm.Stack[vm.StackSize-1] = WordI64(-1)
+		} else {
+			vm.FDs[fd] = nil
+			vm.Stack[vm.StackSize-1] = WordU64(0)
+		}
+	}
+	return nil
+}
+
+// Sets the offset of a file descriptor.
+func sysCallSeek(vm *Coppervm) error {
+	if vm.StackSize < 3 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get offset and whence
+	whence := vm.Stack[vm.StackSize-1].AsI64
+	offset := vm.Stack[vm.StackSize-2].AsI64
+	// Get file descriptor
+	fd := vm.Stack[vm.StackSize-3].AsU64
+	file, ok := vm.getFile(fd)
+	if !ok {
+		vm.Stack[vm.StackSize-3] = WordI64(-1)
+	} else {
+		// Seek the file
+		newPosition, err := file.Seek(offset, int(whence))
+		if err != nil {
+			vm.Stack[vm.StackSize-3] = WordI64(-1)
+		} else {
+			vm.Stack[vm.StackSize-3] = WordI64(newPosition)
+		}
+	}
+	vm.StackSize -= 2
+	return nil
+}
+
+// Sets the program break to an address.
+func sysCallBrk(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Move the break to given address or
+	// return the current one if it's 0
+	newBreak := vm.Stack[vm.StackSize-1].AsU64
+	if newBreak != 0 && !vm.setMemoryBreak(newBreak) {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+	} else {
+		vm.Stack[vm.StackSize-1] = WordU64(vm.memoryBreak)
+	}
+	return nil
+}
+
+// Moves the program break by an increment.
+func sysCallSbrk(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Move the break by given increment and
+	// return the old one
+	increment := vm.Stack[vm.StackSize-1].AsI64
+	oldBreak := vm.memoryBreak
+	if !vm.setMemoryBreak(uint64(int64(oldBreak) + increment)) {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+	} else {
+		vm.Stack[vm.StackSize-1] = WordU64(oldBreak)
+	}
+	return nil
+}
+
+// Halts the vm with a status code.
+func sysCallExit(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	statusCode := vm.Stack[vm.StackSize-1]
+	vm.haltVm(int(statusCode.AsI64))
+	vm.StackSize--
+	return nil
+}
+
+// Writes the information of the file with name stored
+// in memory to a memory buffer of StatBufferSize bytes.
+func sysCallStat(vm *Coppervm) error {
+	if vm.StackSize < 2 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get buffer and file name
+	bufStart := vm.Stack[vm.StackSize-1].AsU64
+	if !vm.isValidMemoryRange(bufStart, StatBufferSize) {
+		return ErrorIllegalMemoryAccess(vm, bufStart)
+	}
+	fileName, ok := vm.getMemoryString(vm.Stack[vm.StackSize-2].AsU64)
+	if !ok {
+		return ErrorIllegalMemoryAccess(vm, vm.Stack[vm.StackSize-2].AsU64)
+	}
+	// Stat the file
+	info, err := vm.fs.Stat(fileName)
+	if err != nil {
+		vm.Stack[vm.StackSize-2] = WordI64(-1)
+	} else {
+		var isDir uint64
+		if info.IsDir() {
+			isDir = 1
+		}
+		var buf [StatBufferSize]byte
+		binary.BigEndian.PutUint64(buf[0:], uint64(info.Size()))
+		binary.BigEndian.PutUint64(buf[8:], uint64(info.Mode().Perm()))
+		binary.BigEndian.PutUint64(buf[16:], uint64(info.ModTime().Unix()))
+		binary.BigEndian.PutUint64(buf[24:], isDir)
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryWrite(bufStart, buf[:])
+		}
+		vm.lockSharedMemory()
+		copy(vm.Memory[bufStart:], buf[:])
+		vm.unlockSharedMemory()
+		vm.Stack[vm.StackSize-2] = WordU64(0)
+	}
+	vm.StackSize--
+	return nil
+}
+
+// Removes the file or empty directory with name stored in memory.
+func sysCallUnlink(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	fileName, ok := vm.getMemoryString(vm.Stack[vm.StackSize-1].AsU64)
+	if !ok {
+		return ErrorIllegalMemoryAccess(vm, vm.Stack[vm.StackSize-1].AsU64)
+	}
+	if err := vm.fs.Remove(fileName); err != nil {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+	} else {
+		vm.Stack[vm.StackSize-1] = WordU64(0)
+	}
+	return nil
+}
+
+// Renames the file with name stored in memory.
+func sysCallRename(vm *Coppervm) error {
+	if vm.StackSize < 2 {
+		return ErrorStackUnderflow(vm)
+	}
+	newName, ok := vm.getMemoryString(vm.Stack[vm.StackSize-1].AsU64)
+	if !ok {
+		return ErrorIllegalMemoryAccess(vm, vm.Stack[vm.StackSize-1].AsU64)
+	}
+	oldName, ok := vm.getMemoryString(vm.Stack[vm.StackSize-2].AsU64)
+	if !ok {
+		return ErrorIllegalMemoryAccess(vm, vm.Stack[vm.StackSize-2].AsU64)
+	}
+	if err := vm.fs.Rename(oldName, newName); err != nil {
+		vm.Stack[vm.StackSize-2] = WordI64(-1)
+	} else {
+		vm.Stack[vm.StackSize-2] = WordU64(0)
+	}
+	vm.StackSize--
+	return nil
+}
+
+// Creates a directory with name stored in memory.
+func sysCallMkdir(vm *Coppervm) error {
+	if vm.StackSize < 2 {
+		return ErrorStackUnderflow(vm)
+	}
+	mode := vm.Stack[vm.StackSize-1].AsU64
+	dirName, ok := vm.getMemoryString(vm.Stack[vm.StackSize-2].AsU64)
+	if !ok {
+		return ErrorIllegalMemoryAccess(vm, vm.Stack[vm.StackSize-2].AsU64)
+	}
+	if err := vm.fs.Mkdir(dirName, os.FileMode(mode).Perm()); err != nil {
+		vm.Stack[vm.StackSize-2] = WordI64(-1)
+	} else {
+		vm.Stack[vm.StackSize-2] = WordU64(0)
+	}
+	vm.StackSize--
+	return nil
+}
+
+// Writes the null-terminated names of the entries of the
+// directory with name stored in memory to a memory buffer.
+func sysCallReaddir(vm *Coppervm) error {
+	if vm.StackSize < 3 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get size, buffer and directory name
+	size := vm.Stack[vm.StackSize-1].AsU64
+	bufStart := vm.Stack[vm.StackSize-2].AsU64
+	if !vm.isValidMemoryRange(bufStart, size) {
+		return ErrorIllegalMemoryAccess(vm, bufStart)
+	}
+	dirName, ok := vm.getMemoryString(vm.Stack[vm.StackSize-3].AsU64)
+	if !ok {
+		return ErrorIllegalMemoryAccess(vm, vm.Stack[vm.StackSize-3].AsU64)
+	}
+	// Read the directory
+	names, err := vm.fs.ReadDir(dirName)
+	var entries []byte
+	for _, name := range names {
+		entries = append(entries, name...)
+		entries = append(entries, 0)
+	}
+	if err != nil || uint64(len(entries)) > size {
+		vm.Stack[vm.StackSize-3] = WordI64(-1)
+	} else {
+		if len(vm.hooks) > 0 {
+			vm.hookMemoryWrite(bufStart, entries)
+		}
+		vm.lockSharedMemory()
+		copy(vm.Memory[bufStart:], entries)
+		vm.unlockSharedMemory()
+		vm.Stack[vm.StackSize-3] = WordU64(uint64(len(entries)))
+	}
+	vm.StackSize -= 2
+	return nil
+}
+
+// Pushes the number of command-line arguments.
+func sysCallArgc(vm *Coppervm) error {
+	return vm.pushStack(WordU64(uint64(len(vm.args))))
+}
+
+// Writes a command-line argument to a memory buffer
+// as a null-terminated string.
+func sysCallArgv(vm *Coppervm) error {
+	if vm.StackSize < 3 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get size, buffer and index
+	size := vm.Stack[vm.StackSize-1].AsU64
+	bufStart := vm.Stack[vm.StackSize-2].AsU64
+	if !vm.isValidMemoryRange(bufStart, size) {
+		return ErrorIllegalMemoryAccess(vm, bufStart)
+	}
+	index := vm.Stack[vm.StackSize-3].AsU64
+	if index >= uint64(len(vm.args)) {
+		vm.Stack[vm.StackSize-3] = WordI64(-1)
+	} else {
+		vm.Stack[vm.StackSize-3] = vm.putMemoryString(bufStart, size, vm.args[index])
+	}
+	vm.StackSize -= 2
+	return nil
+}
+
+// Writes the value of the environment variable with name
+// stored in memory to a memory buffer as a null-terminated string.
+func sysCallGetenv(vm *Coppervm) error {
+	if vm.StackSize < 3 {
+		return ErrorStackUnderflow(vm)
+	}
+	// Get size, buffer and name
+	size := vm.Stack[vm.StackSize-1].AsU64
+	bufStart := vm.Stack[vm.StackSize-2].AsU64
+	if !vm.isValidMemoryRange(bufStart, size) {
+		return ErrorIllegalMemoryAccess(vm, bufStart)
+	}
+	name, ok := vm.getMemoryString(vm.Stack[vm.StackSize-3].AsU64)
+	if !ok {
+		return ErrorIllegalMemoryAccess(vm, vm.Stack[vm.StackSize-3].AsU64)
+	}
+	value, exist := vm.lookupEnv(name)
+	if !exist {
+		vm.Stack[vm.StackSize-3] = WordI64(-1)
+	} else {
+		vm.Stack[vm.StackSize-3] = vm.putMemoryString(bufStart, size, value)
+	}
+	vm.StackSize -= 2
+	return nil
+}
+
+// Pushes the wall-clock time in nanoseconds since the Unix epoch.
+func sysCallTime(vm *Coppervm) error {
+	return vm.pushStack(WordI64(vm.clock.Now().UnixNano()))
+}
+
+// Pushes the monotonic time in nanoseconds from an arbitrary origin.
+func sysCallMonotonic(vm *Coppervm) error {
+	return vm.pushStack(WordI64(int64(vm.clock.Monotonic())))
+}
+
+// Pauses the execution for a number of nanoseconds.
+func sysCallSleep(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	duration := vm.Stack[vm.StackSize-1].AsI64
+	if duration < 0 {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+	} else {
+		if sleeper, ok := vm.clock.(contextSleeper); ok {
+			ctx := vm.context()
+			if err := sleeper.SleepContext(ctx, time.Duration(duration)); err != nil {
+				return ErrorCanceled(vm, err)
+			}
+		} else {
+			vm.clock.Sleep(time.Duration(duration))
+		}
+		vm.Stack[vm.StackSize-1] = WordU64(0)
+	}
+	return nil
+}
+
+// Sets the seed of the pseudo-random numbers.
+func sysCallSeed(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	vm.random.seed(vm.Stack[vm.StackSize-1].AsU64)
+	vm.StackSize--
+	return nil
+}
+
+// Pushes the next pseudo-random number.
+func sysCallRand(vm *Coppervm) error {
+	return vm.pushStack(WordU64(vm.random.next()))
+}
+
+// Writes a null-terminated string to a memory buffer of
+// given size and returns its length or -1 if it doesn't fit.
+// The buffer must be a valid memory range.
+func (vm *Coppervm) putMemoryString(bufStart uint64, size uint64, str string) Word {
+	if uint64(len(str)) >= size {
+		return WordI64(-1)
+	}
+	if len(vm.hooks) > 0 {
+		vm.hookMemoryWrite(bufStart, append([]byte(str), 0))
+	}
+	vm.lockSharedMemory()
+	copy(vm.Memory[bufStart:], str)
+	vm.Memory[bufStart+uint64(len(str))] = 0
+	vm.unlockSharedMemory()
+	return WordU64(uint64(len(str)))
+}
+
+// Returns the null-terminated string stored in memory
+// starting at given address.
+// The second return value is false if the address is
+// outside the memory.
+func (vm *Coppervm) getMemoryString(addr uint64) (string, bool) {
+	if !vm.isValidMemoryRange(addr, 1) {
+		return "", false
+	}
+	vm.lockSharedMemory()
+	end := uint64(len(vm.Memory))
+	if idx := bytes.IndexByte(vm.Memory[addr:], 0); idx >= 0 {
+		// The terminator is read too
+		end = addr + uint64(idx) + 1
+	}
+	str := string(bytes.TrimSuffix(vm.Memory[addr:end], []byte{0}))
+	vm.unlockSharedMemory()
+	if len(vm.hooks) > 0 {
+		vm.hookMemoryRead(addr, end-addr)
+	}
+	return str, true
+}
@@ -0,0 +1,330 @@
+package coppervm
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultSyscallTable(t *testing.T) {
+	table := DefaultSyscallTable()
+	for _, sysCall := range []SysCall{
+		SysCallRead,
+		SysCallWrite,
+		SysCallOpen,
+		SysCallClose,
+		SysCallSeek,
+		SysCallExit,
+		SysCallBrk,
+		SysCallSbrk,
+		SysCallStat,
+		SysCallUnlink,
+		SysCallRename,
+		SysCallMkdir,
+		SysCallReaddir,
+		SysCallArgc,
+		SysCallArgv,
+		SysCallGetenv,
+		SysCallTime,
+		SysCallMonotonic,
+		SysCallSleep,
+		SysCallSeed,
+		SysCallRand,
+		SysCallSpawn,
+		SysCallYield,
+		SysCallJoin,
+		SysCallThreadExit,
+		SysCallChan,
+		SysCallSend,
+		SysCallRecv,
+		SysCallChanClose,
+		SysCallTrap,
+	} {
+		assert.Contains(t, table, sysCall)
+	}
+}
+
+func TestRegisterSyscall(t *testing.T) {
+	const sysCallAnswer SysCall = 100
+	answer := SyscallHandlerFunc(func(vm *Coppervm) error {
+		return vm.pushStack(WordI64(42))
+	})
+	program := []InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(sysCallAnswer))}}
+
+	// Unknown syscall
+	vm := NewCoppervm()
+	vm.Program = program
+	err := vm.ExecuteInstruction()
+	assert.ErrorIs(t, err, ErrorKindUnknownSyscall)
+	assert.Equal(t, InstAddr(0), vm.Ip)
+
+	// Registered with option
+	vm = NewCoppervm(WithSyscall(sysCallAnswer, answer))
+	vm.Program = program
+	err = vm.ExecuteInstruction()
+	assert.NoError(t, err)
+	assert.Equal(t, InstAddr(1), vm.Ip)
+	assert.Equal(t, int64(1), vm.StackSize)
+	assert.Equal(t, WordI64(42), vm.Stack[0])
+
+	// Registered with method
+	vm = NewCoppervm()
+	vm.RegisterSyscall(sysCallAnswer, answer)
+	vm.Program = program
+	err = vm.ExecuteInstruction()
+	assert.NoError(t, err)
+
+	// Replaced table
+	vm = NewCoppervm(WithSyscallTable(SyscallTable{sysCallAnswer: answer}))
+	vm.Program = []InstDef{{Kind: InstSyscall, Operand: WordU64(uint64(SysCallExit))}}
+	vm.Stack[0] = WordU64(0)
+	vm.StackSize = 1
+	err = vm.ExecuteInstruction()
+	assert.ErrorIs(t, err, ErrorKindUnknownSyscall)
+}
+
+func TestSysCallOpen(t *testing.T) {
+	fs := NewMemFileSystem()
+	fs.WriteFile("a.txt", []byte("a"))
+	open := func(name uint64, flags int64) []InstDef {
+		return []InstDef{
+			{Kind: InstPush, Operand: WordU64(name)},
+			{Kind: InstPush, Operand: WordI64(flags)},
+			{Kind: InstPush, Operand: WordU64(0644)},
+			{Kind: InstSyscall, Operand: WordU64(uint64(SysCallOpen))},
+		}
+	}
+	var program []InstDef
+	program = append(program, open(0, OpenFlagReadOnly)...)
+	program = append(program, open(6, OpenFlagReadWrite)...)
+	program = append(program, open(6, OpenFlagWriteOnly+OpenFlagCreate)...)
+	program = append(program, open(6, OpenFlagReadWrite+OpenFlagCreate+OpenFlagExclusive)...)
+	program = append(program, open(0, OpenFlagWriteOnly+OpenFlagAppend)...)
+	program = append(program, open(0, 0x3)...)
+	program = append(program, open(0, 0x1000)...)
+	program = append(program, InstDef{Kind: InstHalt})
+
+	vm := NewCoppervm(WithFileSystem(fs))
+	vm.loadProgramFromMeta(FileMeta(0, program, []byte("a.txt\x00b.txt\x00"), DebugSymbols{}))
+	err := vm.ExecuteProgram(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Word{
+		WordI64(3),
+		WordI64(-1),
+		WordI64(4),
+		WordI64(-1),
+		WordI64(5),
+		WordI64(-1),
+		WordI64(-1),
+	}, vm.Stack[:vm.StackSize])
+	_, exist := fs.ReadFile("b.txt")
+	assert.True(t, exist)
+
+	vm.Reset()
+	vm.Program = open(0, OpenFlagReadOnly)[2:]
+	err = vm.ExecuteProgram(-1)
+	assert.ErrorIs(t, err, ErrorKindStackUnderflow)
+}
+
+func TestFileMetadataSyscalls(t *testing.T) {
+	syscall := func(sysCall SysCall, args ...uint64) []InstDef {
+		var program []InstDef
+		for _, arg := range args {
+			program = append(program, InstDef{Kind: InstPush, Operand: WordU64(arg)})
+		}
+		return append(program, InstDef{Kind: InstSyscall, Operand: WordU64(uint64(sysCall))})
+	}
+	// Memory layout: names at 0, 6, 12 and buffer at 16
+	memory := []byte("a.txt\x00b.txt\x00dir\x00")
+	const buf = 16
+
+	tests := []struct {
+		program []InstDef
+		result  Word
+		check   func(t *testing.T, vm *Coppervm, fs *MemFileSystem)
+	}{
+		{syscall(SysCallStat, 0, buf), WordU64(0), func(t *testing.T, vm *Coppervm, fs *MemFileSystem) {
+			stat := vm.Memory[buf : buf+StatBufferSize]
+			assert.Equal(t, uint64(5), binary.BigEndian.Uint64(stat[0:]))
+			assert.Equal(t, uint64(0644), binary.BigEndian.Uint64(stat[8:]))
+			assert.NotZero(t, binary.BigEndian.Uint64(stat[16:]))
+			assert.Equal(t, uint64(0), binary.BigEndian.Uint64(stat[24:]))
+		}},
+		{syscall(SysCallStat, 12, buf), WordU64(0), func(t *testing.T, vm *Coppervm, fs *MemFileSystem) {
+			assert.Equal(t, uint64(1), binary.BigEndian.Uint64(vm.Memory[buf+24:]))
+		}},
+		{syscall(SysCallStat, 6, buf), WordI64(-1), nil},
+		{syscall(SysCallUnlink, 0), WordU64(0), func(t *testing.T, vm *Coppervm, fs *MemFileSystem) {
+			_, exist := fs.ReadFile("a.txt")
+			assert.False(t, exist)
+		}},
+		{syscall(SysCallUnlink, 12), WordI64(-1), nil},
+		{syscall(SysCallRename, 0, 6), WordU64(0), func(t *testing.T, vm *Coppervm, fs *MemFileSystem) {
+			data, exist := fs.ReadFile("b.txt")
+			assert.True(t, exist)
+			assert.Equal(t, "hello", string(data))
+		}},
+		{syscall(SysCallRename, 6, 0), WordI64(-1), nil},
+		{syscall(SysCallMkdir, 6, 0755), WordU64(0), func(t *testing.T, vm *Coppervm, fs *MemFileSystem) {
+			info, err := fs.Stat("b.txt")
+			assert.NoError(t, err)
+			assert.True(t, info.IsDir())
+		}},
+		{syscall(SysCallMkdir, 12, 0755), WordI64(-1), nil},
+		{syscall(SysCallReaddir, 12, buf, 16), WordU64(10), func(t *testing.T, vm *Coppervm, fs *MemFileSystem) {
+			assert.Equal(t, "c.txt\x00d\x00e\x00", string(vm.Memory[buf:buf+10]))
+		}},
+		{syscall(SysCallReaddir, 12, buf, 4), WordI64(-1), nil},
+		{syscall(SysCallReaddir, 0, buf, 16), WordI64(-1), nil},
+	}
+
+	for _, test := range tests {
+		fs := NewMemFileSystem()
+		fs.WriteFile("a.txt", []byte("hello"))
+		fs.WriteFile("dir/c.txt", []byte{})
+		fs.WriteFile("dir/e", []byte{})
+		fs.Mkdir("dir/d", 0755)
+
+		vm := NewCoppervm(WithFileSystem(fs))
+		vm.loadProgramFromMeta(FileMeta(0, test.program, memory, DebugSymbols{}))
+		err := vm.ExecuteProgram(len(test.program))
+		assert.NoError(t, err, test)
+		assert.Equal(t, int64(1), vm.StackSize, test)
+		assert.Equal(t, test.result, vm.Stack[0], test)
+		if test.check != nil {
+			test.check(t, vm, fs)
+		}
+	}
+}
+
+func TestArgsSyscalls(t *testing.T) {
+	syscall := func(sysCall SysCall, args ...uint64) []InstDef {
+		var program []InstDef
+		for _, arg := range args {
+			program = append(program, InstDef{Kind: InstPush, Operand: WordU64(arg)})
+		}
+		return append(program, InstDef{Kind: InstSyscall, Operand: WordU64(uint64(sysCall))})
+	}
+	// Memory layout: names at 0 and 5, buffer at 16
+	memory := []byte("HOME\x00USER\x00")
+	const buf = 16
+
+	tests := []struct {
+		program []InstDef
+		result  Word
+		out     string
+	}{
+		{syscall(SysCallArgc), WordU64(3), ""},
+		{syscall(SysCallArgv, 0, buf, 16), WordU64(8), "prog.cpr\x00"},
+		{syscall(SysCallArgv, 2, buf, 16), WordU64(0), "\x00"},
+		{syscall(SysCallArgv, 1, buf, 3), WordI64(-1), ""},
+		{syscall(SysCallArgv, 3, buf, 16), WordI64(-1), ""},
+		{syscall(SysCallGetenv, 0, buf, 16), WordU64(8), "/home/me\x00"},
+		{syscall(SysCallGetenv, 0, buf, 8), WordI64(-1), ""},
+		{syscall(SysCallGetenv, 5, buf, 16), WordI64(-1), ""},
+	}
+
+	for _, test := range tests {
+		vm := NewCoppervm(
+			WithArgs([]string{"prog.cpr", "a=1", ""}),
+			WithEnv([]string{"HOME=/home/me", "EMPTY="}),
+		)
+		vm.loadProgramFromMeta(FileMeta(0, test.program, memory, DebugSymbols{}))
+		err := vm.ExecuteProgram(len(test.program))
+		assert.NoError(t, err, test)
+		assert.Equal(t, int64(1), vm.StackSize, test)
+		assert.Equal(t, test.result, vm.Stack[0], test)
+		assert.Equal(t, test.out, string(vm.Memory[buf:buf+uint64(len(test.out))]), test)
+	}
+
+	// Default arguments and environment
+	os.Setenv("COPPERVM_TEST_ENV", "value")
+	defer os.Unsetenv("COPPERVM_TEST_ENV")
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallArgc))},
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstPush, Operand: WordU64(32)},
+		{Kind: InstPush, Operand: WordU64(16)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallGetenv))},
+	}, []byte("COPPERVM_TEST_ENV\x00"), DebugSymbols{}))
+	err := vm.ExecuteProgram(5)
+	assert.NoError(t, err)
+	assert.Equal(t, []Word{WordU64(0), WordU64(5)}, vm.Stack[:vm.StackSize])
+}
+
+func TestClockSyscalls(t *testing.T) {
+	start := time.Unix(100, 0)
+	vm := NewCoppervm(WithClock(NewVirtualClock(start)))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallTime))},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallMonotonic))},
+		{Kind: InstPush, Operand: WordI64(1500)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallSleep))},
+		{Kind: InstPush, Operand: WordI64(-1)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallSleep))},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallTime))},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallMonotonic))},
+		{Kind: InstHalt},
+	}, []byte{}, DebugSymbols{}))
+
+	err := vm.ExecuteProgram(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Word{
+		WordI64(start.UnixNano()),
+		WordI64(0),
+		WordU64(0),
+		WordI64(-1),
+		WordI64(start.UnixNano() + 1500),
+		WordI64(1500),
+	}, vm.Stack[:vm.StackSize])
+}
+
+func TestRandomSyscalls(t *testing.T) {
+	expected := []Word{
+		WordU64(0x56ce4ab7719ba3a0),
+		WordU64(0xc841eb53ebbb2dda),
+		WordU64(0xca466be0c9980276),
+	}
+	rand := InstDef{Kind: InstSyscall, Operand: WordU64(uint64(SysCallRand))}
+
+	// Seeded with option
+	vm := NewCoppervm(WithRandomSeed(42))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{rand, rand, rand}, []byte{}, DebugSymbols{}))
+	err := vm.ExecuteProgram(3)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, vm.Stack[:vm.StackSize])
+
+	// Reset restores the initial seed
+	vm.Reset()
+	err = vm.ExecuteProgram(3)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, vm.Stack[:vm.StackSize])
+
+	// Seeded with syscall
+	vm = NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Operand: WordU64(42)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallSeed))},
+		rand, rand, rand,
+	}, []byte{}, DebugSymbols{}))
+	err = vm.ExecuteProgram(5)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, vm.Stack[:vm.StackSize])
+
+	// Zero seed
+	vm = NewCoppervm(WithRandomSeed(0))
+	vm.Program = []InstDef{rand}
+	err = vm.ExecuteInstruction()
+	assert.NoError(t, err)
+	assert.NotEqual(t, WordU64(0), vm.Stack[0])
+}
+
+func TestSysCallString(t *testing.T) {
+	assert.Equal(t, "read", SysCallRead.String())
+	assert.Equal(t, "rand", SysCallRand.String())
+	assert.Equal(t, "42", SysCall(42).String())
+}
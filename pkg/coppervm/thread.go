@@ -0,0 +1,293 @@
+package coppervm
+
+// Number of instructions a thread executes before the
+// next one is scheduled.
+const CoppervmThreadTimeSlice int = 100
+
+// A thread of the program; the one that is running keeps its
+// state in the vm, the others save it here.
+// Every thread has its own stacks, so the exceptions don't
+// cross threads.
+// All the threads share the memory, the files and the channels.
+type thread struct {
+	stack         []Word
+	stackSize     int64
+	callStack     []InstAddr
+	callStackSize int64
+	tryStack      []tryFrame
+	tryStackSize  int64
+	ip            InstAddr
+
+	finished  bool
+	exitValue Word
+	// Reports whether the system call that blocked the thread
+	// can complete; nil if the thread is not blocked
+	wait func() bool
+}
+
+// A bounded queue of words between threads.
+type channel struct {
+	buf      []Word
+	capacity int
+	closed   bool
+}
+
+// Returns the id of the running thread; the first
+// thread of the program has id 0.
+func (vm *Coppervm) CurrentThread() uint64 {
+	return uint64(vm.currentThread)
+}
+
+// Turn the program into a multi-threaded one, where the
+// running thread is the first of the threads.
+func (vm *Coppervm) startThreads() {
+	if vm.threads == nil {
+		vm.threads = []*thread{{}}
+		vm.currentThread = 0
+		vm.timeSlice = CoppervmThreadTimeSlice
+	}
+}
+
+// Forget all the threads and the channels and go back to the
+// state of the first thread, that owns the stacks of the vm.
+func (vm *Coppervm) stopThreads() {
+	if vm.threads != nil {
+		vm.saveThread(vm.threads[vm.currentThread])
+		vm.loadThread(vm.threads[0])
+	}
+	vm.threads = nil
+	vm.currentThread = 0
+	vm.channels = nil
+	vm.switchThread = false
+	vm.blocked = false
+}
+
+func (vm *Coppervm) saveThread(t *thread) {
+	t.stack, t.stackSize = vm.Stack, vm.StackSize
+	t.callStack, t.callStackSize = vm.CallStack, vm.CallStackSize
+	t.tryStack, t.tryStackSize = vm.tryStack, vm.tryStackSize
+	t.ip = vm.Ip
+}
+
+func (vm *Coppervm) loadThread(t *thread) {
+	vm.Stack, vm.StackSize = t.stack, t.stackSize
+	vm.CallStack, vm.CallStackSize = t.callStack, t.callStackSize
+	vm.tryStack, vm.tryStackSize = t.tryStack, t.tryStackSize
+	vm.Ip = t.ip
+}
+
+// Block the running thread in the current system call until
+// wait returns true; then the system call is executed again.
+func (vm *Coppervm) blockThread(wait func() bool) {
+	vm.startThreads()
+	vm.threads[vm.currentThread].wait = wait
+	vm.blocked = true
+	vm.switchThread = true
+}
+
+// Count an executed instruction and switch to the next thread
+// at the end of the time slice or if the running one yields,
+// blocks or exits.
+func (vm *Coppervm) tickThread() error {
+	vm.timeSlice--
+	if vm.timeSlice > 0 && !vm.switchThread {
+		return nil
+	}
+	vm.switchThread = false
+	return vm.schedule()
+}
+
+// Switch to the next thread, in round-robin order, that is not
+// finished or blocked; the running thread is the last choice.
+// Return a *CoppervmError if all the threads are blocked.
+func (vm *Coppervm) schedule() error {
+	vm.saveThread(vm.threads[vm.currentThread])
+	for i := 1; i <= len(vm.threads); i++ {
+		idx := (vm.currentThread + i) % len(vm.threads)
+		t := vm.threads[idx]
+		if t.finished || (t.wait != nil && !t.wait()) {
+			continue
+		}
+		t.wait = nil
+		vm.currentThread = idx
+		vm.loadThread(t)
+		vm.timeSlice = CoppervmThreadTimeSlice
+		vm.blocked = false
+		return nil
+	}
+	return ErrorDeadlock(vm)
+}
+
+// Returns the channel with given id.
+// The second return value is false if the channel doesn't exist.
+func (vm *Coppervm) getChannel(id uint64) (*channel, bool) {
+	if id >= uint64(len(vm.channels)) {
+		return nil, false
+	}
+	return vm.channels[id], true
+}
+
+// Starts a new thread at the address on the stack, with the
+// argument on top of its stack, and pushes its id.
+func sysCallSpawn(vm *Coppervm) error {
+	if vm.StackSize < 2 {
+		return ErrorStackUnderflow(vm)
+	}
+	addr := vm.Stack[vm.StackSize-2].AsU64
+	arg := vm.Stack[vm.StackSize-1]
+
+	vm.startThreads()
+	t := &thread{
+		stack:     make([]Word, len(vm.Stack)),
+		stackSize: 1,
+		callStack: make([]InstAddr, len(vm.CallStack)),
+		tryStack:  make([]tryFrame, len(vm.tryStack)),
+		ip:        InstAddr(addr),
+	}
+	t.stack[0] = arg
+	vm.threads = append(vm.threads, t)
+
+	vm.StackSize--
+	vm.Stack[vm.StackSize-1] = WordU64(uint64(len(vm.threads) - 1))
+	return nil
+}
+
+// Ends the time slice of the running thread.
+func sysCallYield(vm *Coppervm) error {
+	if vm.threads != nil {
+		vm.switchThread = true
+	}
+	return nil
+}
+
+// Waits the end of a thread and pushes its exit value.
+func sysCallJoin(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	id := vm.Stack[vm.StackSize-1].AsU64
+	if id >= uint64(len(vm.threads)) || id == uint64(vm.currentThread) {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+		return nil
+	}
+	t := vm.threads[id]
+	if !t.finished {
+		vm.blockThread(func() bool {
+			return t.finished
+		})
+		return nil
+	}
+	vm.Stack[vm.StackSize-1] = t.exitValue
+	return nil
+}
+
+// Ends the running thread with the exit value on the stack.
+// The vm halts when all the threads are ended.
+func sysCallThreadExit(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	vm.StackSize--
+
+	vm.startThreads()
+	t := vm.threads[vm.currentThread]
+	t.finished = true
+	t.exitValue = vm.Stack[vm.StackSize]
+	for _, other := range vm.threads {
+		if !other.finished {
+			vm.switchThread = true
+			return nil
+		}
+	}
+	vm.haltVm(0)
+	return nil
+}
+
+// Creates a channel that holds up to the given number
+// of words and pushes its id.
+func sysCallChan(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	capacity := vm.Stack[vm.StackSize-1].AsI64
+	if capacity <= 0 {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+		return nil
+	}
+	vm.channels = append(vm.channels, &channel{capacity: int(capacity)})
+	vm.Stack[vm.StackSize-1] = WordU64(uint64(len(vm.channels) - 1))
+	return nil
+}
+
+// Sends a word to a channel, waiting while it's full.
+func sysCallSend(vm *Coppervm) error {
+	if vm.StackSize < 2 {
+		return ErrorStackUnderflow(vm)
+	}
+	ch, ok := vm.getChannel(vm.Stack[vm.StackSize-2].AsU64)
+	if ok && !ch.closed && len(ch.buf) >= ch.capacity {
+		vm.blockThread(func() bool {
+			return ch.closed || len(ch.buf) < ch.capacity
+		})
+		return nil
+	}
+
+	value := vm.Stack[vm.StackSize-1]
+	vm.StackSize--
+	if !ok || ch.closed {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+	} else {
+		ch.buf = append(ch.buf, value)
+		vm.Stack[vm.StackSize-1] = WordU64(0)
+	}
+	return nil
+}
+
+// Receives a word from a channel, waiting while it's empty.
+// Pushes the word and 1, or 0 and 0 if the channel is closed
+// and empty.
+func sysCallRecv(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	if vm.StackSize >= int64(len(vm.Stack)) {
+		return ErrorStackOverflow(vm)
+	}
+	ch, ok := vm.getChannel(vm.Stack[vm.StackSize-1].AsU64)
+	if ok && !ch.closed && len(ch.buf) == 0 {
+		vm.blockThread(func() bool {
+			return ch.closed || len(ch.buf) > 0
+		})
+		return nil
+	}
+
+	if !ok {
+		vm.Stack[vm.StackSize-1] = WordU64(0)
+		vm.Stack[vm.StackSize] = WordI64(-1)
+	} else if len(ch.buf) == 0 {
+		vm.Stack[vm.StackSize-1] = WordU64(0)
+		vm.Stack[vm.StackSize] = WordU64(0)
+	} else {
+		vm.Stack[vm.StackSize-1] = ch.buf[0]
+		vm.Stack[vm.StackSize] = WordU64(1)
+		ch.buf = ch.buf[1:]
+	}
+	vm.StackSize++
+	return nil
+}
+
+// Closes a channel; the words already sent can still be
+// received.
+func sysCallChanClose(vm *Coppervm) error {
+	if vm.StackSize < 1 {
+		return ErrorStackUnderflow(vm)
+	}
+	ch, ok := vm.getChannel(vm.Stack[vm.StackSize-1].AsU64)
+	if !ok || ch.closed {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+	} else {
+		ch.closed = true
+		vm.Stack[vm.StackSize-1] = WordU64(0)
+	}
+	return nil
+}
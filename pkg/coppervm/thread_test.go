@@ -0,0 +1,165 @@
+package coppervm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func threadSyscall(sysCall SysCall) InstDef {
+	return InstDef{Kind: InstSyscall, Name: "syscall", Operand: WordU64(uint64(sysCall))}
+}
+
+// The producer sends 1, 2, 3 on a channel of capacity 2 and
+// exits with 42; the main thread prints what it receives and
+// the exit value of the producer.
+var producerConsumerProgram = []InstDef{
+	{Kind: InstPush, Name: "push", Operand: WordU64(2)},
+	threadSyscall(SysCallChan),
+	{Kind: InstPush, Name: "push", Operand: WordU64(14)},
+	{Kind: InstOver, Name: "over", Operand: WordU64(1)},
+	threadSyscall(SysCallSpawn),
+	// Receive loop at 5
+	{Kind: InstOver, Name: "over", Operand: WordU64(1)},
+	threadSyscall(SysCallRecv),
+	{Kind: InstJmpZero, Name: "jz", Operand: WordU64(10)},
+	{Kind: InstPrint, Name: "print"},
+	{Kind: InstJmp, Name: "jmp", Operand: WordU64(5)},
+	{Kind: InstDrop, Name: "drop"},
+	threadSyscall(SysCallJoin),
+	{Kind: InstPrint, Name: "print"},
+	{Kind: InstHalt, Name: "halt"},
+	// Producer at 14
+	{Kind: InstDup, Name: "dup"},
+	{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+	threadSyscall(SysCallSend),
+	{Kind: InstDrop, Name: "drop"},
+	{Kind: InstDup, Name: "dup"},
+	{Kind: InstPush, Name: "push", Operand: WordU64(2)},
+	threadSyscall(SysCallSend),
+	{Kind: InstDrop, Name: "drop"},
+	{Kind: InstDup, Name: "dup"},
+	{Kind: InstPush, Name: "push", Operand: WordU64(3)},
+	threadSyscall(SysCallSend),
+	{Kind: InstDrop, Name: "drop"},
+	threadSyscall(SysCallChanClose),
+	{Kind: InstDrop, Name: "drop"},
+	{Kind: InstPush, Name: "push", Operand: WordU64(42)},
+	threadSyscall(SysCallThreadExit),
+}
+
+func TestThreadsChannel(t *testing.T) {
+	vm, output, err := runTestProgram(producerConsumerProgram, 10000)
+	assert.NoError(t, err)
+	assert.True(t, vm.Halt)
+	assert.Equal(t, printedWords(WordU64(1), WordU64(2), WordU64(3), WordU64(42)), output)
+
+	// Reset goes back to a single thread
+	vm.Reset()
+	assert.Nil(t, vm.threads)
+	assert.Nil(t, vm.channels)
+	assert.Equal(t, CoppervmStackCapacity, int64(len(vm.Stack)))
+	var second bytes.Buffer
+	vm.debugOutput = &second
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	assert.Equal(t, output, second.String())
+}
+
+func TestThreadsYield(t *testing.T) {
+	_, output, err := runTestProgram([]InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordU64(8)},
+		{Kind: InstPush, Name: "push", Operand: WordU64(7)},
+		threadSyscall(SysCallSpawn),
+		{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+		{Kind: InstPrint, Name: "print"},
+		threadSyscall(SysCallYield),
+		{Kind: InstPrint, Name: "print"},
+		{Kind: InstHalt, Name: "halt"},
+		// Thread at 8 prints its argument
+		{Kind: InstPrint, Name: "print"},
+		threadSyscall(SysCallYield),
+		{Kind: InstNoop, Name: "noop"},
+	}, 10000)
+	assert.NoError(t, err)
+	// The main thread prints its thread id last
+	assert.Equal(t, printedWords(WordU64(1), WordU64(7), WordU64(1)), output)
+}
+
+func TestThreadsTimeSlice(t *testing.T) {
+	// Two threads loop forever
+	vm, _, err := runTestProgram([]InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordU64(3)},
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		threadSyscall(SysCallSpawn),
+		{Kind: InstJmp, Name: "jmp", Operand: WordU64(3)},
+	}, 10000)
+	assert.NoError(t, err)
+	assert.False(t, vm.Halt)
+	assert.Len(t, vm.threads, 2)
+
+	// After one time slice, counted from the spawn, the
+	// other thread runs
+	vm.Reset()
+	assert.NoError(t, vm.ExecuteProgram(2+CoppervmThreadTimeSlice))
+	assert.Equal(t, uint64(1), vm.CurrentThread())
+	assert.NoError(t, vm.ExecuteProgram(CoppervmThreadTimeSlice))
+	assert.Equal(t, uint64(0), vm.CurrentThread())
+}
+
+func TestThreadsErrors(t *testing.T) {
+	// Nobody sends on the channel
+	vm, _, err := runTestProgram([]InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+		threadSyscall(SysCallChan),
+		threadSyscall(SysCallRecv),
+		{Kind: InstHalt, Name: "halt"},
+	}, 10000)
+	assert.ErrorIs(t, err, ErrorKindDeadlock)
+	assert.Equal(t, InstAddr(2), vm.Ip)
+
+	// Invalid arguments
+	vm, _, err = runTestProgram([]InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		threadSyscall(SysCallJoin),
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		threadSyscall(SysCallChan),
+		{Kind: InstPush, Name: "push", Operand: WordU64(5)},
+		threadSyscall(SysCallRecv),
+		{Kind: InstPush, Name: "push", Operand: WordU64(5)},
+		{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+		threadSyscall(SysCallSend),
+		{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+		threadSyscall(SysCallChan),
+		threadSyscall(SysCallChanClose),
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		threadSyscall(SysCallChanClose),
+		{Kind: InstHalt, Name: "halt"},
+	}, 10000)
+	assert.NoError(t, err)
+	assert.Equal(t, []Word{
+		WordI64(-1),
+		WordI64(-1),
+		WordU64(0), WordI64(-1),
+		WordI64(-1),
+		WordU64(0),
+		WordI64(-1),
+	}, vm.Stack[:vm.StackSize])
+
+	// The last thread to exit halts the vm
+	vm, _, err = runTestProgram([]InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		threadSyscall(SysCallThreadExit),
+	}, 10000)
+	assert.NoError(t, err)
+	assert.True(t, vm.Halt)
+}
+
+func TestThreadsSnapshot(t *testing.T) {
+	vm := NewCoppervm(WithDebugOutput(&bytes.Buffer{}))
+	vm.loadProgramFromMeta(FileMeta(0, producerConsumerProgram, []byte{}, DebugSymbols{}))
+	vm.EnableUndoLog(10)
+	assert.NoError(t, vm.ExecuteProgram(5))
+	assert.Error(t, vm.Snapshot(&bytes.Buffer{}))
+	assert.Equal(t, 0, vm.UndoLogSize())
+}
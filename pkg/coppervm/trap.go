@@ -0,0 +1,111 @@
+package coppervm
+
+// Kind of the trap handler that catches the faults of
+// every kind without an handler of their own.
+const TrapCatchAll CoppervmErrorKind = -1
+
+// Reports whether the errors of given kind are faults of the
+// program that can be caught by a trap handler; running out of
+// gas, cancellations and deadlocks always stop the execution.
+func (err CoppervmErrorKind) Trappable() bool {
+	switch err {
+	case ErrorKindIllegalInstAccess,
+		ErrorKindStackOverflow,
+		ErrorKindStackUnderflow,
+		ErrorKindDivideByZero,
+		ErrorKindIllegalMemoryAccess,
+		ErrorKindInvalidInstruction,
+		ErrorKindUnknownSyscall,
+		ErrorKindCallStackOverflow,
+		ErrorKindCallStackUnderflow,
+		ErrorKindTryStackOverflow,
+		ErrorKindTryStackUnderflow,
+		ErrorKindUncaughtException:
+		return true
+	}
+	return false
+}
+
+// Returns the address of the trap handler of given kind
+// of fault, or of the catch-all one.
+// The second return value is false if there is no handler.
+func (vm *Coppervm) trapHandler(kind CoppervmErrorKind) (InstAddr, bool) {
+	if handler, ok := vm.traps[kind]; ok {
+		return handler, true
+	}
+	handler, ok := vm.traps[TrapCatchAll]
+	return handler, ok
+}
+
+// Returns the trap handler that catches a fault of given kind
+// in the current state of the vm.
+// The second return value is false if there is no handler or
+// no room on the stack for the kind and the ip of the fault.
+func (vm *Coppervm) catchingTrapHandler(kind CoppervmErrorKind) (InstAddr, bool) {
+	if len(vm.traps) == 0 || !kind.Trappable() ||
+		vm.StackSize+2 > int64(len(vm.Stack)) {
+		return 0, false
+	}
+	return vm.trapHandler(kind)
+}
+
+// Catch a fault of the program with its trap handler: the kind
+// of the fault and the ip of the faulting instruction are pushed
+// on the stack and the execution continues from the handler.
+// Returns nil if the fault is caught, or err if there is no handler
+// or no room on the stack for the kind and the ip.
+func (vm *Coppervm) trap(err error) error {
+	fault, ok := err.(*CoppervmError)
+	if !ok {
+		return err
+	}
+	handler, ok := vm.catchingTrapHandler(fault.Kind)
+	if !ok {
+		// The state changed after the fault, that was expected
+		// to be caught when it was created
+		if fault.Backtrace == nil {
+			fault.addContext(vm)
+		}
+		return err
+	}
+
+	for _, h := range vm.hooks {
+		if trapHook, ok := h.(TrapHook); ok {
+			trapHook.Trap(vm, fault, handler)
+		}
+	}
+	vm.Stack[vm.StackSize] = WordI64(int64(fault.Kind))
+	vm.Stack[vm.StackSize+1] = WordU64(uint64(fault.CurrentIp))
+	vm.StackSize += 2
+	vm.Ip = handler
+	return nil
+}
+
+// Installs the handler at the address on the stack for the faults
+// of given kind, or TrapCatchAll; the handler -1 removes it.
+// Pushes 0 on success or -1 if the kind can't be caught or the
+// handler is outside the program.
+func sysCallTrap(vm *Coppervm) error {
+	if vm.StackSize < 2 {
+		return ErrorStackUnderflow(vm)
+	}
+	kind := CoppervmErrorKind(vm.Stack[vm.StackSize-2].AsI64)
+	handler := vm.Stack[vm.StackSize-1]
+	vm.StackSize--
+
+	if (kind != TrapCatchAll && !kind.Trappable()) ||
+		(handler.AsI64 != -1 && handler.AsU64 >= uint64(len(vm.Program))) {
+		vm.Stack[vm.StackSize-1] = WordI64(-1)
+		return nil
+	}
+	if handler.AsI64 == -1 {
+		delete(vm.traps, kind)
+	} else {
+		if vm.traps == nil {
+			vm.traps = map[CoppervmErrorKind]InstAddr{}
+		}
+		vm.traps[kind] = InstAddr(handler.AsU64)
+	}
+	vm.Stack[vm.StackSize-1] = WordU64(0)
+	return nil
+}
@@ -0,0 +1,247 @@
+package coppervm
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func trapSyscall() InstDef {
+	return InstDef{Kind: InstSyscall, Name: "syscall", Operand: WordU64(uint64(SysCallTrap))}
+}
+
+// Installs the handler at 8 for the faults of given kind and
+// divides by zero; the handler prints the kind and resumes
+// after the faulting instruction.
+func trapTestProgram(kind CoppervmErrorKind) []InstDef {
+	return []InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordI64(int64(kind))},
+		{Kind: InstPush, Name: "push", Operand: WordU64(8)},
+		trapSyscall(),
+		{Kind: InstDrop, Name: "drop"},
+		{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		{Kind: InstDivInt, Name: "div"},
+		{Kind: InstHalt, Name: "halt"},
+		// Handler at 8
+		{Kind: InstSwap, Name: "swap", Operand: WordU64(1)},
+		{Kind: InstPrint, Name: "print"},
+		{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+		{Kind: InstAddInt, Name: "add"},
+		{Kind: InstJmpIndirect, Name: "ijmp"},
+	}
+}
+
+func TestTrap(t *testing.T) {
+	for _, kind := range []CoppervmErrorKind{ErrorKindDivideByZero, TrapCatchAll} {
+		vm, output, err := runTestProgram(trapTestProgram(kind), 100)
+		assert.NoError(t, err)
+		assert.True(t, vm.Halt)
+		assert.Equal(t, InstAddr(7), vm.Ip)
+		assert.Equal(t, printedWords(WordI64(int64(ErrorKindDivideByZero))), output)
+		assert.Equal(t, []Word{WordU64(1), WordU64(0)}, vm.Stack[:vm.StackSize])
+	}
+
+	// The handler of another kind doesn't catch the fault
+	_, output, err := runTestProgram(trapTestProgram(ErrorKindStackUnderflow), 100)
+	assert.ErrorIs(t, err, ErrorKindDivideByZero)
+	assert.Empty(t, output)
+
+	// The handler of the kind is preferred to the catch-all
+	var debug bytes.Buffer
+	vm := NewCoppervm(WithDebugOutput(&debug))
+	vm.loadProgramFromMeta(FileMeta(4, trapTestProgram(ErrorKindDivideByZero), []byte{}, DebugSymbols{}))
+	vm.traps = map[CoppervmErrorKind]InstAddr{TrapCatchAll: 7, ErrorKindDivideByZero: 8}
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	assert.Equal(t, printedWords(WordI64(int64(ErrorKindDivideByZero))), debug.String())
+}
+
+func TestTrapRemove(t *testing.T) {
+	program := append([]InstDef{}, trapTestProgram(ErrorKindDivideByZero)[:4]...)
+	program = append(program, []InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordI64(int64(ErrorKindDivideByZero))},
+		{Kind: InstPush, Name: "push", Operand: WordI64(-1)},
+		trapSyscall(),
+		{Kind: InstDrop, Name: "drop"},
+		{Kind: InstPush, Name: "push", Operand: WordU64(1)},
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		{Kind: InstDivInt, Name: "div"},
+	}...)
+	_, _, err := runTestProgram(program, 100)
+	assert.ErrorIs(t, err, ErrorKindDivideByZero)
+}
+
+func TestTrapSyscallErrors(t *testing.T) {
+	tests := []struct {
+		kind    int64
+		handler Word
+		result  Word
+	}{
+		{int64(ErrorKindStackUnderflow), WordU64(0), WordU64(0)},
+		{int64(TrapCatchAll), WordI64(-1), WordU64(0)},
+		{int64(ErrorKindOutOfGas), WordU64(0), WordI64(-1)},
+		{int64(ErrorKindCanceled), WordU64(0), WordI64(-1)},
+		{int64(ErrorKindDeadlock), WordU64(0), WordI64(-1)},
+		{-2, WordU64(0), WordI64(-1)},
+		{100, WordU64(0), WordI64(-1)},
+		{int64(ErrorKindStackUnderflow), WordU64(3), WordI64(-1)},
+	}
+	for _, test := range tests {
+		vm, _, err := runTestProgram([]InstDef{
+			{Kind: InstPush, Name: "push", Operand: WordI64(test.kind)},
+			{Kind: InstPush, Name: "push", Operand: test.handler},
+			trapSyscall(),
+		}, 100)
+		assert.ErrorIs(t, err, ErrorKindIllegalInstAccess)
+		assert.Equal(t, []Word{test.result}, vm.Stack[:vm.StackSize])
+	}
+
+	_, _, err := runTestProgram([]InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		trapSyscall(),
+	}, 100)
+	assert.ErrorIs(t, err, ErrorKindStackUnderflow)
+}
+
+func TestTrapFaults(t *testing.T) {
+	catchAll := []InstDef{
+		{Kind: InstPush, Name: "push", Operand: WordI64(int64(TrapCatchAll))},
+		{Kind: InstPush, Name: "push", Operand: WordU64(4)},
+		trapSyscall(),
+		{Kind: InstJmp, Name: "jmp", Operand: WordU64(5)},
+		// Handler at 4
+		{Kind: InstHalt, Name: "halt"},
+	}
+
+	// Jump outside the program
+	vm, _, err := runTestProgram(append(catchAll,
+		InstDef{Kind: InstJmp, Name: "jmp", Operand: WordU64(100)}), 100)
+	assert.NoError(t, err)
+	assert.True(t, vm.Halt)
+	assert.Equal(t, []Word{WordU64(0), WordI64(int64(ErrorKindIllegalInstAccess)), WordU64(100)},
+		vm.Stack[:vm.StackSize])
+
+	// Illegal memory access
+	vm, _, err = runTestProgram(append(catchAll,
+		InstDef{Kind: InstPush, Name: "push", Operand: WordU64(uint64(CoppervmMemoryCapacity))},
+		InstDef{Kind: InstMemRead, Name: "read"}), 100)
+	assert.NoError(t, err)
+	assert.Equal(t, []Word{WordU64(0), WordU64(uint64(CoppervmMemoryCapacity)), WordI64(int64(ErrorKindIllegalMemoryAccess)), WordU64(6)},
+		vm.Stack[:vm.StackSize])
+
+	// No room on the stack for the kind and the ip
+	_, _, err = runTestProgram(append(catchAll,
+		InstDef{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		InstDef{Kind: InstPush, Name: "push", Operand: WordU64(0)},
+		InstDef{Kind: InstDivInt, Name: "div"}), 100, WithStackCapacity(3))
+	assert.ErrorIs(t, err, ErrorKindDivideByZero)
+
+	// Out of gas is never caught
+	_, _, err = runTestProgram(append(catchAll,
+		InstDef{Kind: InstJmp, Name: "jmp", Operand: WordU64(5)}), 100, WithGas(10, DefaultGasTable()))
+	assert.ErrorIs(t, err, ErrorKindOutOfGas)
+}
+
+func TestTrapReset(t *testing.T) {
+	vm, _, err := runTestProgram(trapTestProgram(ErrorKindDivideByZero), 100)
+	assert.NoError(t, err)
+	vm.Reset()
+	vm.Ip = 4
+	assert.ErrorIs(t, vm.ExecuteProgram(-1), ErrorKindDivideByZero)
+}
+
+func TestTrapStepBack(t *testing.T) {
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, trapTestProgram(ErrorKindDivideByZero), []byte{}, DebugSymbols{}))
+	vm.EnableUndoLog(10)
+	assert.NoError(t, vm.ExecuteProgram(7))
+	assert.Equal(t, InstAddr(8), vm.Ip)
+
+	// Revert the fault and the trap system call
+	_, ok := vm.StepBack()
+	assert.True(t, ok)
+	assert.Equal(t, InstAddr(6), vm.Ip)
+	assert.Equal(t, []Word{WordU64(1), WordU64(0)}, vm.Stack[:vm.StackSize])
+	for i := 0; i < 4; i++ {
+		vm.StepBack()
+	}
+	assert.Equal(t, InstAddr(2), vm.Ip)
+	assert.Empty(t, vm.traps)
+}
+
+func TestTrapSnapshot(t *testing.T) {
+	program := trapTestProgram(ErrorKindDivideByZero)
+	vm := NewCoppervm()
+	vm.loadProgramFromMeta(FileMeta(0, program, []byte{}, DebugSymbols{}))
+	assert.NoError(t, vm.ExecuteProgram(3))
+	var snapshot bytes.Buffer
+	assert.NoError(t, vm.Snapshot(&snapshot))
+
+	restored := NewCoppervm()
+	restored.loadProgramFromMeta(FileMeta(0, program, []byte{}, DebugSymbols{}))
+	assert.NoError(t, restored.Restore(bytes.NewReader(snapshot.Bytes())))
+	assert.Equal(t, map[CoppervmErrorKind]InstAddr{ErrorKindDivideByZero: 8}, restored.traps)
+
+	// Version 1 snapshots end before the trap handlers
+	// and the try stack
+	data := snapshot.Bytes()
+	data = append([]byte{}, data[:len(data)-4-16-8]...)
+	data[5] = 1
+	restored = NewCoppervm()
+	restored.loadProgramFromMeta(FileMeta(0, program, []byte{}, DebugSymbols{}))
+	assert.NoError(t, restored.Restore(bytes.NewReader(data)))
+	assert.Empty(t, restored.traps)
+}
+
+// Hook keeping the last fault caught by a trap handler.
+type faultHook struct {
+	NoopHook
+	fault *CoppervmError
+}
+
+func (h *faultHook) Trap(vm *Coppervm, fault *CoppervmError, handler InstAddr) {
+	h.fault = fault
+}
+
+func TestTrapErrorContext(t *testing.T) {
+	// The caught faults have no backtrace and stack
+	hook := &faultHook{}
+	_, _, err := runTestProgram(trapTestProgram(ErrorKindDivideByZero), 100, WithHook(hook))
+	assert.NoError(t, err)
+	assert.NotNil(t, hook.fault)
+	assert.Equal(t, ErrorKindDivideByZero, hook.fault.Kind)
+	assert.Equal(t, InstAddr(6), hook.fault.CurrentIp)
+	assert.Nil(t, hook.fault.Backtrace)
+	assert.Nil(t, hook.fault.Stack)
+
+	var fault *CoppervmError
+	_, _, err = runTestProgram(trapTestProgram(ErrorKindStackUnderflow), 100)
+	assert.True(t, errors.As(err, &fault))
+	assert.NotEmpty(t, fault.Backtrace)
+	assert.Equal(t, []Word{WordU64(1), WordU64(0)}, fault.Stack)
+
+	// The fault is not caught if the handler is removed after
+	// the fault is created
+	const sysCallFault SysCall = 100
+	removeTraps := SyscallHandlerFunc(func(vm *Coppervm) error {
+		err := ErrorDivideByZero(vm)
+		vm.traps = nil
+		return err
+	})
+	program := append(trapTestProgram(ErrorKindDivideByZero)[:4],
+		InstDef{Kind: InstSyscall, Operand: WordU64(uint64(sysCallFault))})
+	_, _, err = runTestProgram(program, 100, WithSyscall(sysCallFault, removeTraps))
+	assert.True(t, errors.As(err, &fault))
+	assert.Equal(t, ErrorKindDivideByZero, fault.Kind)
+	assert.NotEmpty(t, fault.Backtrace)
+}
+
+func TestTrapKindString(t *testing.T) {
+	assert.Equal(t, "ErrorDivideByZero", ErrorKindDivideByZero.String())
+	assert.Equal(t, "TrapCatchAll", TrapCatchAll.String())
+	assert.Equal(t, "CoppervmErrorKind(-2)", CoppervmErrorKind(-2).String())
+	assert.Equal(t, "CoppervmErrorKind(100)", fmt.Sprint(CoppervmErrorKind(100)))
+}
@@ -0,0 +1,315 @@
+package coppervm
+
+// System calls that only change the state of the vm, so they
+// are completely reverted by StepBack.
+var undoableSyscalls = map[SysCall]bool{
+	SysCallBrk:       true,
+	SysCallSbrk:      true,
+	SysCallStat:      true,
+	SysCallReaddir:   true,
+	SysCallArgc:      true,
+	SysCallArgv:      true,
+	SysCallGetenv:    true,
+	SysCallTime:      true,
+	SysCallMonotonic: true,
+	SysCallSeed:      true,
+	SysCallRand:      true,
+	SysCallTrap:      true,
+}
+
+// Instruction reverted by StepBack.
+type UndoneInstruction struct {
+	Ip   InstAddr
+	Inst InstDef
+	// The instruction had effects outside the vm that are
+	// not reverted, like the output of print and write or
+	// the changes to the files.
+	SideEffects bool
+}
+
+// Changes made by an executed instruction.
+type undoEntry struct {
+	UndoneInstruction
+
+	stackSize     int64
+	stack         []stackChange
+	callStackSize int64
+	// Return address overwritten by a call
+	callStackSlot InstAddr
+	tryStackSize  int64
+	// Frame overwritten by a try
+	tryStackSlot tryFrame
+	memory       []memoryChange
+	memoryBreak  uint64
+	random       uint64
+	halt         bool
+	exitCode     int
+	// Gas left after paying the instruction
+	gas uint64
+	// Trap handlers replaced by the trap system call
+	traps      map[CoppervmErrorKind]InstAddr
+	trapsSaved bool
+}
+
+type stackChange struct {
+	index int64
+	old   Word
+}
+
+type memoryChange struct {
+	addr uint64
+	old  []byte
+}
+
+// Number of entries allocated when the undo log is enabled;
+// the log grows up to its capacity as the instructions are
+// recorded.
+const undoLogInitialSize = 64
+
+// Deepest word below the top of the stack, before or after the
+// instruction, that an instruction other than swap or a syscall
+// can change.
+const undoStackReach = 3
+
+// Hook recording the changes of every instruction in a ring
+// buffer, so they can be reverted.
+type undoLog struct {
+	NoopHook
+
+	entries  []undoEntry
+	start    int
+	count    int
+	capacity int
+
+	// Copy of the stack as it was before the current
+	// instruction, used to find the changed words
+	shadow []Word
+	synced bool
+
+	current undoEntry
+}
+
+// Start recording the changes of the executed instructions, so
+// they can be reverted with StepBack.
+// Only the last capacity instructions are kept; the log starts
+// small and grows up to capacity as they're recorded.
+// Words and memory changed from outside the vm while recording,
+// instead of by the instructions, can't be reverted, and nothing
+// is recorded after the program spawns a thread or creates a
+// channel.
+func (vm *Coppervm) EnableUndoLog(capacity int) {
+	vm.DisableUndoLog()
+	if capacity <= 0 {
+		return
+	}
+	size := capacity
+	if size > undoLogInitialSize {
+		size = undoLogInitialSize
+	}
+	vm.undoLog = &undoLog{entries: make([]undoEntry, size), capacity: capacity}
+	vm.AddHook(vm.undoLog)
+}
+
+// Stop recording the changes of the instructions and
+// forget the recorded ones.
+func (vm *Coppervm) DisableUndoLog() {
+	if vm.undoLog == nil {
+		return
+	}
+	for i, h := range vm.hooks {
+		if h == Hook(vm.undoLog) {
+			vm.hooks = append(vm.hooks[:i], vm.hooks[i+1:]...)
+			break
+		}
+	}
+	vm.undoLog = nil
+}
+
+// Returns the number of instructions that can be reverted.
+func (vm *Coppervm) UndoLogSize() int {
+	if vm.undoLog == nil {
+		return 0
+	}
+	return vm.undoLog.count
+}
+
+// Revert the last instruction executed while the undo log was
+// enabled, restoring ip, stack, call stack, try frames, memory,
+// program break, random numbers, halt flag, exit code, gas and
+// trap handlers.
+// The effects outside the vm are not reverted: the output is not
+// taken back and the files, their offsets and the file descriptors
+// stay as they are; UndoneInstruction.SideEffects tells when the
+// instruction had such effects.
+// The second return value is false if there are no instructions
+// to revert.
+func (vm *Coppervm) StepBack() (UndoneInstruction, bool) {
+	log := vm.undoLog
+	if log == nil || log.count == 0 {
+		return UndoneInstruction{}, false
+	}
+	log.count--
+	entry := log.entries[(log.start+log.count)%len(log.entries)]
+	log.entries[(log.start+log.count)%len(log.entries)] = undoEntry{}
+
+	vm.lockSharedMemory()
+	for i := len(entry.memory) - 1; i >= 0; i-- {
+		copy(vm.Memory[entry.memory[i].addr:], entry.memory[i].old)
+	}
+	vm.unlockSharedMemory()
+	for _, change := range entry.stack {
+		vm.Stack[change.index] = change.old
+	}
+	if entry.callStackSize < int64(len(vm.CallStack)) {
+		vm.CallStack[entry.callStackSize] = entry.callStackSlot
+	}
+	if entry.tryStackSize < int64(len(vm.tryStack)) {
+		vm.tryStack[entry.tryStackSize] = entry.tryStackSlot
+	}
+	vm.Ip = entry.Ip
+	vm.StackSize = entry.stackSize
+	vm.CallStackSize = entry.callStackSize
+	vm.tryStackSize = entry.tryStackSize
+	vm.memoryBreak = entry.memoryBreak
+	vm.random.state = entry.random
+	vm.Halt = entry.halt
+	vm.ExitCode = entry.exitCode
+	if vm.gasTable != nil {
+		vm.gas = entry.gas + vm.gasTable.Cost(entry.Inst)
+	}
+	if entry.trapsSaved {
+		vm.traps = entry.traps
+	}
+	log.synced = false
+	return entry.UndoneInstruction, true
+}
+
+// Forget the recorded instructions.
+func (log *undoLog) clear() {
+	for i := range log.entries {
+		log.entries[i] = undoEntry{}
+	}
+	log.start = 0
+	log.count = 0
+	log.synced = false
+}
+
+func (log *undoLog) BeforeInstruction(vm *Coppervm, ip InstAddr, inst InstDef) {
+	if !log.synced {
+		log.shadow = append(log.shadow[:0], vm.Stack...)
+		log.synced = true
+	}
+	log.current = undoEntry{
+		UndoneInstruction: UndoneInstruction{Ip: ip, Inst: inst},
+		stackSize:         vm.StackSize,
+		callStackSize:     vm.CallStackSize,
+		tryStackSize:      vm.tryStackSize,
+		memoryBreak:       vm.memoryBreak,
+		random:            vm.random.state,
+		halt:              vm.Halt,
+		exitCode:          vm.ExitCode,
+		gas:               vm.gas,
+	}
+	if vm.CallStackSize < int64(len(vm.CallStack)) {
+		log.current.callStackSlot = vm.CallStack[vm.CallStackSize]
+	}
+	if vm.tryStackSize < int64(len(vm.tryStack)) {
+		log.current.tryStackSlot = vm.tryStack[vm.tryStackSize]
+	}
+	if inst.Kind == InstSyscall && SysCall(inst.Operand.AsU64) == SysCallTrap {
+		log.current.traps = map[CoppervmErrorKind]InstAddr{}
+		for kind, handler := range vm.traps {
+			log.current.traps[kind] = handler
+		}
+		log.current.trapsSaved = true
+	}
+	// print writes to the output and halt closes the files
+	if inst.Kind == InstPrint || inst.Kind == InstHalt {
+		log.current.SideEffects = true
+	}
+}
+
+func (log *undoLog) SyscallEnter(vm *Coppervm, sysCall SysCall) {
+	if !undoableSyscalls[sysCall] {
+		log.current.SideEffects = true
+	}
+}
+
+func (log *undoLog) MemoryWrite(vm *Coppervm, addr uint64, data []byte) {
+	end := addr + uint64(len(data))
+	if end > uint64(len(vm.Memory)) || end < addr {
+		return
+	}
+	vm.lockSharedMemory()
+	old := append([]byte{}, vm.Memory[addr:end]...)
+	vm.unlockSharedMemory()
+	log.current.memory = append(log.current.memory, memoryChange{addr: addr, old: old})
+}
+
+func (log *undoLog) AfterInstruction(vm *Coppervm, ip InstAddr, inst InstDef, err error) {
+	// The threads and the channels are not recorded, so
+	// nothing before them can be reverted
+	if vm.threads != nil || vm.channels != nil {
+		log.clear()
+		return
+	}
+
+	// The words above the stack size can be overwritten too, and
+	// they're visible again when the size is restored
+	size := log.current.stackSize
+	low := vm.StackSize
+	if vm.StackSize > size {
+		size, low = vm.StackSize, size
+	}
+	if size > int64(len(vm.Stack)) {
+		size = int64(len(vm.Stack))
+	}
+	// Only the words near the top of the stack are compared, except
+	// for swap, that reaches as deep as its operand, and for the
+	// syscalls, that can be registered from outside
+	switch inst.Kind {
+	case InstSwap:
+		low -= inst.Operand.AsI64 + 1
+	case InstSyscall:
+		low = 0
+	default:
+		low -= undoStackReach
+	}
+	if low < 0 {
+		low = 0
+	}
+	for i := low; i < size; i++ {
+		if !wordsIdentical(vm.Stack[i], log.shadow[i]) {
+			log.current.stack = append(log.current.stack, stackChange{index: i, old: log.shadow[i]})
+			log.shadow[i] = vm.Stack[i]
+		}
+	}
+
+	// Grow the log when it's full, and replace the oldest
+	// entry once it reached its capacity
+	if log.count == len(log.entries) && len(log.entries) < log.capacity {
+		log.grow()
+	}
+	if log.count == len(log.entries) {
+		log.start = (log.start + 1) % len(log.entries)
+		log.count--
+	}
+	log.entries[(log.start+log.count)%len(log.entries)] = log.current
+	log.count++
+	log.current = undoEntry{}
+}
+
+// Doubles the size of the log, up to its capacity, moving the
+// entries at the start of the new buffer.
+func (log *undoLog) grow() {
+	size := 2 * len(log.entries)
+	if size > log.capacity {
+		size = log.capacity
+	}
+	entries := make([]undoEntry, size)
+	for i := 0; i < log.count; i++ {
+		entries[i] = log.entries[(log.start+i)%len(log.entries)]
+	}
+	log.entries = entries
+	log.start = 0
+}
@@ -0,0 +1,158 @@
+package coppervm
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var undoTestProgram = []InstDef{
+	{Kind: InstPush, Operand: WordU64(1)},
+	{Kind: InstPush, Operand: WordU64(2)},
+	{Kind: InstSwap, Operand: WordU64(1)},
+	{Kind: InstDrop},
+	{Kind: InstPush, Operand: WordU64(7)},
+	{Kind: InstPush, Operand: WordU64(0)},
+	{Kind: InstMemWriteInt},
+	{Kind: InstFunCall, Operand: WordU64(11)},
+	{Kind: InstFunCall, Operand: WordU64(13)},
+	{Kind: InstPrint},
+	{Kind: InstHalt},
+	// Function at 11
+	{Kind: InstPush, Operand: WordU64(5)},
+	{Kind: InstFunReturn},
+	// Function at 13
+	{Kind: InstSyscall, Operand: WordU64(uint64(SysCallRand))},
+	{Kind: InstFunReturn},
+}
+
+// Visible state of a vm.
+type undoTestState struct {
+	ip        InstAddr
+	stack     []Word
+	callStack []InstAddr
+	memory    []byte
+	random    uint64
+	halt      bool
+}
+
+func captureUndoTestState(vm *Coppervm) undoTestState {
+	return undoTestState{
+		ip:        vm.Ip,
+		stack:     append([]Word{}, vm.Stack[:vm.StackSize]...),
+		callStack: append([]InstAddr{}, vm.CallStack[:vm.CallStackSize]...),
+		memory:    append([]byte{}, vm.Memory...),
+		random:    vm.random.state,
+		halt:      vm.Halt,
+	}
+}
+
+func TestStepBack(t *testing.T) {
+	var output bytes.Buffer
+	vm := NewCoppervm(WithDebugOutput(&output), WithMemoryCapacity(16))
+	vm.loadProgramFromMeta(FileMeta(0, undoTestProgram, []byte{}, DebugSymbols{}))
+	vm.EnableUndoLog(100)
+
+	var states []undoTestState
+	for !vm.Halt {
+		states = append(states, captureUndoTestState(vm))
+		assert.NoError(t, vm.ExecuteInstruction())
+	}
+	assert.Equal(t, len(states), vm.UndoLogSize())
+
+	for i := len(states) - 1; i >= 0; i-- {
+		undone, ok := vm.StepBack()
+		assert.True(t, ok)
+		assert.Equal(t, states[i], captureUndoTestState(vm), i)
+		assert.Equal(t, states[i].ip, undone.Ip)
+		kind := undoTestProgram[undone.Ip].Kind
+		assert.Equal(t, kind == InstPrint || kind == InstHalt, undone.SideEffects, i)
+	}
+	_, ok := vm.StepBack()
+	assert.False(t, ok)
+
+	// The output is not taken back, but the program runs again
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	assert.Equal(t, 2, bytes.Count(output.Bytes(), []byte("\n")))
+}
+
+func TestUndoLogCapacity(t *testing.T) {
+	vm := NewCoppervm(WithDebugOutput(&bytes.Buffer{}))
+	vm.loadProgramFromMeta(FileMeta(0, undoTestProgram, []byte{}, DebugSymbols{}))
+	vm.EnableUndoLog(2)
+	assert.NoError(t, vm.ExecuteProgram(5))
+	assert.Equal(t, 2, vm.UndoLogSize())
+
+	_, ok := vm.StepBack()
+	assert.True(t, ok)
+	_, ok = vm.StepBack()
+	assert.True(t, ok)
+	_, ok = vm.StepBack()
+	assert.False(t, ok)
+	assert.Equal(t, InstAddr(3), vm.Ip)
+
+	// Reset forgets the recorded instructions
+	assert.NoError(t, vm.ExecuteProgram(1))
+	vm.Reset()
+	assert.Equal(t, 0, vm.UndoLogSize())
+
+	// Without the undo log nothing is recorded
+	vm.DisableUndoLog()
+	assert.NoError(t, vm.ExecuteProgram(1))
+	_, ok = vm.StepBack()
+	assert.False(t, ok)
+	assert.Empty(t, vm.hooks)
+}
+
+func TestStepBackSideEffects(t *testing.T) {
+	fs := NewMemFileSystem()
+	vm := NewCoppervm(WithFileSystem(fs))
+	vm.loadProgramFromMeta(FileMeta(0, []InstDef{
+		{Kind: InstPush, Operand: WordU64(0)},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallUnlink))},
+		{Kind: InstSyscall, Operand: WordU64(uint64(SysCallRand))},
+	}, []byte("a.txt\x00"), DebugSymbols{}))
+	vm.EnableUndoLog(10)
+	assert.NoError(t, vm.ExecuteProgram(3))
+
+	undone, _ := vm.StepBack()
+	assert.False(t, undone.SideEffects)
+	undone, _ = vm.StepBack()
+	assert.True(t, undone.SideEffects)
+	assert.Equal(t, InstAddr(1), undone.Ip)
+}
+
+func TestUndoLogGrowth(t *testing.T) {
+	var program []InstDef
+	for i := 0; i < 100; i++ {
+		program = append(program, InstDef{Kind: InstPush, Operand: WordU64(uint64(i))})
+	}
+	program = append(program,
+		InstDef{Kind: InstSwap, Operand: WordU64(99)},
+		InstDef{Kind: InstAddInt},
+		InstDef{Kind: InstHalt},
+	)
+	vm := NewCoppervm(WithDebugOutput(&bytes.Buffer{}))
+	vm.loadProgramFromMeta(FileMeta(0, program, []byte{}, DebugSymbols{}))
+	vm.EnableUndoLog(100)
+	assert.Equal(t, undoLogInitialSize, len(vm.undoLog.entries))
+
+	var states []undoTestState
+	for !vm.Halt {
+		states = append(states, captureUndoTestState(vm))
+		assert.NoError(t, vm.ExecuteInstruction())
+	}
+	// The log grows up to its capacity and then drops
+	// the oldest instructions
+	assert.Equal(t, 100, vm.UndoLogSize())
+	assert.Equal(t, 100, len(vm.undoLog.entries))
+
+	for i := len(states) - 1; i >= len(states)-100; i-- {
+		_, ok := vm.StepBack()
+		assert.True(t, ok)
+		assert.Equal(t, states[i], captureUndoTestState(vm), i)
+	}
+	_, ok := vm.StepBack()
+	assert.False(t, ok)
+}
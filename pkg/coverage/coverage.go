@@ -0,0 +1,133 @@
+package coverage
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/Supercaly/coppervm/pkg/coppervm"
+)
+
+// Header of the coverage data files.
+const DataFileHeader string = "coppervm coverage"
+
+// Coverage counts how many times every instruction of a
+// program is executed.
+// Register it with coppervm.WithHook or Coppervm.AddHook.
+type Coverage struct {
+	coppervm.NoopHook
+
+	// Executions of every instruction address
+	Counts []uint64
+}
+
+// Create a new Coverage for a program with given
+// number of instructions.
+func New(programSize int) *Coverage {
+	return &Coverage{Counts: make([]uint64, programSize)}
+}
+
+func (c *Coverage) BeforeInstruction(vm *coppervm.Coppervm, ip coppervm.InstAddr, inst coppervm.InstDef) {
+	if ip < coppervm.InstAddr(len(c.Counts)) {
+		c.Counts[ip]++
+	}
+}
+
+// Add the counts of other coverage to this one.
+// Both coverages must come from the same program.
+func (c *Coverage) Merge(other *Coverage) error {
+	if len(c.Counts) != len(other.Counts) {
+		return fmt.Errorf("cannot merge the coverage of a program with %d instructions with one with %d",
+			len(other.Counts), len(c.Counts))
+	}
+	for addr, count := range other.Counts {
+		c.Counts[addr] += count
+	}
+	return nil
+}
+
+// Write the coverage in the data file format.
+// The file starts with the header and the size of the program
+// followed by a line with address and count for every executed
+// instruction.
+func (c *Coverage) WriteData(w io.Writer) error {
+	fmt.Fprintf(w, "%s\n", DataFileHeader)
+	fmt.Fprintf(w, "size %d\n", len(c.Counts))
+	for addr, count := range c.Counts {
+		if count == 0 {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%d %d\n", addr, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Parse a coverage from the data file format.
+func Parse(r io.Reader) (*Coverage, error) {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	next := func() (string, bool) {
+		line++
+		if !scanner.Scan() {
+			return "", false
+		}
+		return strings.TrimSpace(scanner.Text()), true
+	}
+
+	if header, ok := next(); !ok || header != DataFileHeader {
+		return nil, fmt.Errorf("not a coverage data file")
+	}
+	sizeLine, _ := next()
+	var size int
+	if _, err := fmt.Sscanf(sizeLine, "size %d", &size); err != nil || size < 0 {
+		return nil, fmt.Errorf("line %d: invalid program size '%s'", line, sizeLine)
+	}
+
+	cov := New(size)
+	for {
+		text, ok := next()
+		if !ok {
+			break
+		}
+		if text == "" {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected address and count", line)
+		}
+		addr, err := strconv.ParseUint(fields[0], 10, 64)
+		if err != nil || addr >= uint64(size) {
+			return nil, fmt.Errorf("line %d: invalid address '%s'", line, fields[0])
+		}
+		count, err := strconv.ParseUint(fields[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid count '%s'", line, fields[1])
+		}
+		cov.Counts[addr] += count
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cov, nil
+}
+
+// Read a coverage from a data file.
+func ReadFile(path string) (*Coverage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cov, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return cov, nil
+}
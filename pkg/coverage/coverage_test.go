@@ -0,0 +1,127 @@
+package coverage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/Supercaly/coppervm/pkg/coppervm"
+	"github.com/stretchr/testify/assert"
+)
+
+// Loop that runs twice and skips the last push.
+var testProgram = []coppervm.InstDef{
+	{Kind: coppervm.InstPush, Name: "push", Operand: coppervm.WordI64(2)},
+	{Kind: coppervm.InstPush, Name: "push", Operand: coppervm.WordI64(1)},
+	{Kind: coppervm.InstSubInt, Name: "sub"},
+	{Kind: coppervm.InstDup, Name: "dup"},
+	{Kind: coppervm.InstJmpNotZero, Name: "jnz", Operand: coppervm.WordU64(1)},
+	{Kind: coppervm.InstHalt, Name: "halt"},
+	{Kind: coppervm.InstPush, Name: "push", Operand: coppervm.WordI64(0)},
+}
+
+var testLines = []SourceLine{
+	{"main.casm", 2},
+	{"main.casm", 4},
+	{"main.casm", 5},
+	{"lib.casm", 1},
+	{"lib.casm", 1},
+	{"main.casm", 6},
+	{"main.casm", 7},
+}
+
+const testSource = `main:
+    push 2
+loop:
+    push 1
+    sub
+    halt
+    push 0
+`
+
+func runCoverage(t *testing.T) *Coverage {
+	cov := New(len(testProgram))
+	vm := coppervm.NewCoppervm(coppervm.WithHook(cov))
+	vm.Program = testProgram
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	return cov
+}
+
+func TestCoverage(t *testing.T) {
+	cov := runCoverage(t)
+	assert.Equal(t, []uint64{1, 2, 2, 2, 2, 1, 0}, cov.Counts)
+
+	assert.NoError(t, cov.Merge(runCoverage(t)))
+	assert.Equal(t, []uint64{2, 4, 4, 4, 4, 2, 0}, cov.Counts)
+	assert.Error(t, cov.Merge(New(1)))
+}
+
+func TestDataFile(t *testing.T) {
+	cov := runCoverage(t)
+
+	var out bytes.Buffer
+	assert.NoError(t, cov.WriteData(&out))
+	assert.Equal(t, "coppervm coverage\nsize 7\n0 1\n1 2\n2 2\n3 2\n4 2\n5 1\n", out.String())
+
+	parsed, err := Parse(&out)
+	assert.NoError(t, err)
+	assert.Equal(t, cov.Counts, parsed.Counts)
+
+	tests := []string{
+		"",
+		"wrong header\n",
+		"coppervm coverage\n",
+		"coppervm coverage\nsize -1\n",
+		"coppervm coverage\nsize 2\n0\n",
+		"coppervm coverage\nsize 2\n2 1\n",
+		"coppervm coverage\nsize 2\n0 a\n",
+	}
+	for _, test := range tests {
+		_, err := Parse(strings.NewReader(test))
+		assert.Error(t, err, test)
+	}
+}
+
+func TestFiles(t *testing.T) {
+	cov := runCoverage(t)
+
+	files, err := cov.Files(testLines)
+	assert.NoError(t, err)
+	assert.Equal(t, []FileCoverage{
+		{Name: "lib.casm", Lines: map[int]uint64{1: 2}},
+		{Name: "main.casm", Lines: map[int]uint64{2: 1, 4: 2, 5: 2, 6: 1, 7: 0}},
+	}, files)
+	assert.Equal(t, 4, files[1].Covered())
+
+	_, err = cov.Files(testLines[1:])
+	assert.Error(t, err)
+}
+
+func TestWriteLcov(t *testing.T) {
+	files, err := runCoverage(t).Files(testLines)
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, WriteLcov(&out, files))
+	assert.Equal(t, "TN:\nSF:lib.casm\nDA:1,2\nLF:1\nLH:1\nend_of_record\n"+
+		"TN:\nSF:main.casm\nDA:2,1\nDA:4,2\nDA:5,2\nDA:6,1\nDA:7,0\nLF:5\nLH:4\nend_of_record\n",
+		out.String())
+}
+
+func TestWriteAnnotated(t *testing.T) {
+	files, err := runCoverage(t).Files(testLines)
+	assert.NoError(t, err)
+
+	var out bytes.Buffer
+	assert.NoError(t, WriteAnnotated(&out, files[1], []byte(testSource)))
+	assert.Equal(t, `        -:    0:Source:main.casm
+        -:    0:Lines executed:80.00% of 5
+        -:    1:main:
+        1:    2:    push 2
+        -:    3:loop:
+        2:    4:    push 1
+        2:    5:    sub
+        1:    6:    halt
+    #####:    7:    push 0
+`, out.String())
+}
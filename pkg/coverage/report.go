@@ -0,0 +1,123 @@
+package coverage
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// A line of a source file, numbered from 1.
+type SourceLine struct {
+	File string
+	Line int
+}
+
+// Execution counts of the lines of a source file.
+type FileCoverage struct {
+	Name string
+	// Count of every line with at least one instruction
+	Lines map[int]uint64
+}
+
+// Returns the number of lines executed at least once.
+func (fc FileCoverage) Covered() int {
+	covered := 0
+	for _, count := range fc.Lines {
+		if count > 0 {
+			covered++
+		}
+	}
+	return covered
+}
+
+// Returns the numbers of the lines with instructions, sorted.
+func (fc FileCoverage) sortedLines() []int {
+	var lines []int
+	for line := range fc.Lines {
+		lines = append(lines, line)
+	}
+	sort.Ints(lines)
+	return lines
+}
+
+// Map the coverage of the instructions to the source lines
+// they come from; lines has the source line of every
+// instruction address.
+// The count of a line is the highest count of its instructions.
+// The files are sorted by name.
+func (c *Coverage) Files(lines []SourceLine) ([]FileCoverage, error) {
+	if len(lines) != len(c.Counts) {
+		return nil, fmt.Errorf("the coverage is of a program with %d instructions but the source has %d",
+			len(c.Counts), len(lines))
+	}
+
+	files := make(map[string]FileCoverage)
+	for addr, line := range lines {
+		fc, ok := files[line.File]
+		if !ok {
+			fc = FileCoverage{Name: line.File, Lines: make(map[int]uint64)}
+			files[line.File] = fc
+		}
+		if count, ok := fc.Lines[line.Line]; !ok || c.Counts[addr] > count {
+			fc.Lines[line.Line] = c.Counts[addr]
+		}
+	}
+
+	var out []FileCoverage
+	for _, fc := range files {
+		out = append(out, fc)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// Write the coverage of the files in the lcov tracefile format
+// read by genhtml and by the coverage viewers of the editors.
+func WriteLcov(w io.Writer, files []FileCoverage) error {
+	for _, fc := range files {
+		fmt.Fprintf(w, "TN:\n")
+		fmt.Fprintf(w, "SF:%s\n", fc.Name)
+		for _, line := range fc.sortedLines() {
+			fmt.Fprintf(w, "DA:%d,%d\n", line, fc.Lines[line])
+		}
+		fmt.Fprintf(w, "LF:%d\n", len(fc.Lines))
+		fmt.Fprintf(w, "LH:%d\n", fc.Covered())
+		if _, err := fmt.Fprintf(w, "end_of_record\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write the source of a file with every line prefixed by its
+// count in the style of gcov: lines without instructions are
+// marked with '-' and lines never executed with '#####'.
+func WriteAnnotated(w io.Writer, fc FileCoverage, source []byte) error {
+	fmt.Fprintf(w, "%9s:%5d:Source:%s\n", "-", 0, fc.Name)
+	percent := 0.0
+	if len(fc.Lines) > 0 {
+		percent = float64(fc.Covered()) * 100 / float64(len(fc.Lines))
+	}
+	fmt.Fprintf(w, "%9s:%5d:Lines executed:%.2f%% of %d\n", "-", 0, percent, len(fc.Lines))
+
+	scanner := bufio.NewScanner(bytes.NewReader(source))
+	line := 0
+	for scanner.Scan() {
+		line++
+		count, ok := fc.Lines[line]
+		prefix := "-"
+		if ok && count == 0 {
+			prefix = "#####"
+		} else if ok {
+			prefix = fmt.Sprintf("%d", count)
+		}
+		if _, err := fmt.Fprintf(w, "%9s:%5d:%s\n", prefix, line, scanner.Text()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,230 @@
+package profiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"sort"
+
+	"github.com/Supercaly/coppervm/pkg/coppervm"
+)
+
+// Field numbers of the messages in the pprof profile.proto
+// (https://github.com/google/pprof/blob/main/proto/profile.proto).
+const (
+	profileSampleType  = 1
+	profileSample      = 2
+	profileLocation    = 4
+	profileFunction    = 5
+	profileStringTable = 6
+	profilePeriodType  = 11
+	profilePeriod      = 12
+
+	valueTypeType = 1
+	valueTypeUnit = 2
+
+	sampleLocationId = 1
+	sampleValue      = 2
+
+	locationId      = 1
+	locationAddress = 3
+	locationLine    = 4
+
+	lineFunctionId = 1
+	lineLine       = 2
+
+	functionId         = 1
+	functionName       = 2
+	functionSystemName = 3
+	functionFilename   = 4
+	functionStartLine  = 5
+)
+
+// Writes the profile in the gzipped protocol buffer format read
+// by `go tool pprof`.
+// Every instruction is a sample of value 1; the locations are the
+// instruction addresses, with the source lines from the line table
+// or the addresses themselves as line numbers.
+func (p *Profiler) WritePprof(w io.Writer) error {
+	enc := pprofEncoder{
+		strings:   map[string]int64{"": 0},
+		functions: make(map[coppervm.InstAddr]uint64),
+		locations: make(map[pprofLocation]uint64),
+	}
+	enc.stringTable = []string{""}
+
+	var out protoBuffer
+	// Sample and period types
+	var valueType protoBuffer
+	valueType.int64Field(valueTypeType, enc.stringId("instructions"))
+	valueType.int64Field(valueTypeUnit, enc.stringId("count"))
+	out.messageField(profileSampleType, &valueType)
+	out.messageField(profilePeriodType, &valueType)
+	out.int64Field(profilePeriod, 1)
+
+	// Samples sorted so the output is deterministic
+	var samples []sample
+	for s := range p.samples {
+		samples = append(samples, s)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].stack != samples[j].stack {
+			return samples[i].stack < samples[j].stack
+		}
+		return samples[i].ip < samples[j].ip
+	})
+	for _, s := range samples {
+		// The locations go from the innermost function to the outermost
+		var ids []uint64
+		ip := s.ip
+		for id := s.stack; id >= 0; id = p.nodes[id].parent {
+			node := p.nodes[id]
+			ids = append(ids, enc.locationId(p, pprofLocation{ip: ip, entry: node.entry}))
+			ip = node.callSite
+		}
+
+		var msg protoBuffer
+		msg.packedUint64Field(sampleLocationId, ids)
+		msg.packedUint64Field(sampleValue, []uint64{p.samples[s]})
+		out.messageField(profileSample, &msg)
+	}
+
+	out.Write(enc.locationsData.Bytes())
+	out.Write(enc.functionsData.Bytes())
+	for _, str := range enc.stringTable {
+		out.stringField(profileStringTable, str)
+	}
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(out.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// An instruction address inside the function starting at entry.
+type pprofLocation struct {
+	ip    coppervm.InstAddr
+	entry coppervm.InstAddr
+}
+
+// State used to write the tables of the profile.
+type pprofEncoder struct {
+	strings     map[string]int64
+	stringTable []string
+
+	functions     map[coppervm.InstAddr]uint64
+	functionsData protoBuffer
+
+	locations     map[pprofLocation]uint64
+	locationsData protoBuffer
+}
+
+// Returns the index of a string in the string table.
+func (enc *pprofEncoder) stringId(str string) int64 {
+	if id, ok := enc.strings[str]; ok {
+		return id
+	}
+	enc.stringTable = append(enc.stringTable, str)
+	enc.strings[str] = int64(len(enc.stringTable) - 1)
+	return enc.strings[str]
+}
+
+// Returns the id of the function starting at given address,
+// writing it to the functions table if it's new.
+func (enc *pprofEncoder) functionId(p *Profiler, entry coppervm.InstAddr) uint64 {
+	if id, ok := enc.functions[entry]; ok {
+		return id
+	}
+	id := uint64(len(enc.functions) + 1)
+	enc.functions[entry] = id
+
+	name := enc.stringId(p.functionName(entry))
+	var msg protoBuffer
+	msg.uint64Field(functionId, id)
+	msg.int64Field(functionName, name)
+	msg.int64Field(functionSystemName, name)
+	if loc, ok := p.lineTable.Lookup(entry); ok {
+		msg.int64Field(functionFilename, enc.stringId(loc.File))
+		msg.int64Field(functionStartLine, int64(loc.Row))
+	}
+	enc.functionsData.messageField(profileFunction, &msg)
+	return id
+}
+
+// Returns the id of a location, writing it to the locations
+// table if it's new.
+func (enc *pprofEncoder) locationId(p *Profiler, loc pprofLocation) uint64 {
+	if id, ok := enc.locations[loc]; ok {
+		return id
+	}
+	id := uint64(len(enc.locations) + 1)
+	enc.locations[loc] = id
+
+	lineNumber := int64(loc.ip)
+	if source, ok := p.lineTable.Lookup(loc.ip); ok {
+		lineNumber = int64(source.Row)
+	}
+	var line protoBuffer
+	line.uint64Field(lineFunctionId, enc.functionId(p, loc.entry))
+	line.int64Field(lineLine, lineNumber)
+
+	var msg protoBuffer
+	msg.uint64Field(locationId, id)
+	msg.uint64Field(locationAddress, uint64(loc.ip))
+	msg.messageField(locationLine, &line)
+	enc.locationsData.messageField(profileLocation, &msg)
+	return id
+}
+
+// Minimal protocol buffer encoder for the messages
+// of the profile.
+type protoBuffer struct {
+	bytes.Buffer
+}
+
+const (
+	wireVarint          = 0
+	wireLengthDelimited = 2
+)
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.WriteByte(byte(v) | 0x80)
+		v >>= 7
+	}
+	b.WriteByte(byte(v))
+}
+
+func (b *protoBuffer) key(field int, wireType int) {
+	b.varint(uint64(field)<<3 | uint64(wireType))
+}
+
+func (b *protoBuffer) uint64Field(field int, v uint64) {
+	b.key(field, wireVarint)
+	b.varint(v)
+}
+
+func (b *protoBuffer) int64Field(field int, v int64) {
+	b.uint64Field(field, uint64(v))
+}
+
+func (b *protoBuffer) stringField(field int, str string) {
+	b.key(field, wireLengthDelimited)
+	b.varint(uint64(len(str)))
+	b.WriteString(str)
+}
+
+func (b *protoBuffer) messageField(field int, msg *protoBuffer) {
+	b.key(field, wireLengthDelimited)
+	b.varint(uint64(msg.Len()))
+	b.Write(msg.Bytes())
+}
+
+func (b *protoBuffer) packedUint64Field(field int, vs []uint64) {
+	var packed protoBuffer
+	for _, v := range vs {
+		packed.varint(v)
+	}
+	b.messageField(field, &packed)
+}
@@ -0,0 +1,247 @@
+package profiler
+
+import (
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Supercaly/coppervm/pkg/coppervm"
+)
+
+// Number of instructions listed in the hot instructions
+// section of the text report.
+const ReportHotInstructions int = 20
+
+// Profiler counts the instructions executed by a vm.
+// Every instruction is attributed to the function it runs in,
+// tracked with the call and ret instructions; the functions are
+// named after the nearest debug symbol before their first
+// instruction and the line table maps the instructions back to
+// their source lines.
+// Register it with coppervm.WithHook or Coppervm.AddHook.
+type Profiler struct {
+	coppervm.NoopHook
+
+	program   []coppervm.InstDef
+	symbols   coppervm.DebugSymbols
+	lineTable coppervm.LineTable
+
+	// Executions of every instruction address
+	counts []uint64
+	total  uint64
+
+	// Interned call stacks; a stack is identified by
+	// its index in nodes
+	nodes   []stackNode
+	nodeIds map[stackNode]int
+	// Active functions of every thread, the innermost
+	// is the last one
+	frames [][]int
+
+	// Executions of every address in a given call stack
+	samples map[sample]uint64
+}
+
+// A function called at callSite inside the stack parent.
+// The stack of the first function has parent -1.
+type stackNode struct {
+	parent   int
+	callSite coppervm.InstAddr
+	entry    coppervm.InstAddr
+}
+
+type sample struct {
+	stack int
+	ip    coppervm.InstAddr
+}
+
+// Create a new Profiler for given program; the debug symbols
+// and the line table can be empty.
+func New(program []coppervm.InstDef, symbols coppervm.DebugSymbols, lineTable coppervm.LineTable) *Profiler {
+	return &Profiler{
+		program:   program,
+		symbols:   symbols,
+		lineTable: lineTable,
+		counts:    make([]uint64, len(program)),
+		nodeIds:   make(map[stackNode]int),
+		samples:   make(map[sample]uint64),
+	}
+}
+
+func (p *Profiler) BeforeInstruction(vm *coppervm.Coppervm, ip coppervm.InstAddr, inst coppervm.InstDef) {
+	frames := p.threadFrames(vm)
+	// The first instruction of a thread is the entry of
+	// its outermost function
+	if len(*frames) == 0 {
+		*frames = append(*frames, p.intern(stackNode{parent: -1, entry: ip}))
+	}
+	if ip < coppervm.InstAddr(len(p.counts)) {
+		p.counts[ip]++
+	}
+	p.total++
+	p.samples[sample{stack: (*frames)[len(*frames)-1], ip: ip}]++
+}
+
+func (p *Profiler) Call(vm *coppervm.Coppervm, from coppervm.InstAddr, to coppervm.InstAddr) {
+	frames := p.threadFrames(vm)
+	*frames = append(*frames, p.intern(stackNode{
+		parent:   (*frames)[len(*frames)-1],
+		callSite: from,
+		entry:    to,
+	}))
+}
+
+func (p *Profiler) Return(vm *coppervm.Coppervm, from coppervm.InstAddr, to coppervm.InstAddr) {
+	// A ret without call leaves the program outside any function
+	// we know about, so it stays in the outermost one
+	frames := p.threadFrames(vm)
+	if len(*frames) > 1 {
+		*frames = (*frames)[:len(*frames)-1]
+	}
+}
+
+// Returns the active functions of the running thread.
+func (p *Profiler) threadFrames(vm *coppervm.Coppervm) *[]int {
+	thread := int(vm.CurrentThread())
+	for len(p.frames) <= thread {
+		p.frames = append(p.frames, nil)
+	}
+	return &p.frames[thread]
+}
+
+// Returns the id of a call stack, adding it if it's new.
+func (p *Profiler) intern(node stackNode) int {
+	if id, ok := p.nodeIds[node]; ok {
+		return id
+	}
+	p.nodes = append(p.nodes, node)
+	p.nodeIds[node] = len(p.nodes) - 1
+	return len(p.nodes) - 1
+}
+
+// Returns the number of executed instructions.
+func (p *Profiler) Total() uint64 {
+	return p.total
+}
+
+// Returns how many times the instruction at given address
+// was executed.
+func (p *Profiler) Count(addr coppervm.InstAddr) uint64 {
+	if addr >= coppervm.InstAddr(len(p.counts)) {
+		return 0
+	}
+	return p.counts[addr]
+}
+
+// Counts of the instructions executed by a function.
+type FunctionProfile struct {
+	Name  string
+	Entry coppervm.InstAddr
+	// Instructions executed by the function itself
+	Self uint64
+	// Instructions executed by the function and by the
+	// functions it called
+	Cumulative uint64
+}
+
+// Returns the profile of every function that executed at
+// least one instruction, sorted by decreasing self count.
+func (p *Profiler) Functions() []FunctionProfile {
+	profiles := make(map[coppervm.InstAddr]*FunctionProfile)
+	get := func(entry coppervm.InstAddr) *FunctionProfile {
+		if f, ok := profiles[entry]; ok {
+			return f
+		}
+		f := &FunctionProfile{Name: p.functionName(entry), Entry: entry}
+		profiles[entry] = f
+		return f
+	}
+
+	for s, count := range p.samples {
+		get(p.nodes[s.stack].entry).Self += count
+
+		// Recursive functions count only once in a stack
+		seen := make(map[coppervm.InstAddr]bool)
+		for id := s.stack; id >= 0; id = p.nodes[id].parent {
+			entry := p.nodes[id].entry
+			if !seen[entry] {
+				seen[entry] = true
+				get(entry).Cumulative += count
+			}
+		}
+	}
+
+	var out []FunctionProfile
+	for _, f := range profiles {
+		out = append(out, *f)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Self != out[j].Self {
+			return out[i].Self > out[j].Self
+		}
+		return out[i].Entry < out[j].Entry
+	})
+	return out
+}
+
+// Returns the name of the function starting at given address.
+func (p *Profiler) functionName(entry coppervm.InstAddr) string {
+	if name := p.symbols.Symbolize(entry); name != "" {
+		return name
+	}
+	return fmt.Sprintf("func_%d", entry)
+}
+
+// Writes a human readable report with the self and cumulative
+// counts of the functions and the most executed instructions.
+func (p *Profiler) WriteReport(w io.Writer) error {
+	fmt.Fprintf(w, "Total instructions: %d\n", p.total)
+
+	fmt.Fprintf(w, "\nFunctions:\n")
+	fmt.Fprintf(w, "%12s %7s %12s %7s  %s\n", "self", "self%", "cum", "cum%", "function")
+	for _, f := range p.Functions() {
+		fmt.Fprintf(w, "%12d %6.2f%% %12d %6.2f%%  %s\n",
+			f.Self, p.percent(f.Self),
+			f.Cumulative, p.percent(f.Cumulative),
+			f.Name)
+	}
+
+	var addrs []coppervm.InstAddr
+	for addr, count := range p.counts {
+		if count > 0 {
+			addrs = append(addrs, coppervm.InstAddr(addr))
+		}
+	}
+	sort.SliceStable(addrs, func(i, j int) bool {
+		return p.counts[addrs[i]] > p.counts[addrs[j]]
+	})
+	if len(addrs) > ReportHotInstructions {
+		addrs = addrs[:ReportHotInstructions]
+	}
+
+	fmt.Fprintf(w, "\nHot instructions:\n")
+	fmt.Fprintf(w, "%12s %7s %8s  %s\n", "count", "count%", "address", "instruction")
+	for _, addr := range addrs {
+		location := p.symbols.Symbolize(addr)
+		if location != "" {
+			location = fmt.Sprintf(" (%s)", location)
+		}
+		if loc, ok := p.lineTable.Lookup(addr); ok {
+			location += fmt.Sprintf(" at %s", loc)
+		}
+		_, err := fmt.Fprintf(w, "%12d %6.2f%% %8d  %s%s\n",
+			p.counts[addr], p.percent(p.counts[addr]),
+			addr, p.program[addr].Name, location)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Profiler) percent(count uint64) float64 {
+	if p.total == 0 {
+		return 0
+	}
+	return float64(count) * 100 / float64(p.total)
+}
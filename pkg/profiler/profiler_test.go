@@ -0,0 +1,152 @@
+package profiler
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/Supercaly/coppervm/pkg/coppervm"
+	"github.com/stretchr/testify/assert"
+)
+
+// main calls twice f that calls g once.
+var testProgram = []coppervm.InstDef{
+	{Kind: coppervm.InstFunCall, Name: "call", Operand: coppervm.WordU64(3)},
+	{Kind: coppervm.InstFunCall, Name: "call", Operand: coppervm.WordU64(3)},
+	{Kind: coppervm.InstHalt, Name: "halt"},
+	{Kind: coppervm.InstNoop, Name: "noop"},
+	{Kind: coppervm.InstFunCall, Name: "call", Operand: coppervm.WordU64(6)},
+	{Kind: coppervm.InstFunReturn, Name: "ret"},
+	{Kind: coppervm.InstNoop, Name: "noop"},
+	{Kind: coppervm.InstNoop, Name: "noop"},
+	{Kind: coppervm.InstFunReturn, Name: "ret"},
+}
+
+var testSymbols = coppervm.DebugSymbols{
+	{Name: "main", Address: 0},
+	{Name: "f", Address: 3},
+	{Name: "g", Address: 6},
+}
+
+var testLineTable = coppervm.LineTable{
+	{Address: 0, File: "main.casm", Row: 4, Col: 5},
+	{Address: 1, File: "main.casm", Row: 5, Col: 5},
+	{Address: 2, File: "main.casm", Row: 6, Col: 5},
+	{Address: 3, File: "lib.casm", Row: 2, Col: 5},
+	{Address: 4, File: "lib.casm", Row: 3, Col: 5},
+	{Address: 5, File: "lib.casm", Row: 4, Col: 5},
+	{Address: 6, File: "lib.casm", Row: 7, Col: 5},
+	{Address: 7, File: "lib.casm", Row: 8, Col: 5},
+	{Address: 8, File: "lib.casm", Row: 9, Col: 5},
+}
+
+func runProfiler(t *testing.T, symbols coppervm.DebugSymbols) *Profiler {
+	return runProfilerWithLines(t, symbols, nil)
+}
+
+func runProfilerWithLines(t *testing.T, symbols coppervm.DebugSymbols, lineTable coppervm.LineTable) *Profiler {
+	prof := New(testProgram, symbols, lineTable)
+	vm := coppervm.NewCoppervm(coppervm.WithHook(prof))
+	vm.Program = testProgram
+	assert.NoError(t, vm.ExecuteProgram(-1))
+	return prof
+}
+
+func TestProfiler(t *testing.T) {
+	prof := runProfiler(t, testSymbols)
+
+	assert.Equal(t, uint64(15), prof.Total())
+	assert.Equal(t, uint64(1), prof.Count(0))
+	assert.Equal(t, uint64(2), prof.Count(3))
+	assert.Equal(t, uint64(2), prof.Count(8))
+	assert.Equal(t, uint64(0), prof.Count(100))
+
+	assert.Equal(t, []FunctionProfile{
+		{Name: "f", Entry: 3, Self: 6, Cumulative: 12},
+		{Name: "g", Entry: 6, Self: 6, Cumulative: 6},
+		{Name: "main", Entry: 0, Self: 3, Cumulative: 15},
+	}, prof.Functions())
+
+	// Without symbols the functions are named by address
+	prof = runProfiler(t, coppervm.DebugSymbols{})
+	assert.Equal(t, "func_3", prof.Functions()[0].Name)
+}
+
+func TestWriteReport(t *testing.T) {
+	prof := runProfiler(t, testSymbols)
+
+	var out bytes.Buffer
+	assert.NoError(t, prof.WriteReport(&out))
+	report := out.String()
+	assert.True(t, strings.HasPrefix(report, "Total instructions: 15\n"))
+	assert.Contains(t, report, "           6  40.00%           12  80.00%  f\n")
+	assert.Contains(t, report, "           2  13.33%        8  ret (g+2)\n")
+
+	// With the line table the instructions have the source location
+	prof = runProfilerWithLines(t, testSymbols, testLineTable)
+	out.Reset()
+	assert.NoError(t, prof.WriteReport(&out))
+	assert.Contains(t, out.String(), "           2  13.33%        8  ret (g+2) at lib.casm:9:5\n")
+}
+
+func TestWritePprof(t *testing.T) {
+	prof := runProfiler(t, testSymbols)
+
+	var out bytes.Buffer
+	assert.NoError(t, prof.WritePprof(&out))
+	gz, err := gzip.NewReader(&out)
+	assert.NoError(t, err)
+	data, err := ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+
+	// Decode the top level fields of the profile
+	var strs []string
+	var samples, locations, functions int
+	var total uint64
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		if key&7 == wireVarint {
+			_, n = binary.Uvarint(data)
+			data = data[n:]
+			continue
+		}
+		size, n := binary.Uvarint(data)
+		field := data[n : n+int(size)]
+		data = data[n+int(size):]
+
+		switch key >> 3 {
+		case profileSample:
+			samples++
+			// The value is the last packed field
+			total += uint64(field[len(field)-1])
+		case profileLocation:
+			locations++
+		case profileFunction:
+			functions++
+		case profileStringTable:
+			strs = append(strs, string(field))
+		}
+	}
+
+	assert.Equal(t, prof.Total(), total)
+	assert.Equal(t, 3, functions)
+	assert.Equal(t, 9, locations)
+	// f is called from two places, so it has two call stacks
+	assert.Equal(t, 15, samples)
+	assert.Equal(t, []string{"", "instructions", "count", "main", "f", "g"}, strs)
+
+	// With the line table the functions have their source file
+	prof = runProfilerWithLines(t, testSymbols, testLineTable)
+	out.Reset()
+	assert.NoError(t, prof.WritePprof(&out))
+	gz, err = gzip.NewReader(&out)
+	assert.NoError(t, err)
+	data, err = ioutil.ReadAll(gz)
+	assert.NoError(t, err)
+	assert.True(t, bytes.Contains(data, []byte("main.casm")))
+	assert.True(t, bytes.Contains(data, []byte("lib.casm")))
+}
@@ -8,6 +8,11 @@ examples=$(find examples/ -maxdepth 1 -name "*.casm" -type f)
 for e in $examples; do
     name=$(basename $e)
     name=${name%.casm}
+    # The threads and the traps are available only on the copper vm
+    if grep -q -e '%include "thread.casm"' -e '%include "trap.casm"' $e; then
+        echo "Skip '$e'"
+        continue
+    fi
     ./build/casm -t x86-64linux -o "examples/bin/$name.asm" $e -I stdlib/
     nasm -felf64 "examples/bin/$name.asm"
     ld -o "examples/bin/$name" "examples/bin/$name.o"
@@ -5,7 +5,7 @@ set CMD_DIR=cmd
 
 if not exist "%BUILD_DIR%" mkdir %BUILD_DIR%
 
-go build -o "%BUILD_DIR%/casm.exe" "%CMD_DIR%/casm/casm.go"
-go build -o "%BUILD_DIR%/deasm.exe" "%CMD_DIR%/deasm/deasm.go"
-go build -o "%BUILD_DIR%/emulator.exe" "%CMD_DIR%/emulator/emulator.go"
-go build -o "%BUILD_DIR%/copperdb.exe" "%CMD_DIR%/copperdb/copperdb.go"
+go build -o "%BUILD_DIR%/casm.exe" "./%CMD_DIR%/casm"
+go build -o "%BUILD_DIR%/deasm.exe" "./%CMD_DIR%/deasm"
+go build -o "%BUILD_DIR%/emulator.exe" "./%CMD_DIR%/emulator"
+go build -o "%BUILD_DIR%/copperdb.exe" "./%CMD_DIR%/copperdb"
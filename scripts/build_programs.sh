@@ -7,7 +7,7 @@ CMD_DIR=cmd
 
 mkdir -p $BUILD_DIR
 
-go build -o $BUILD_DIR/casm $CMD_DIR/casm/casm.go
-go build -o $BUILD_DIR/deasm $CMD_DIR/deasm/deasm.go
-go build -o $BUILD_DIR/emulator $CMD_DIR/emulator/emulator.go
-go build -o $BUILD_DIR/copperdb $CMD_DIR/copperdb/copperdb.go
+go build -o $BUILD_DIR/casm ./$CMD_DIR/casm
+go build -o $BUILD_DIR/deasm ./$CMD_DIR/deasm
+go build -o $BUILD_DIR/emulator ./$CMD_DIR/emulator
+go build -o $BUILD_DIR/copperdb ./$CMD_DIR/copperdb
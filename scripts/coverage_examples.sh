@@ -0,0 +1,16 @@
+#! /bin/sh
+
+set -e
+
+mkdir -p build/coverage
+rm -f build/coverage/*
+
+examples=$(find examples/ -maxdepth 1 -name "*.casm" -type f)
+for e in $examples; do
+    name=$(basename $e)
+    name=${name%.casm}
+    ./build/casm -t copper -o "build/coverage/$name.copper" $e -I stdlib/ > /dev/null
+    ./build/emulator -coverage "build/coverage/$name.cov" "build/coverage/$name.copper" > /dev/null
+    ./build/casm -coverage "build/coverage/$name.cov" -lcov "build/coverage/$name.info" $e -I stdlib/ > "build/coverage/$name.txt"
+    echo "Coverage of '$e' saved to 'build/coverage/$name.txt'"
+done
@@ -2,10 +2,10 @@
 
 set CMD_DIR="cmd"
 
-go install "%CMD_DIR%/casm/casm.go"
-go install "%CMD_DIR%/deasm/deasm.go"
-go install "%CMD_DIR%/emulator/emulator.go"
-go install "%CMD_DIR%/copperdb/copperdb.go"
+go install "./%CMD_DIR%/casm"
+go install "./%CMD_DIR%/deasm"
+go install "./%CMD_DIR%/emulator"
+go install "./%CMD_DIR%/copperdb"
 
 for /f %%i in ('go env GOPATH') do set GOPATH=%%i
 
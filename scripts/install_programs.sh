@@ -4,10 +4,10 @@ set -e
 
 CMD_DIR="cmd"
 
-go install "$CMD_DIR/casm/casm.go"
-go install "$CMD_DIR/deasm/deasm.go"
-go install "$CMD_DIR/emulator/emulator.go"
-go install "$CMD_DIR/copperdb/copperdb.go"
+go install "./$CMD_DIR/casm"
+go install "./$CMD_DIR/deasm"
+go install "./$CMD_DIR/emulator"
+go install "./$CMD_DIR/copperdb"
 
 GOPATH=$(go env GOPATH)
 